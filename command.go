@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	devs "github.com/beanz/udin2mqtt-go/pkg/devices"
+
+	"github.com/spf13/viper"
+)
+
+// runCommand runs the export and import commands. They use the API of
+// a running bridge so that imports are validated against its UDIN
+// devices and announced to Home Assistant.
+func runCommand(args []string, stdout io.Writer, v *viper.Viper) error {
+	fs := flag.NewFlagSet(appName+" "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	api := fs.String("url", "http://"+v.GetString("UI_Advertise"),
+		"URL of the bridge UI")
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch args[0] {
+	case "export":
+		format := fs.String("format", "json", "output format, json or yaml")
+		codes := fs.Bool("codes", false,
+			"include lock codes instead of redacting them")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		resp, err := client.Get(fmt.Sprintf("%s/api/export?format=%s&codes=%t",
+			*api, url.QueryEscape(*format), *codes))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	case "import":
+		dryRun := fs.Bool("dry-run", false,
+			"show the changes without applying them")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: %s import [-dry-run] <file|->", appName)
+		}
+		var b []byte
+		var err error
+		if fs.Arg(0) == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(fs.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(
+			fmt.Sprintf("%s/api/import?dry_run=%t", *api, *dryRun),
+			"application/octet-stream", bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		var res struct {
+			Message string               `json:"message"`
+			Changes []*devs.ImportChange `json:"changes"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		if err != nil {
+			return err
+		}
+		for _, c := range res.Changes {
+			fmt.Fprintf(stdout, "%-9s %s\n", c.Action, c.Device)
+			for _, d := range c.Diff {
+				fmt.Fprintf(stdout, "          %s\n", d)
+			}
+		}
+		fmt.Fprintln(stdout, res.Message)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s, expected export or import",
+			args[0])
+	}
+}
+
+// responseError returns an error describing a failed API request.
+func responseError(resp *http.Response) error {
+	var res struct {
+		Message string                  `json:"message"`
+		Errors  []*devs.ValidationError `json:"errors"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("request failed: %s", resp.Status)
+	}
+	if len(res.Errors) > 0 {
+		return devs.ValidationErrors(res.Errors)
+	}
+	return fmt.Errorf("request failed: %s", res.Message)
+}
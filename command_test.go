@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	devs "github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/beanz/udin2mqtt-go/pkg/ui"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExportImportCommands(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	devices := devs.NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = devices.Create(
+		[]string{"blind", "0", "udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devices.Create([]string{"door", "2", "udin_8r-r7"}, true, "")
+	assert.NoError(t, err)
+	devices.Device("door").Code = "1234"
+	ch := make(chan ui.UIEvent, 1)
+	// the router parses index.html relative to the working directory
+	srv := httptest.NewServer(
+		ui.NewUI(devices, Version, 1).CreateRouter(os.Stderr, ch))
+	defer srv.Close()
+	v := viper.New()
+
+	var out bytes.Buffer
+	err = runCommand([]string{"export", "-url", srv.URL, "-format", "yaml"},
+		&out, v)
+	assert.NoError(t, err)
+	exported := out.String()
+	assert.Contains(t, exported, "kind: momentaryopenclose")
+	assert.Contains(t, exported, "code: REDACTED")
+
+	out.Reset()
+	err = runCommand([]string{"export", "-url", srv.URL, "-codes"}, &out, v)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `"code": "1234"`)
+
+	file := filepath.Join(t.TempDir(), "devices.yaml")
+	assert.NoError(t, os.WriteFile(file,
+		[]byte(strings.Replace(exported, "udin_8r-r2", "udin_8r-r3", 1)),
+		0o600))
+	out.Reset()
+	err = runCommand([]string{"import", "-url", srv.URL, "-dry-run", file},
+		&out, v)
+	assert.NoError(t, err)
+	assert.Equal(t, "update    blind\n"+
+		"          def: [udin_8r-r1 udin_8r-r2] -> [udin_8r-r1 udin_8r-r3]\n"+
+		"unchanged door\n"+
+		"dry run, no devices changed\n", out.String())
+	assert.Empty(t, ch)
+
+	out.Reset()
+	err = runCommand([]string{"import", "-url", srv.URL, file}, &out, v)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "importing 2 devices")
+	assert.Equal(t, ui.UIImportEvent, (<-ch).Kind)
+
+	assert.NoError(t, os.WriteFile(file, []byte(
+		`{"devices":{"door":{"kind":"2","def":["udin_8r-r2"]}}}`), 0o600))
+	err = runCommand([]string{"import", "-url", srv.URL, file}, &out, v)
+	assert.EqualError(t, err,
+		`device door: def[0] "udin_8r-r2": relay already used by blind`)
+
+	err = runCommand([]string{"import", "-url", srv.URL}, &out, v)
+	assert.Error(t, err)
+	err = runCommand([]string{"frobnicate"}, &out, v)
+	assert.EqualError(t, err,
+		"unknown command frobnicate, expected export or import")
+}
@@ -5,15 +5,17 @@ go 1.17
 require (
 	github.com/acomagu/bufpipe v1.0.3
 	github.com/beanz/homeassistant-go v0.0.0-20211127150436-a7bcfaba0507
+	github.com/eclipse/paho.golang v0.10.0
 	github.com/go-chi/chi v1.5.4
 	github.com/spf13/viper v1.9.0
 	github.com/stretchr/testify v1.7.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	go.starlark.net v0.0.0-20211013185944-b0039bd2cfe3
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/eclipse/paho.golang v0.10.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
@@ -31,5 +33,4 @@ require (
 	golang.org/x/text v0.3.6 // indirect
 	gopkg.in/ini.v1 v1.63.2 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
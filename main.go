@@ -3,17 +3,29 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/beanz/udin2mqtt-go/pkg/automation"
+	"github.com/beanz/udin2mqtt-go/pkg/broker"
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
 	devs "github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/diag"
+	"github.com/beanz/udin2mqtt-go/pkg/limit"
+	"github.com/beanz/udin2mqtt-go/pkg/meter"
+	"github.com/beanz/udin2mqtt-go/pkg/schedule"
+	devstore "github.com/beanz/udin2mqtt-go/pkg/store"
 	"github.com/beanz/udin2mqtt-go/pkg/udin"
 	"github.com/beanz/udin2mqtt-go/pkg/ui"
 
@@ -60,6 +72,27 @@ func run(args []string, stdout io.Writer, v *viper.Viper) error {
 	v.SetDefault("Verbose", 0)
 	v.SetDefault("App_Name", appName)
 	v.SetDefault("device", map[string]interface{}{})
+	v.SetDefault("Device_Store", "")
+	v.SetDefault("Types_Dir", "")
+	v.SetDefault("Input_Poll_Interval", 50*time.Millisecond)
+	v.SetDefault("Long_Press", automation.DefaultPressTimings.Long)
+	v.SetDefault("Double_Press", automation.DefaultPressTimings.Double)
+	v.SetDefault("Meter_Rate_Window", 15*time.Minute)
+	v.SetDefault("Meter_Update_Interval", time.Minute)
+	v.SetDefault("Command_Interval", 0)
+	v.SetDefault("Command_Policy", limit.Coalesce)
+	v.SetDefault("Command_Queue", limit.DefaultQueueLength)
+	v.SetDefault("Diagnostics_Interval", 10*time.Second)
+	v.SetDefault("Watchdog_Interval", time.Second)
+	v.SetDefault("Bridge_State_Interval", time.Minute)
+	v.SetDefault("Bridge_Log", false)
+	v.SetDefault("Broker_Username", "")
+	v.SetDefault("Broker_Password", "")
+	v.SetDefault("Broker_Password_File", "")
+	v.SetDefault("Broker_CA_File", "")
+	v.SetDefault("Broker_Cert_File", "")
+	v.SetDefault("Broker_Key_File", "")
+	v.SetDefault("Broker_Insecure_Skip_Verify", false)
 	v.SetConfigName(appName)
 	v.SetConfigType("yaml")
 	v.AddConfigPath("/etc/" + appName)
@@ -70,10 +103,24 @@ func run(args []string, stdout io.Writer, v *viper.Viper) error {
 		return fmt.Errorf("config file error: %+v", err)
 	}
 
+	if v.GetString("Device_Store") == "" {
+		v.Set("Device_Store", filepath.Join(
+			filepath.Dir(v.ConfigFileUsed()), appName+"-devices.json"))
+	}
+
+	if v.GetString("Types_Dir") == "" {
+		v.Set("Types_Dir", filepath.Join(
+			filepath.Dir(v.ConfigFileUsed()), "types"))
+	}
+
 	if v.GetString("UI_Advertise") == "" {
 		v.Set("UI_Advertise", v.GetString("UI"))
 	}
 
+	if len(args) > 1 {
+		return runCommand(args[1:], stdout, v)
+	}
+
 	if v.GetInt("Verbose") > 0 {
 		settings, err := json.MarshalIndent(v.AllSettings(), "", "  ")
 		if err != nil {
@@ -97,15 +144,6 @@ func run(args []string, stdout io.Writer, v *viper.Viper) error {
 		name := uidSafe(u.Name())
 		logger.Printf("found UDIN device %s\n", u)
 		udins[name] = u
-		logger.Printf("Resetting relays\n")
-		err = u.Status(0) // query status
-		if err != nil {
-			return fmt.Errorf("failed to query status: %+v", err)
-		}
-		err = u.Off(0) // switch off all relays on startup
-		if err != nil {
-			return fmt.Errorf("failed to reset device: %+v", err)
-		}
 	}
 
 	// Set up channel on which to send signal notifications.
@@ -118,31 +156,238 @@ func run(args []string, stdout io.Writer, v *viper.Viper) error {
 	msgs := make(chan *mqtt.Msg, 50)
 	errCh := make(chan error, 1)
 
+	types, err := devs.LoadScripts(v.GetString("Types_Dir"))
+	if err != nil {
+		return fmt.Errorf("failed to load device types: %+v", err)
+	}
+	for _, t := range types {
+		logger.Printf("loaded device type %s\n", t)
+	}
+
 	devices := devs.NewDevices(udins)
-	for name := range v.GetStringMap("device") {
-		args := []string{name, v.GetString("device." + name + ".kind")}
-		args = append(args, v.GetStringSlice("device."+name+".def")...)
-		enabled := v.GetBool("device." + name + ".enabled")
-		icon := v.GetString("device." + name + ".icon")
-		dev, err := devices.Create(args, enabled, icon)
+	store := devstore.New(v.GetString("Device_Store"))
+	f, err := loadDevices(store, v, logger)
+	if err != nil {
+		return err
+	}
+	err = devices.LoadRelays(f.Relays)
+	if err != nil {
+		return fmt.Errorf("invalid relay settings: %+v", err)
+	}
+	for name, u := range udins {
+		logger.Printf("Resetting relays on %s\n", name)
+		err = resetRelays(name, u, devices, logger)
 		if err != nil {
-			return fmt.Errorf("unable to create device %s: %+v", name, err)
+			return err
 		}
-		logger.Printf("loaded device %v\n", dev)
-		if !enabled {
-			continue
+		err = readInputs(name, u, devices)
+		if err != nil {
+			return err
 		}
-		msg, err := dev.DiscoveryMessage(v)
+	}
+	err = devices.Load(f.Devices)
+	if err != nil {
+		return err
+	}
+	watchdog := udin.NewWatchdog(clock.Real, udins)
+	for relay := range devices.MaxOns() {
+		err = watchRelay(watchdog, udins, devices, relay)
 		if err != nil {
-			return fmt.Errorf("failed to generate discovery message: %w",
-				err)
+			return err
 		}
-		msg.Retain = true
-		msgp <- msg
+	}
+	sched := schedule.New(clock.Real, time.Local)
+	// sunrise and sunset rules need the coordinates of the site
+	if v.IsSet("Latitude") || v.IsSet("Longitude") {
+		err = sched.SetCoordinates(
+			v.GetFloat64("Latitude"), v.GetFloat64("Longitude"))
+		if err != nil {
+			return err
+		}
+	}
+	err = sched.Load(f.Schedules)
+	if err != nil {
+		return err
+	}
+	autos := automation.New(clock.Real)
+	err = autos.SetPressTimings(automation.PressTimings{
+		Long:   v.GetDuration("Long_Press"),
+		Double: v.GetDuration("Double_Press"),
+	})
+	if err != nil {
+		return err
+	}
+	err = autos.Load(f.Automations)
+	if err != nil {
+		return err
+	}
+	meters := meter.New(v.GetDuration("Meter_Rate_Window"))
+	err = meters.Load(f.Meters)
+	if err != nil {
+		return err
+	}
+	autos.SetCounter(meters)
+	autos.SetWatcher(devices)
+	devices.SetNameChecker(meters)
+	// the limit for devices without a rate limit of their own
+	defaultLimit := limit.Limit{
+		Interval: v.GetDuration("Command_Interval"),
+		Policy:   v.GetString("Command_Policy"),
+	}
+	err = defaultLimit.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid command rate limit: %+v", err)
+	}
+	limiter := limit.New(clock.Real, v.GetInt("Command_Queue"))
+	diagnostics := diag.New(clock.Real, Version, udins, devices)
+	// result publishes the result of a command
+	result := func(res *devs.Result) {
+		publish(res.Messages(v, v.GetBool("Bridge_Log")), msgp)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// commands run in the background so that pulses and staggered
+	// groups do not stall the main loop. The commands for a device run
+	// in order so queued holds the commands waiting for each device
+	// with a running command.
+	type queuedCommand struct {
+		device, command, source string
+	}
+	donec := make(chan *devs.Result)
+	queued := map[string][]queuedCommand{}
+	var running sync.WaitGroup
+	start := func(devName, cmd, source string) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			res := commandDevice(ctx, udins, devices, devName, cmd, v, msgp,
+				logger)
+			res.Source = source
+			select {
+			case donec <- res:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	// command runs a command once the earlier commands for the device
+	// have finished
+	command := func(devName, cmd, source string) {
+		if q, ok := queued[devName]; ok {
+			queued[devName] = append(q, queuedCommand{devName, cmd, source})
+			return
+		}
+		queued[devName] = nil
+		start(devName, cmd, source)
+	}
+	// finished records the result of a command and starts the next
+	// command for the device
+	finished := func(res *devs.Result) {
+		if res.Outcome == devs.ResultError {
+			diagnostics.Record(diag.CommandError)
+		}
+		result(res)
+		q := queued[res.Device]
+		if len(q) == 0 {
+			delete(queued, res.Device)
+			return
+		}
+		queued[res.Device] = q[1:]
+		start(q[0].device, q[0].command, q[0].source)
+	}
+	// submit runs a command unless the rate limit of the device drops
+	// it or defers it until the limiter sends it on limitc. Only the
+	// limit of a group applies to its commands, not those of its
+	// members.
+	submit := func(devName, cmd, source string) {
+		dev := devices.Device(devName)
+		if dev == nil {
+			command(devName, cmd, source)
+			return
+		}
+		l := defaultLimit
+		if dev.Limit.Interval > 0 {
+			l = dev.Limit
+			if l.Policy == "" {
+				l.Policy = defaultLimit.Policy
+			}
+		}
+		res := &devs.Result{
+			Device:  devName,
+			Command: cmd,
+			Source:  source,
+			Actions: []string{},
+			Time:    time.Now(),
+		}
+		switch limiter.Submit(devName, cmd, l) {
+		case limit.Run:
+			command(devName, cmd, source)
+			return
+		case limit.Deferred:
+			logger.Printf("deferred %s command for %s, rate limit %s\n",
+				cmd, devName, l)
+			res.Outcome = devs.ResultDeferred
+		case limit.Dropped:
+			logger.Printf("dropped %s command for %s, rate limit %s\n",
+				cmd, devName, l)
+			res.Outcome = devs.ResultDropped
+		}
+		res.Duration = time.Since(res.Time).String()
+		result(res)
+	}
+	save := func() error {
+		return store.Save(&devstore.File{
+			Devices:     devices.Configs(),
+			Relays:      devices.RelayConfigs(),
+			Schedules:   sched.Rules(),
+			Automations: autos.Rules(),
+			Meters:      meters.Configs(),
+		})
+	}
+	for _, dev := range devices.Devices() {
+		logger.Printf("loaded device %v\n", dev)
+	}
+	// announceAll publishes the discovery messages of every entity. It
+	// is called at startup, every Resend_Time and when Home Assistant
+	// comes online in case the retained messages were lost.
+	announceAll := func() error {
+		// the bridge and UDIN devices are announced first so that the
+		// via_device links of the entities resolve
+		publish(devices.BridgeMessages(v), msgp)
+		publish([]*mqtt.Msg{
+			limit.DiscoveryMessage(v, devs.BridgeID(v)),
+			limiter.StatsMessage(v),
+		}, msgp)
+		publish(diagnostics.DiscoveryMessages(v), msgp)
+		msgp <- diagnostics.StateMessage(v)
+		for _, dev := range devices.Devices() {
+			// disabled devices are removed in case they were disabled
+			// while we were not connected
+			msgs, err := devices.EnableDisable(dev.Name, dev.Enabled, v)
+			if err != nil {
+				return err
+			}
+			publish(msgs, msgp)
+		}
+		for _, input := range meters.Inputs() {
+			msgs, err := meters.AnnounceMessages(input, v, time.Now())
+			if err != nil {
+				return err
+			}
+			publish(msgs, msgp)
+		}
+		return nil
+	}
+	err = announceAll()
+	if err != nil {
+		return err
 	}
 
-	uiRouter := ui.NewUI(devices, Version,
-		time.Now().Unix()).CreateRouter(stdout, uic)
+	u := ui.NewUI(devices, Version, time.Now().Unix())
+	u.Schedules = sched
+	u.Automations = autos
+	u.Meters = meters
+	u.Udins = udins
+	uiRouter := u.CreateRouter(stdout, uic)
 
 	srv := &http.Server{
 		Addr:           v.GetString("UI"),
@@ -158,27 +403,89 @@ func run(args []string, stdout io.Writer, v *viper.Viper) error {
 		}
 	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	schedc := make(chan schedule.Fire)
+	go sched.Run(ctx, schedc)
+
+	// inputs are polled as the UDIN devices do not report changes
+	inputc := make(chan automation.Event)
+	go autos.Run(ctx, udins, v.GetDuration("Input_Poll_Interval"), inputc,
+		logger)
+
+	// meter states are republished so that rates fall when pulses stop
+	// and counts are saved periodically rather than on every pulse
+	meterTicker := time.NewTicker(v.GetDuration("Meter_Update_Interval"))
+	defer meterTicker.Stop()
+
+	// relays are polled as a pulse may have been interrupted between
+	// switching the relay on and off
+	alertc := make(chan udin.Alert)
+	go watchdog.Run(ctx, v.GetDuration("Watchdog_Interval"), alertc, logger)
+
+	limitc := make(chan limit.Command)
+	go limiter.Run(ctx, limitc)
+	// diagnostics are published periodically rather than on every
+	// dropped command
+	diagTicker := time.NewTicker(v.GetDuration("Diagnostics_Interval"))
+	defer diagTicker.Stop()
+	// the bridge state is also published periodically to refresh the
+	// uptime
+	stateTicker := time.NewTicker(v.GetDuration("Bridge_State_Interval"))
+	defer stateTicker.Stop()
+	// a Resend_Time of zero disables the periodic resend
+	var resendc <-chan time.Time
+	if d := v.GetDuration("Resend_Time"); d > 0 {
+		resendTicker := time.NewTicker(d)
+		defer resendTicker.Stop()
+		resendc = resendTicker.C
+	}
+	rediscover := &rediscovery{
+		ticks:    resendc,
+		announce: announceAll,
+		logger:   logger,
+	}
 
 	go func(ctx context.Context, errCh chan error) {
-		mqttc, err := mqtt.NewClient(&mqtt.ClientConfig{
-			AppName:              v.GetString("App_Name"),
-			Version:              Version,
-			Debug:                v.GetInt("Verbose") > 0,
-			Log:                  logger,
-			Broker:               v.GetString("Broker"),
-			ClientID:             v.GetString("Client_ID"),
-			DataTopicPrefix:      v.GetString("Bridge_Topic"),
-			DiscoveryTopicPrefix: v.GetString("Discovery_Prefix"),
-			ConnectRetryDelay:    v.GetDuration("Connect_Retry_Delay"),
-			KeepAlive:            int16(v.GetInt("KeepAlive")),
-			Subs: []mqtt.Sub{
-				{
-					Topic: v.GetString("Bridge_Topic") + "/+/set",
-					QoS:   1,
+		mqttc, err := broker.NewClient(&broker.Config{
+			ClientConfig: mqtt.ClientConfig{
+				AppName:              v.GetString("App_Name"),
+				Version:              Version,
+				Debug:                v.GetInt("Verbose") > 0,
+				Log:                  logger,
+				Broker:               v.GetString("Broker"),
+				ClientID:             v.GetString("Client_ID"),
+				DataTopicPrefix:      v.GetString("Bridge_Topic"),
+				DiscoveryTopicPrefix: v.GetString("Discovery_Prefix"),
+				ConnectRetryDelay:    v.GetDuration("Connect_Retry_Delay"),
+				KeepAlive:            int16(v.GetInt("KeepAlive")),
+				Subs: []mqtt.Sub{
+					{
+						Topic: v.GetString("Bridge_Topic") + "/+/set",
+						QoS:   1,
+					},
+					// Home Assistant birth messages
+					{
+						Topic: haStatusTopic(v),
+						QoS:   1,
+					},
+					// management requests
+					{
+						Topic: ui.RequestTopic(v) + "#",
+						QoS:   1,
+					},
+					// retained states restore cover positions on restart
+					{
+						Topic: v.GetString("Bridge_Topic") + "/+/state",
+						QoS:   1,
+					},
 				},
 			},
+			Username:           v.GetString("Broker_Username"),
+			Password:           v.GetString("Broker_Password"),
+			PasswordFile:       v.GetString("Broker_Password_File"),
+			CAFile:             v.GetString("Broker_CA_File"),
+			CertFile:           v.GetString("Broker_Cert_File"),
+			KeyFile:            v.GetString("Broker_Key_File"),
+			InsecureSkipVerify: v.GetBool("Broker_Insecure_Skip_Verify"),
 		}, logger)
 		if err != nil {
 			errCh <- fmt.Errorf("Failed to create MQTT client: %w", err)
@@ -187,6 +494,277 @@ func run(args []string, stdout io.Writer, v *viper.Viper) error {
 		errCh <- mqttc.Run(ctx, msgp, msgs)
 	}(ctx, errCh)
 
+	// handleEvent makes the changes requested through the UI or the
+	// management topics. It returns a saveError if the devices could
+	// not be saved and otherwise the error of the change, if any.
+	handleEvent := func(uie ui.UIEvent) error {
+		switch uie.Kind {
+		case ui.UIEnableEvent:
+			logger.Printf("enable %s %s\n", uie.Args[0], uie.Args[1])
+			val := uie.Args[1] == "true"
+			msgs, err := devices.EnableDisable(uie.Args[0], val, v)
+			if err != nil {
+				return fmt.Errorf("failed to enable/disable device: %w",
+					err)
+			}
+			publish(msgs, msgp)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UICreateEvent:
+			dev, err := devices.Create(uie.Args, false, "")
+			if err != nil {
+				return fmt.Errorf("failed to create device: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+			logger.Printf("loaded device %v\n", dev)
+		case ui.UITimingEvent:
+			logger.Printf("timing %s pulse=%s guard=%s\n",
+				uie.Args[0], uie.Args[1], uie.Args[2])
+			pulse, _ := time.ParseDuration(uie.Args[1])
+			guard, _ := time.ParseDuration(uie.Args[2])
+			err := devices.SetTiming(uie.Args[0], devs.Timing{
+				Pulse: pulse,
+				Guard: guard,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to set timing: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UILimitEvent:
+			logger.Printf("rate limit %s interval=%s policy=%s\n",
+				uie.Args[0], uie.Args[1], uie.Args[2])
+			interval, _ := time.ParseDuration(uie.Args[1])
+			err := devices.SetLimit(uie.Args[0], limit.Limit{
+				Interval: interval,
+				Policy:   uie.Args[2],
+			})
+			if err != nil {
+				return fmt.Errorf("failed to set rate limit: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIRenameEvent:
+			logger.Printf("rename %s to %s\n", uie.Args[0], uie.Args[1])
+			rm, err := devices.RemovalMessages(uie.Args[0], v)
+			if err != nil {
+				return fmt.Errorf("failed to rename device: %w", err)
+			}
+			dev, err := devices.Rename(uie.Args[0], uie.Args[1])
+			if err != nil {
+				return fmt.Errorf("failed to rename device: %w", err)
+			}
+			publish(rm, msgp)
+			sched.RenameDevice(uie.Args[0], dev.Name)
+			limiter.RenameDevice(uie.Args[0], dev.Name)
+			autos.RenameDevice(uie.Args[0], dev.Name)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+			if !dev.Enabled {
+				return nil
+			}
+			err = announce(devices, dev.Name, v, msgp)
+			if err != nil {
+				logger.Printf("%s\n", err)
+				return nil
+			}
+		case ui.UIEditEvent:
+			logger.Printf("edit %v\n", uie.Args)
+			rm, err := devices.RemovalMessages(uie.Args[0], v)
+			if err != nil {
+				return fmt.Errorf("failed to edit device: %w", err)
+			}
+			dev, err := devices.Edit(uie.Args)
+			if err != nil {
+				return fmt.Errorf("failed to edit device: %w", err)
+			}
+			publish(rm, msgp)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+			if !dev.Enabled {
+				return nil
+			}
+			err = announce(devices, dev.Name, v, msgp)
+			if err != nil {
+				logger.Printf("%s\n", err)
+				return nil
+			}
+		case ui.UIDeleteEvent:
+			logger.Printf("delete %s\n", uie.Args[0])
+			rm, err := devices.RemovalMessages(uie.Args[0], v)
+			if err != nil {
+				return fmt.Errorf("failed to delete device: %w", err)
+			}
+			err = devices.Delete(uie.Args[0])
+			if err != nil {
+				return fmt.Errorf("failed to delete device: %w", err)
+			}
+			publish(rm, msgp)
+			sched.DeleteDevice(uie.Args[0])
+			limiter.DeleteDevice(uie.Args[0])
+			autos.DeleteDevice(uie.Args[0])
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIScheduleAddEvent:
+			r, err := sched.Add(schedule.Rule{
+				Device:  uie.Args[0],
+				Command: uie.Args[1],
+				At:      uie.Args[2],
+				Days:    uie.Args[3],
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add schedule: %w", err)
+			}
+			logger.Printf("added schedule %s: %s\n", r.ID, r)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIScheduleDeleteEvent:
+			logger.Printf("delete schedule %s\n", uie.Args[0])
+			err := sched.Delete(uie.Args[0])
+			if err != nil {
+				return fmt.Errorf("failed to delete schedule: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIAutomationAddEvent:
+			r, err := autos.Add(automation.Rule{
+				Input:   uie.Args[0],
+				Event:   uie.Args[1],
+				Hold:    uie.Args[2],
+				Device:  uie.Args[3],
+				Command: uie.Args[4],
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add automation: %w", err)
+			}
+			logger.Printf("added automation %s: %s\n", r.ID, r)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIAutomationDeleteEvent:
+			logger.Printf("delete automation %s\n", uie.Args[0])
+			err := autos.Delete(uie.Args[0])
+			if err != nil {
+				return fmt.Errorf("failed to delete automation: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIMeterSetEvent:
+			logger.Printf("set meter %v\n", uie.Args)
+			upp, _ := strconv.ParseFloat(uie.Args[2], 64)
+			// an existing meter may be renamed
+			var rm []*mqtt.Msg
+			var err error
+			if meters.Counts(uie.Args[0]) {
+				rm, err = meters.RemovalMessages(uie.Args[0], v)
+				if err != nil {
+					return fmt.Errorf("failed to set meter: %w", err)
+				}
+			}
+			err = meters.Set(uie.Args[0], meter.Config{
+				Name:          uie.Args[1],
+				UnitsPerPulse: upp,
+				Unit:          uie.Args[3],
+				DeviceClass:   uie.Args[4],
+				Debounce:      uie.Args[5],
+			})
+			if err != nil {
+				return fmt.Errorf("failed to set meter: %w", err)
+			}
+			publish(rm, msgp)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+			msgs, err := meters.AnnounceMessages(uie.Args[0], v,
+				time.Now())
+			if err != nil {
+				logger.Printf("%s\n", err)
+				return nil
+			}
+			publish(msgs, msgp)
+		case ui.UIMeterDeleteEvent:
+			logger.Printf("delete meter %s\n", uie.Args[0])
+			rm, err := meters.RemovalMessages(uie.Args[0], v)
+			if err != nil {
+				return fmt.Errorf("failed to delete meter: %w", err)
+			}
+			err = meters.Delete(uie.Args[0])
+			if err != nil {
+				return fmt.Errorf("failed to delete meter: %w", err)
+			}
+			publish(rm, msgp)
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIInvertEvent:
+			logger.Printf("invert %s %s\n", uie.Args[0], uie.Args[1])
+			err := invertRelay(udins, devices, uie.Args[0],
+				uie.Args[1] == "true")
+			if err != nil {
+				return fmt.Errorf("failed to invert relay: %w", err)
+			}
+			err = watchRelay(watchdog, udins, devices, uie.Args[0])
+			if err != nil {
+				return fmt.Errorf("failed to invert relay: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIMaxOnEvent:
+			logger.Printf("max on-time %s %s\n", uie.Args[0], uie.Args[1])
+			maxOn, _ := time.ParseDuration(uie.Args[1])
+			err := devices.SetMaxOn(uie.Args[0], maxOn)
+			if err != nil {
+				return fmt.Errorf("failed to set max on-time: %w", err)
+			}
+			err = watchRelay(watchdog, udins, devices, uie.Args[0])
+			if err != nil {
+				return fmt.Errorf("failed to set max on-time: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		case ui.UIImportEvent:
+			err := importDevices(devices, uie.Args[0], v, msgp, logger)
+			if err != nil {
+				return fmt.Errorf("failed to import devices: %w", err)
+			}
+			err = save()
+			if err != nil {
+				return &saveError{err}
+			}
+		}
+		// the devices may have changed
+		msgp <- diagnostics.StateMessage(v)
+		return nil
+	}
+
 LOOP:
 	for {
 		select {
@@ -197,80 +775,159 @@ LOOP:
 		case err = <-errCh:
 			break LOOP
 		case uie := <-uic:
-			switch uie.Kind {
-			case ui.UIEnableEvent:
-				logger.Printf("enable %s %s\n", uie.Args[0], uie.Args[1])
-				val := uie.Args[1] == "true"
-				devices.EnableDisable(uie.Args[0], val)
-				v.Set("device."+uie.Args[0]+".enabled", val)
-				err = v.WriteConfig()
-				if err != nil {
-					return fmt.Errorf("failed to write config: %+v", err)
-				}
-				if !val {
-					continue
-				}
-				msg, err := devices.Device(uie.Args[0]).DiscoveryMessage(v)
-				if err != nil {
-					logger.Printf("failed to generate discovery message: %s",
-						err)
-					continue
-				}
-				msg.Retain = true
-				msgp <- msg
-			case ui.UICreateEvent:
-				dev, err := devices.Create(uie.Args, false, "")
-				if err != nil {
-					fmt.Fprintf(stdout, "failed to create device: %+v\n", err)
-					continue
-				}
-				v.Set("device."+dev.Name+".kind", dev.Type.String())
-				v.Set("device."+dev.Name+".def", dev.Def)
-				err = v.WriteConfig()
-				if err != nil {
-					return fmt.Errorf("failed to write config: %+v", err)
-				}
-				logger.Printf("loaded device %v\n", dev)
+			err = handleEvent(uie)
+			if isSaveError(err) {
+				return err
+			}
+			if err != nil {
+				logger.Printf("%s\n", err)
 			}
 		case msg := <-msgs:
 
 			topic := msg.Topic
 			cmd := string(msg.Body.([]byte))
 			logger.Printf("mqtt < %s: %s\n", topic, cmd)
+			if topic == haStatusTopic(v) {
+				rediscover.status(cmd)
+				continue
+			}
+			if strings.HasPrefix(topic, ui.RequestTopic(v)) {
+				resp, uie := u.HandleRequest(v, topic, msg.Body.([]byte))
+				if uie != nil {
+					err = handleEvent(*uie)
+					if isSaveError(err) {
+						return err
+					}
+					if err != nil {
+						logger.Printf("%s\n", err)
+						resp.Body.(*ui.Response).SetError(err)
+					}
+				}
+				msgp <- resp
+				continue
+			}
 			ts := strings.Split(topic, "/")
 			devName := ts[len(ts)-2]
-			act, err := devices.ActionForDevice(devName, cmd)
-			if err != nil {
-				logger.Printf("command failed: %s\n", err)
+			if ts[len(ts)-1] == "state" {
+				if devices.RestoreState(devName, cmd) {
+					logger.Printf("restored state of %s: %s\n", devName, cmd)
+					msgs, err := devices.StateMessages(devName, v)
+					if err != nil {
+						logger.Printf(
+							"failed to generate state message: %s\n", err)
+						continue
+					}
+					publish(msgs, msgp)
+				}
 				continue
 			}
-			logger.Printf("Found action: %s\n", act)
-			u := udins[act.Udin]
-			if u == nil {
-				logger.Printf("invalid UDIN %s for %s\n", act.Udin, devName)
+			submit(devName, cmd, devs.SourceMQTT)
+		case res := <-donec:
+			finished(res)
+		case c := <-limitc:
+			logger.Printf("running deferred %s command for %s\n",
+				c.Command, c.Device)
+			command(c.Device, c.Command, devs.SourceRateLimit)
+		case f := <-schedc:
+			logger.Printf("schedule %s: %s\n", f.Rule.ID, f.Rule)
+			submit(f.Rule.Device, f.Rule.Command, devs.SourceSchedule)
+		case ev := <-inputc:
+			if ev.Type == automation.Pulse {
+				msg, err := meters.StateMessage(ev.Input, v, ev.Time)
+				if err != nil {
+					logger.Printf("%s\n", err)
+					continue
+				}
+				msgp <- msg
 				continue
 			}
-			switch act.Action {
-			case "pulse":
-				err := u.Pulse(act.Relay, time.Second)
-				if err != nil {
-					logger.Printf("failed to pulse relay %d on %s: %s\n",
-						act.Relay, act.Udin, err)
+			if ev.Type == automation.Rising || ev.Type == automation.Falling {
+				on := ev.Type == automation.Rising
+				for _, dev := range devices.SetInput(ev.Input, on) {
+					msgs, err := devices.StateMessages(dev, v)
+					if err != nil {
+						logger.Printf(
+							"failed to generate state message: %s\n", err)
+						continue
+					}
+					publish(msgs, msgp)
 				}
-			default:
-				logger.Printf("invalid UDIN action %s for %s\n",
-					act.Action, devName)
+			}
+			if ev.IsPress() {
+				logger.Printf("%s %s press\n", ev.Input, ev.Type)
+				msgp <- &mqtt.Msg{
+					Topic: devs.InputActionTopic(v, ev.Input),
+					Body:  ev.Type,
+				}
+			}
+			for _, r := range ev.Rules {
+				logger.Printf("automation %s: %s\n", r.ID, r)
+				submit(r.Device, r.Command, devs.SourceAutomation)
+			}
+		case a := <-alertc:
+			logger.Printf("watchdog: %s\n", a)
+			msgp <- &mqtt.Msg{Topic: devs.AlertTopic(v), Body: a}
+			if a.Error != "" {
 				continue
 			}
+			// the load of the relay has been switched off
+			relay := fmt.Sprintf("%s-r%d", a.Udin, a.Relay)
+			devices.SetRelay(relay, false)
+			if dev := devices.RelayDevice(relay); dev != "" {
+				msgs, err := devices.StateMessages(dev, v)
+				if err != nil {
+					logger.Printf(
+						"failed to generate state message: %s\n", err)
+					continue
+				}
+				publish(msgs, msgp)
+			}
+		case <-diagTicker.C:
+			if limiter.Changed() {
+				msgp <- limiter.StatsMessage(v)
+			}
+			if diagnostics.Changed() {
+				msgp <- diagnostics.StateMessage(v)
+			}
+		case <-rediscover.ticks:
+			rediscover.resend("resending discovery")
+		case <-stateTicker.C:
+			msgp <- diagnostics.StateMessage(v)
+		case now := <-meterTicker.C:
+			for _, input := range meters.Inputs() {
+				msg, err := meters.StateMessage(input, v, now)
+				if err != nil {
+					logger.Printf("%s\n", err)
+					continue
+				}
+				msgp <- msg
+			}
+			if meters.Changed() {
+				err = save()
+				if err != nil {
+					return fmt.Errorf("failed to save devices: %+v", err)
+				}
+			}
 		}
 	}
 
 	logger.Println("shutting down")
 
+	// running pulses are completed so that relays are not left on
+	cancel()
+	running.Wait()
+
 	if err != nil {
 		return err
 	}
 
+	// pulses counted since the last periodic save
+	if meters.Changed() {
+		if err := save(); err != nil {
+			return fmt.Errorf("failed to save devices: %+v", err)
+		}
+	}
+
 	// TOFIX: shutdown the ui
 	if err := srv.Shutdown(context.Background()); err != nil {
 		// Error from closing listeners, or context timeout:
@@ -280,6 +937,358 @@ LOOP:
 	return nil
 }
 
+// commandDevice runs the relay actions for a command sent to a device
+// from the command topic, a schedule or an automation and returns the
+// result. Failures are logged and stop the remaining actions as does
+// ctx being done, though a pulse that has started is always completed.
+func commandDevice(ctx context.Context, udins map[string]*udin.UdinDevice,
+	devices *devs.Devices, devName, cmd string, v *viper.Viper,
+	msgp chan *mqtt.Msg, logger *log.Logger) *devs.Result {
+	res := &devs.Result{
+		Device:  devName,
+		Command: cmd,
+		Outcome: devs.ResultOK,
+		Actions: []string{},
+		Time:    time.Now(),
+	}
+	defer func() {
+		res.Duration = time.Since(res.Time).String()
+	}()
+	acts, err := devices.ActionForDevice(devName, cmd)
+	if err != nil {
+		logger.Printf("command failed: %s\n", err)
+		res.Outcome = devs.ResultError
+		res.Error = err.Error()
+		return res
+	}
+	for _, act := range acts {
+		logger.Printf("Found action: %s\n", act)
+		if act.Delay > 0 {
+			select {
+			case <-time.After(act.Delay):
+			case <-ctx.Done():
+				res.Outcome = devs.ResultError
+				res.Error = "shutting down"
+				return res
+			}
+		}
+		changed := func() {
+			msgs, err := devices.StateMessages(act.Device, v)
+			if err != nil {
+				logger.Printf(
+					"failed to generate state message: %s\n", err)
+				return
+			}
+			for _, msg := range msgs {
+				select {
+				case msgp <- msg:
+				case <-ctx.Done():
+				}
+			}
+		}
+		err := runAction(udins, devices, act, changed)
+		if err != nil {
+			logger.Printf("action %s for %s failed: %s\n",
+				act, devName, err)
+			res.Outcome = devs.ResultError
+			res.Error = fmt.Sprintf("action %s failed: %s", act, err)
+			return res
+		}
+		res.Actions = append(res.Actions, act.String())
+	}
+	return res
+}
+
+// runAction performs a single relay action calling changed whenever
+// the recorded state of the relay is updated.
+func runAction(udins map[string]*udin.UdinDevice, devices *devs.Devices,
+	act *devs.Action, changed func()) error {
+	u := udins[act.Udin]
+	if u == nil {
+		return fmt.Errorf("invalid UDIN %s", act.Udin)
+	}
+	switch act.Action {
+	case "pulse":
+		err := switchRelay(u, devices, act.Relay, act.RelayName(), true)
+		if err != nil {
+			return err
+		}
+		changed()
+		time.Sleep(act.Duration)
+		err = switchRelay(u, devices, act.Relay, act.RelayName(), false)
+		if err != nil {
+			return err
+		}
+	case "on", "off":
+		err := switchRelay(u, devices, act.Relay, act.RelayName(),
+			act.Action == "on")
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid UDIN action %s", act.Action)
+	}
+	changed()
+	return nil
+}
+
+// switchRelay switches the load on a relay on or off, energising the
+// relay to switch the load off if the relay is inverted.
+func switchRelay(u *udin.UdinDevice, devices *devs.Devices, r uint,
+	relay string, on bool) error {
+	var err error
+	if devices.UdinState(relay, on) {
+		err = u.On(r)
+	} else {
+		err = u.Off(r)
+	}
+	if err != nil {
+		return err
+	}
+	devices.SetRelay(relay, on)
+	return nil
+}
+
+// invertRelay changes the inversion of a relay switching the relay so
+// that the load keeps its current state.
+func invertRelay(udins map[string]*udin.UdinDevice, devices *devs.Devices,
+	relay string, invert bool) error {
+	err := devices.SetInvert(relay, invert)
+	if err != nil {
+		return err
+	}
+	name, r, err := devs.ParseRelay(relay)
+	if err != nil {
+		return err
+	}
+	u := udins[name]
+	if u == nil {
+		return fmt.Errorf("invalid UDIN %s", name)
+	}
+	return switchRelay(u, devices, r, relay, devices.RelayOn(relay))
+}
+
+// saveError is a failure to save the devices after a change which
+// stops the bridge.
+type saveError struct {
+	err error
+}
+
+func (e *saveError) Error() string {
+	return fmt.Sprintf("failed to save devices: %+v", e.err)
+}
+
+func isSaveError(err error) bool {
+	var se *saveError
+	return errors.As(err, &se)
+}
+
+// watchRelay sets the maximum on-time and inversion of a relay in the
+// watchdog. Relays of UDIN devices that are not present are ignored.
+func watchRelay(watchdog *udin.Watchdog, udins map[string]*udin.UdinDevice,
+	devices *devs.Devices, relay string) error {
+	name, r, err := devs.ParseRelay(relay)
+	if err != nil {
+		return err
+	}
+	if udins[name] == nil {
+		return nil
+	}
+	err = watchdog.SetInverted(name, r, devices.Inverted(relay))
+	if err != nil {
+		return err
+	}
+	return watchdog.SetMaxOn(name, r, devices.MaxOns()[relay])
+}
+
+// resetRelays switches off the loads on all relays of a UDIN device
+// and records the state read back from the device.
+func resetRelays(name string, u *udin.UdinDevice, devices *devs.Devices,
+	logger *log.Logger) error {
+	inverted := map[uint]bool{}
+	for r := uint(1); r <= u.NumRelays(); r++ {
+		if devices.Inverted(fmt.Sprintf("%s-r%d", name, r)) {
+			inverted[r] = true
+		}
+	}
+	if len(inverted) == 0 {
+		err := u.Off(0) // switch off all relays on startup
+		if err != nil {
+			return fmt.Errorf("failed to reset device: %+v", err)
+		}
+	} else {
+		// each relay is set to its target so that the loads of
+		// inverted relays are not switched on by resetting them all
+		for r := uint(1); r <= u.NumRelays(); r++ {
+			var err error
+			if inverted[r] {
+				err = u.On(r)
+			} else {
+				err = u.Off(r)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to reset device: %+v", err)
+			}
+		}
+	}
+	states, err := u.Status(0) // query status
+	if err != nil {
+		return fmt.Errorf("failed to query status: %+v", err)
+	}
+	for i, st := range states {
+		relay := fmt.Sprintf("%s-r%d", name, i+1)
+		on := devices.UdinState(relay, st)
+		if on {
+			logger.Printf("relay %s did not switch off\n", relay)
+		}
+		devices.SetRelay(relay, on)
+	}
+	return nil
+}
+
+// readInputs records the state of the inputs of a UDIN device so that
+// devices using them report their state before the inputs change.
+func readInputs(name string, u *udin.UdinDevice, devices *devs.Devices) error {
+	if u.NumInputs() == 0 {
+		return nil
+	}
+	states, err := u.Inputs(0)
+	if err != nil {
+		return fmt.Errorf("failed to read inputs of %s: %+v", name, err)
+	}
+	for i, on := range states {
+		devices.SetInput(fmt.Sprintf("%s-i%d", name, i+1), on)
+	}
+	return nil
+}
+
+// importDevices imports the JSON encoded device configs removing the
+// entities of updated devices before announcing them again.
+func importDevices(devices *devs.Devices, data string, v *viper.Viper,
+	msgp chan *mqtt.Msg, logger *log.Logger) error {
+	var cfgs map[string]devs.Config
+	err := json.Unmarshal([]byte(data), &cfgs)
+	if err != nil {
+		return err
+	}
+	changes, err := devices.PlanImport(cfgs)
+	if err != nil {
+		return err
+	}
+	rm := []*mqtt.Msg{}
+	for _, c := range changes {
+		if c.Action != devs.ImportUpdate {
+			continue
+		}
+		msgs, err := devices.RemovalMessages(c.Device, v)
+		if err != nil {
+			return err
+		}
+		rm = append(rm, msgs...)
+	}
+	changes, err = devices.Import(cfgs)
+	if err != nil {
+		return err
+	}
+	publish(rm, msgp)
+	for _, c := range changes {
+		if c.Action == devs.ImportUnchanged {
+			continue
+		}
+		logger.Printf("import %s %s\n", c.Action, c.Device)
+		if !devices.Device(c.Device).Enabled {
+			continue
+		}
+		err := announce(devices, c.Device, v, msgp)
+		if err != nil {
+			logger.Printf("failed to announce device %s: %s\n",
+				c.Device, err)
+		}
+	}
+	return nil
+}
+
+// announce publishes the discovery and state messages for a device.
+func announce(devices *devs.Devices, name string, v *viper.Viper,
+	msgp chan *mqtt.Msg) error {
+	msgs, err := devices.AnnounceMessages(name, v)
+	if err != nil {
+		return err
+	}
+	publish(msgs, msgp)
+	return nil
+}
+
+// rediscovery resends the discovery messages on each tick and when
+// Home Assistant comes online. Failures are only logged as the
+// messages are sent again on the next tick or birth message.
+type rediscovery struct {
+	// ticks is nil if the periodic resend is disabled
+	ticks    <-chan time.Time
+	announce func() error
+	logger   *log.Logger
+}
+
+func (r *rediscovery) resend(reason string) {
+	r.logger.Println(reason)
+	if err := r.announce(); err != nil {
+		r.logger.Printf("failed to resend discovery: %s\n", err)
+	}
+}
+
+// status handles the body of a Home Assistant status message which is
+// "online" when Home Assistant starts.
+func (r *rediscovery) status(body string) {
+	if body == "online" {
+		r.resend("Home Assistant online, resending discovery")
+	}
+}
+
+// haStatusTopic is the topic of the Home Assistant birth and last will
+// messages.
+func haStatusTopic(v *viper.Viper) string {
+	return v.GetString("Discovery_Prefix") + "/status"
+}
+
+func publish(msgs []*mqtt.Msg, msgp chan *mqtt.Msg) {
+	for _, msg := range msgs {
+		msgp <- msg
+	}
+}
+
+// loadDevices reads the device store. If the store has not been
+// created yet, devices in the "device" section of the configuration
+// file are imported into it.
+func loadDevices(store *devstore.Store, v *viper.Viper,
+	logger *log.Logger) (*devstore.File, error) {
+	legacy := map[string]devs.Config{}
+	err := v.UnmarshalKey("device", &legacy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device config: %+v", err)
+	}
+	if store.Exists() {
+		if len(legacy) > 0 {
+			logger.Printf("ignoring device section of config file, "+
+				"devices are loaded from %s\n", store.Path())
+		}
+		f, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load devices: %+v", err)
+		}
+		return f, nil
+	}
+	if len(legacy) > 0 {
+		err = store.Save(&devstore.File{Devices: legacy})
+		if err != nil {
+			return nil, fmt.Errorf("failed to import devices: %+v", err)
+		}
+		logger.Printf("imported %d devices from config file into %s, "+
+			"the device section can now be removed\n",
+			len(legacy), store.Path())
+	}
+	return &devstore.File{Version: devstore.Version, Devices: legacy}, nil
+}
+
 func uidSafe(s string) string {
 	r := strings.ReplaceAll(s, "/", "_slash_")
 	r = strings.ReplaceAll(r, "#", "_hash_")
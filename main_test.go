@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	devs "github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CommandDevice(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{"udin_8r": u8r}
+	devices := devs.NewDevices(udins)
+	_, err = devices.Create(
+		[]string{"vent", "multispeedfan", "udin_8r-r1", "udin_8r-r2"},
+		true, "")
+	assert.NoError(t, err)
+	v := viper.New()
+	v.Set("Bridge_Topic", "udin")
+	msgp := make(chan *mqtt.Msg, 10)
+	logger := log.New(ioutil.Discard, "", 0)
+
+	res := commandDevice(context.Background(), udins, devices, "vent", "speed:2", v, msgp, logger)
+	assert.Equal(t, devs.ResultOK, res.Outcome)
+	assert.Equal(t, []string{"udin_8r[1].off", "udin_8r[2].on"},
+		res.Actions)
+	assert.Empty(t, res.Error)
+	assert.NotEmpty(t, res.Duration)
+
+	res = commandDevice(context.Background(), udins, devices, "vent", "explode", v, msgp, logger)
+	assert.Equal(t, devs.ResultError, res.Outcome)
+	assert.Empty(t, res.Actions)
+	assert.NotEmpty(t, res.Error)
+
+	assert.NoError(t, u8r.Close())
+	res = commandDevice(context.Background(), udins, devices, "vent", "off", v, msgp, logger)
+	assert.Equal(t, devs.ResultError, res.Outcome)
+	assert.Empty(t, res.Actions)
+	assert.Contains(t, res.Error, "action udin_8r[1].off failed: ")
+}
+
+func Test_CommandDeviceShutdown(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	defer u8r.Close()
+	udins := map[string]*udin.UdinDevice{"udin_8r": u8r}
+	devices := devs.NewDevices(udins)
+	for _, def := range [][]string{
+		{"fan1", "multispeedfan", "udin_8r-r1"},
+		{"fan2", "multispeedfan", "udin_8r-r2"},
+		{"fans", "devicegroup", "fan1", "fan2", "stagger=1h"},
+	} {
+		_, err = devices.Create(def, true, "")
+		assert.NoError(t, err)
+	}
+	v := viper.New()
+	msgp := make(chan *mqtt.Msg, 10)
+	logger := log.New(ioutil.Discard, "", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *devs.Result)
+	go func() {
+		done <- commandDevice(ctx, udins, devices, "fans", "on", v, msgp,
+			logger)
+	}()
+	cancel()
+	res := <-done
+	assert.Equal(t, devs.ResultError, res.Outcome)
+	assert.Equal(t, "shutting down", res.Error)
+	assert.Equal(t, []string{"udin_8r[1].on"}, res.Actions,
+		"the staggered member was not switched")
+}
+
+func Test_ResetRelays(t *testing.T) {
+	var sent bytes.Buffer
+	u8r, err := udin.NewUdin("mock", log.New(&sent, "", 0))
+	assert.NoError(t, err)
+	defer u8r.Close()
+	devices := devs.NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	assert.NoError(t, devices.SetInvert("udin_8r-r2", true))
+	assert.NoError(t, u8r.On(1))
+	assert.NoError(t, u8r.On(2))
+	sent.Reset()
+
+	err = resetRelays("udin_8r", u8r, devices, log.New(ioutil.Discard, "", 0))
+	assert.NoError(t, err)
+	assert.NotContains(t, sent.String(), "wrote: f0")
+	assert.NotContains(t, sent.String(), "wrote: f2")
+	states, err := u8r.Status(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false, false, false, false, false,
+		false}, states)
+	for r := 1; r <= 8; r++ {
+		assert.False(t, devices.RelayOn(fmt.Sprintf("udin_8r-r%d", r)))
+	}
+}
+
+func Test_Rediscovery(t *testing.T) {
+	var logged bytes.Buffer
+	ticks := make(chan time.Time, 1)
+	announced := 0
+	var failure error
+	r := &rediscovery{
+		ticks: ticks,
+		announce: func() error {
+			announced++
+			return failure
+		},
+		logger: log.New(&logged, "", 0),
+	}
+
+	// the periodic resend
+	ticks <- time.Now()
+	<-r.ticks
+	r.resend("resending discovery")
+	assert.Equal(t, 1, announced)
+	assert.Equal(t, "resending discovery\n", logged.String())
+
+	// the Home Assistant birth message
+	logged.Reset()
+	r.status("online")
+	assert.Equal(t, 2, announced)
+	assert.Equal(t, "Home Assistant online, resending discovery\n",
+		logged.String())
+
+	// other statuses are ignored
+	logged.Reset()
+	r.status("offline")
+	assert.Equal(t, 2, announced)
+	assert.Empty(t, logged.String())
+
+	// failures are logged and the next tick tries again
+	failure = errors.New("not connected")
+	logged.Reset()
+	r.resend("resending discovery")
+	assert.Equal(t, 3, announced)
+	assert.Equal(t, "resending discovery\n"+
+		"failed to resend discovery: not connected\n", logged.String())
+	failure = nil
+	r.status("online")
+	assert.Equal(t, 4, announced)
+}
+
+func Test_ReadInputs(t *testing.T) {
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	defer u44.Close()
+	assert.NoError(t, u44.SetMockInput(2, true))
+	devices := devs.NewDevices(map[string]*udin.UdinDevice{"udin_44": u44})
+
+	assert.NoError(t, readInputs("udin_44", u44, devices))
+	assert.False(t, devices.InputOn("udin_44-i1"))
+	assert.True(t, devices.InputOn("udin_44-i2"))
+
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	defer u8r.Close()
+	assert.NoError(t, readInputs("udin_8r", u8r, devices),
+		"devices without inputs are skipped")
+}
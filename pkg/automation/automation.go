@@ -0,0 +1,431 @@
+// Package automation runs device commands when UDIN inputs change so
+// that wall switches keep working when the broker or Home Assistant is
+// not available.
+package automation
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+)
+
+// Input events that trigger rules.
+const (
+	// Rising is an input becoming active.
+	Rising = "rising"
+	// Falling is an input becoming inactive.
+	Falling = "falling"
+	// Change is either of Rising or Falling.
+	Change = "change"
+	// Held is an input remaining active for the hold time of the
+	// rule. It fires once per press.
+	Held = "held"
+	// SinglePress, DoublePress and LongPress are the press types
+	// classified by the engine using its PressTimings.
+	SinglePress = "single"
+	DoublePress = "double"
+	LongPress   = "long"
+	// Pulse is a pulse counted by the Counter of the engine.
+	Pulse = "pulse"
+)
+
+// Counter counts pulses on inputs in counter mode. Those inputs are
+// not used for presses or rules.
+type Counter interface {
+	// Counts reports whether input is in counter mode.
+	Counts(input string) bool
+	// Update records the polled state of an input and reports whether
+	// a pulse was counted.
+	Update(input string, on bool, now time.Time) bool
+}
+
+// Watcher selects the inputs whose Rising and Falling events are
+// reported even if they trigger no rules, such as inputs that report
+// the state of a device.
+type Watcher interface {
+	Watches(input string) bool
+}
+
+// PressTypes are the press types in the order they are announced.
+var PressTypes = []string{SinglePress, DoublePress, LongPress}
+
+// PressTimings configure the classification of presses.
+type PressTimings struct {
+	// Long is how long an input must be active to be a long press.
+	Long time.Duration
+	// Double is how soon after a press ends a second press must start
+	// to make a double press. A single press is reported once it has
+	// passed.
+	Double time.Duration
+}
+
+// DefaultPressTimings are used until SetPressTimings is called.
+var DefaultPressTimings = PressTimings{
+	Long:   800 * time.Millisecond,
+	Double: 400 * time.Millisecond,
+}
+
+// Event is an event seen on an input with the rules it triggered.
+// Edge and Held events are only reported if they trigger rules, or
+// for edges if the input is watched, while presses are always
+// reported.
+type Event struct {
+	Input string
+	Type  string
+	Time  time.Time
+	Rules []Rule
+}
+
+// IsPress reports whether the event is a classified press.
+func (ev Event) IsPress() bool {
+	for _, press := range PressTypes {
+		if ev.Type == press {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule sends Command to Device when Input, of the form <udin>-i<n>,
+// sees Event. Hold is the duration, such as "2s", of Held rules.
+type Rule struct {
+	ID      string `json:"id" yaml:"id"`
+	Input   string `json:"input" yaml:"input"`
+	Event   string `json:"event" yaml:"event"`
+	Hold    string `json:"hold,omitempty" yaml:"hold,omitempty"`
+	Device  string `json:"device" yaml:"device"`
+	Command string `json:"command" yaml:"command"`
+}
+
+func (r Rule) String() string {
+	ev := r.Event
+	if r.Event == Held {
+		ev += " " + r.Hold
+	}
+	return fmt.Sprintf("%s %s: %s %s", r.Input, ev, r.Command, r.Device)
+}
+
+// input is the last seen state of an input.
+type input struct {
+	on    bool
+	since time.Time
+	// held records the Held rules that fired during the current press
+	held map[string]bool
+	// long is set once the current press is reported as a long press
+	long bool
+	// presses counts the presses awaiting classification and released
+	// is when the last one ended
+	presses  int
+	released time.Time
+}
+
+type Engine struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	timings PressTimings
+	counter Counter
+	watcher Watcher
+	rules   []Rule
+	hold    map[string]time.Duration
+	nextID  int
+	inputs  map[string]*input
+}
+
+func New(c clock.Clock) *Engine {
+	return &Engine{
+		clock:   c,
+		timings: DefaultPressTimings,
+		hold:    make(map[string]time.Duration),
+		nextID:  1,
+		inputs:  make(map[string]*input),
+	}
+}
+
+// SetPressTimings changes the timings used to classify presses.
+func (e *Engine) SetPressTimings(t PressTimings) error {
+	if t.Long <= 0 || t.Double <= 0 {
+		return fmt.Errorf("invalid press timings long=%s double=%s",
+			t.Long, t.Double)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.timings = t
+	return nil
+}
+
+// SetCounter sets the counter of the inputs in counter mode.
+func (e *Engine) SetCounter(c Counter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.counter = c
+}
+
+// SetWatcher sets the watcher of the inputs whose edges are reported.
+func (e *Engine) SetWatcher(w Watcher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.watcher = w
+}
+
+// Validate checks that a rule is complete. The input is only checked
+// for its form as the engine does not know the UDIN devices.
+func (e *Engine) Validate(r Rule) error {
+	_, err := compile(r)
+	return err
+}
+
+// compile checks a rule and returns its hold time.
+func compile(r Rule) (time.Duration, error) {
+	if r.Input == "" {
+		return 0, fmt.Errorf("missing input")
+	}
+	if r.Device == "" {
+		return 0, fmt.Errorf("missing device")
+	}
+	if r.Command == "" {
+		return 0, fmt.Errorf("missing command")
+	}
+	switch r.Event {
+	case Rising, Falling, Change, SinglePress, DoublePress, LongPress:
+		if r.Hold != "" {
+			return 0, fmt.Errorf("hold may only be used with %s", Held)
+		}
+		return 0, nil
+	case Held:
+		hold, err := time.ParseDuration(r.Hold)
+		if err != nil || hold <= 0 {
+			return 0, fmt.Errorf("invalid hold time %q", r.Hold)
+		}
+		return hold, nil
+	}
+	return 0, fmt.Errorf("invalid event %q, expected %s, %s, %s, %s, "+
+		"%s, %s or %s", r.Event, Rising, Falling, Change, Held,
+		SinglePress, DoublePress, LongPress)
+}
+
+// Add validates a rule and adds it assigning an ID if it has none.
+func (e *Engine) Add(r Rule) (Rule, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	hold, err := compile(r)
+	if err != nil {
+		return r, err
+	}
+	if r.ID == "" {
+		r.ID = strconv.Itoa(e.nextID)
+	}
+	if _, ok := e.hold[r.ID]; ok {
+		return r, fmt.Errorf("duplicate rule id %s", r.ID)
+	}
+	if n, err := strconv.Atoi(r.ID); err == nil && n >= e.nextID {
+		e.nextID = n + 1
+	}
+	e.rules = append(e.rules, r)
+	e.hold[r.ID] = hold
+	return r, nil
+}
+
+// Load adds previously saved rules.
+func (e *Engine) Load(rules []Rule) error {
+	for _, r := range rules {
+		if _, err := e.Add(r); err != nil {
+			return fmt.Errorf("invalid automation %s: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes the rule with the given ID.
+func (e *Engine) Delete(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, r := range e.rules {
+		if r.ID == id {
+			e.rules = append(e.rules[:i], e.rules[i+1:]...)
+			delete(e.hold, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown automation %s", id)
+}
+
+// Has reports whether there is a rule with the given ID.
+func (e *Engine) Has(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.hold[id]
+	return ok
+}
+
+// RenameDevice updates the rules of a renamed device.
+func (e *Engine) RenameDevice(oldName, newName string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range e.rules {
+		if e.rules[i].Device == oldName {
+			e.rules[i].Device = newName
+		}
+	}
+}
+
+// DeleteDevice removes the rules of a deleted device.
+func (e *Engine) DeleteDevice(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rules := e.rules[:0]
+	for _, r := range e.rules {
+		if r.Device == name {
+			delete(e.hold, r.ID)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	e.rules = rules
+}
+
+// Rules returns the persisted form of the rules.
+func (e *Engine) Rules() []Rule {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// Update records the state of an input at time now, which is polled
+// so may be unchanged, and returns the events seen. The first state
+// seen for an input only sets the initial state. Inputs in counter
+// mode are passed to the counter.
+func (e *Engine) Update(name string, on bool, now time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.counter != nil && e.counter.Counts(name) {
+		delete(e.inputs, name)
+		if e.counter.Update(name, on, now) {
+			return []Event{{Input: name, Type: Pulse, Time: now}}
+		}
+		return nil
+	}
+	in, ok := e.inputs[name]
+	if !ok {
+		e.inputs[name] = &input{on: on, since: now, held: map[string]bool{}}
+		return nil
+	}
+	res := []Event{}
+	add := func(ev string, always bool, match func(r Rule) bool) {
+		rules := []Rule{}
+		for _, r := range e.rules {
+			if r.Input == name && match(r) {
+				rules = append(rules, r)
+			}
+		}
+		if always || len(rules) > 0 {
+			res = append(res, Event{Input: name, Type: ev, Time: now,
+				Rules: rules})
+		}
+	}
+	pressed := func(press string) {
+		in.presses = 0
+		add(press, true, func(r Rule) bool { return r.Event == press })
+	}
+	// a press not followed by another in time is a single press which
+	// is checked first in case the next press started since last seen
+	if !in.on && in.presses == 1 &&
+		now.Sub(in.released) >= e.timings.Double {
+		pressed(SinglePress)
+	}
+	if on != in.on {
+		in.on, in.since, in.held = on, now, map[string]bool{}
+		ev := Rising
+		if on {
+			in.long = false
+		} else {
+			ev = Falling
+			if !in.long {
+				in.presses++
+				in.released = now
+			}
+		}
+		watched := e.watcher != nil && e.watcher.Watches(name)
+		add(ev, watched, func(r Rule) bool {
+			return r.Event == ev || r.Event == Change
+		})
+	}
+	switch {
+	case on && !in.long && now.Sub(in.since) >= e.timings.Long:
+		// a single press waiting for a second press is dropped
+		in.long = true
+		pressed(LongPress)
+	case in.presses >= 2:
+		pressed(DoublePress)
+	}
+	if on {
+		for _, r := range e.rules {
+			if r.Input == name && r.Event == Held && !in.held[r.ID] &&
+				now.Sub(in.since) >= e.hold[r.ID] {
+				in.held[r.ID] = true
+				res = append(res, Event{Input: name, Type: Held, Time: now,
+					Rules: []Rule{r}})
+			}
+		}
+	}
+	return res
+}
+
+// Poll reads the inputs of the UDIN devices and returns the events
+// seen.
+func (e *Engine) Poll(udins map[string]*udin.UdinDevice) ([]Event, error) {
+	names := make([]string, 0, len(udins))
+	for name, u := range udins {
+		if u.NumInputs() > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	now := e.clock.Now()
+	res := []Event{}
+	for _, name := range names {
+		states, err := udins[name].Inputs(0)
+		if err != nil {
+			return res, fmt.Errorf("failed to read inputs of %s: %w",
+				name, err)
+		}
+		for i, on := range states {
+			input := fmt.Sprintf("%s-i%d", name, i+1)
+			res = append(res, e.Update(input, on, now)...)
+		}
+	}
+	return res, nil
+}
+
+// Run polls the inputs every interval and sends the events seen until
+// ctx is done. Failures to read inputs are logged.
+func (e *Engine) Run(ctx context.Context, udins map[string]*udin.UdinDevice,
+	interval time.Duration, events chan<- Event, logger *log.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.clock.After(interval):
+		}
+		evs, err := e.Poll(udins)
+		if err != nil && logger != nil {
+			logger.Printf("%s\n", err)
+		}
+		for _, ev := range evs {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package automation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2021, 11, 29, 12, 0, 0, 0, time.UTC)
+
+func Test_Update(t *testing.T) {
+	e := New(clock.NewFake(start))
+	assert.NoError(t, e.Load([]Rule{
+		{Input: "udin_44-i2", Event: Rising, Device: "light_hall",
+			Command: "toggle"},
+		{Input: "udin_44-i1", Event: Held, Hold: "2s", Device: "covers",
+			Command: "close"},
+		{Input: "udin_44-i1", Event: Falling, Device: "fan", Command: "off"},
+		{Input: "udin_44-i3", Event: Change, Device: "fan", Command: "toggle"},
+	}))
+	ids := func(events []Event) []string {
+		res := []string{}
+		for _, ev := range events {
+			for _, r := range ev.Rules {
+				res = append(res, r.ID)
+			}
+		}
+		return res
+	}
+	tests := []struct {
+		name  string
+		input string
+		on    bool
+		at    time.Duration
+		want  []string
+	}{
+		{"initial state", "udin_44-i2", true, 0, nil},
+		{"initial state", "udin_44-i1", false, 0, nil},
+		{"initial state", "udin_44-i3", false, 0, nil},
+		{"unchanged", "udin_44-i2", true, time.Second, []string{}},
+		{"falling without rule", "udin_44-i2", false, 2 * time.Second,
+			[]string{}},
+		{"rising", "udin_44-i2", true, 3 * time.Second, []string{"1"}},
+		{"pressed", "udin_44-i1", true, 4 * time.Second, []string{}},
+		{"not held long enough", "udin_44-i1", true, 5 * time.Second,
+			[]string{}},
+		{"held", "udin_44-i1", true, 6 * time.Second, []string{"2"}},
+		{"held fires once", "udin_44-i1", true, 9 * time.Second,
+			[]string{}},
+		{"released", "udin_44-i1", false, 10 * time.Second, []string{"3"}},
+		{"short press", "udin_44-i1", true, 11 * time.Second, []string{}},
+		{"short release", "udin_44-i1", false, 12 * time.Second,
+			[]string{"3"}},
+		{"change on", "udin_44-i3", true, 13 * time.Second, []string{"4"}},
+		{"change off", "udin_44-i3", false, 14 * time.Second, []string{"4"}},
+	}
+	for _, tc := range tests {
+		got := e.Update(tc.input, tc.on, start.Add(tc.at))
+		if tc.want == nil {
+			assert.Nil(t, got, tc.name)
+			continue
+		}
+		assert.Equal(t, tc.want, ids(got), tc.name)
+	}
+}
+
+func Test_RuleErrors(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{Event: Rising, Device: "d", Command: "on"}, "missing input"},
+		{Rule{Input: "u-i1", Event: Rising, Command: "on"}, "missing device"},
+		{Rule{Input: "u-i1", Event: Rising, Device: "d"}, "missing command"},
+		{Rule{Input: "u-i1", Event: "pressed", Device: "d", Command: "on"},
+			`invalid event "pressed", expected rising, falling, change, ` +
+				`held, single, double or long`},
+		{Rule{Input: "u-i1", Event: Held, Device: "d", Command: "on"},
+			`invalid hold time ""`},
+		{Rule{Input: "u-i1", Event: Held, Hold: "-1s", Device: "d",
+			Command: "on"}, `invalid hold time "-1s"`},
+		{Rule{Input: "u-i1", Event: Rising, Hold: "1s", Device: "d",
+			Command: "on"}, "hold may only be used with held"},
+	}
+	e := New(clock.NewFake(start))
+	for _, tc := range tests {
+		assert.EqualError(t, e.Validate(tc.rule), tc.want)
+		_, err := e.Add(tc.rule)
+		assert.EqualError(t, err, tc.want)
+	}
+	assert.Empty(t, e.Rules())
+	assert.Error(t, e.Load([]Rule{{Input: "u-i1"}}))
+}
+
+func Test_Rules(t *testing.T) {
+	e := New(clock.NewFake(start))
+	assert.NoError(t, e.Load([]Rule{
+		{ID: "3", Input: "u-i1", Event: Held, Hold: "2s", Device: "covers",
+			Command: "close"},
+	}))
+	r, err := e.Add(Rule{Input: "u-i2", Event: Rising, Device: "light",
+		Command: "toggle"})
+	assert.NoError(t, err)
+	assert.Equal(t, "4", r.ID)
+	assert.Equal(t, "u-i2 rising: toggle light", r.String())
+	assert.Equal(t, "u-i1 held 2s: close covers", e.Rules()[0].String())
+	_, err = e.Add(Rule{ID: "3", Input: "u-i3", Event: Rising,
+		Device: "fan", Command: "on"})
+	assert.EqualError(t, err, "duplicate rule id 3")
+	_, err = e.Add(Rule{Input: "u-i3", Event: Falling, Device: "fan",
+		Command: "off"})
+	assert.NoError(t, err)
+
+	e.RenameDevice("covers", "blinds")
+	assert.Equal(t, "blinds", e.Rules()[0].Device)
+	e.DeleteDevice("fan")
+	assert.Equal(t, 2, len(e.Rules()))
+	assert.True(t, e.Has("3"))
+	assert.NoError(t, e.Delete("3"))
+	assert.False(t, e.Has("3"))
+	assert.EqualError(t, e.Delete("3"), "unknown automation 3")
+	assert.Equal(t, []Rule{{ID: "4", Input: "u-i2", Event: Rising,
+		Device: "light", Command: "toggle"}}, e.Rules())
+
+	var nilEngine *Engine
+	assert.Nil(t, nilEngine.Rules())
+}
+
+func Test_Presses(t *testing.T) {
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{"udin_44": u44}
+	fake := clock.NewFake(start)
+	e := New(fake)
+	assert.Error(t, e.SetPressTimings(PressTimings{Long: 0, Double: 1}))
+	assert.NoError(t, e.SetPressTimings(PressTimings{
+		Long:   time.Second,
+		Double: 300 * time.Millisecond,
+	}))
+	_, err = e.Add(Rule{Input: "udin_44-i2", Event: DoublePress,
+		Device: "light", Command: "toggle"})
+	assert.NoError(t, err)
+
+	const interval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event, 100)
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx, udins, interval, events, nil)
+		close(done)
+	}()
+	// wait lets the simulated time pass one poll at a time
+	wait := func(d time.Duration) {
+		for ; d > 0; d -= interval {
+			fake.BlockUntil(1)
+			fake.Advance(interval)
+		}
+		fake.BlockUntil(1)
+	}
+	press := func(i uint, d time.Duration) {
+		assert.NoError(t, u44.SetMockInput(i, true))
+		wait(d)
+		assert.NoError(t, u44.SetMockInput(i, false))
+	}
+	got := func() []string {
+		res := []string{}
+		for len(events) > 0 {
+			ev := <-events
+			assert.True(t, ev.IsPress())
+			s := ev.Input + " " + ev.Type
+			for _, r := range ev.Rules {
+				s += " " + r.ID
+			}
+			res = append(res, s)
+		}
+		return res
+	}
+
+	wait(interval)
+	press(1, 200*time.Millisecond)
+	wait(200 * time.Millisecond)
+	assert.Empty(t, got(), "single press waits for a second press")
+	wait(200 * time.Millisecond)
+	assert.Equal(t, []string{"udin_44-i1 single"}, got())
+
+	press(2, 100*time.Millisecond)
+	wait(150 * time.Millisecond)
+	press(2, 100*time.Millisecond)
+	wait(500 * time.Millisecond)
+	assert.Equal(t, []string{"udin_44-i2 double 1"}, got())
+
+	press(3, 1500*time.Millisecond)
+	assert.Equal(t, []string{"udin_44-i3 long"}, got())
+	wait(500 * time.Millisecond)
+	assert.Empty(t, got(), "release of a long press is not a press")
+
+	// presses too far apart are two single presses
+	press(4, 100*time.Millisecond)
+	wait(400 * time.Millisecond)
+	press(4, 100*time.Millisecond)
+	wait(400 * time.Millisecond)
+	assert.Equal(t,
+		[]string{"udin_44-i4 single", "udin_44-i4 single"}, got())
+
+	cancel()
+	<-done
+}
+
+type mockCounter map[string]bool
+
+func (c mockCounter) Counts(input string) bool {
+	_, ok := c[input]
+	return ok
+}
+
+func (c mockCounter) Update(input string, on bool, now time.Time) bool {
+	pulse := on && !c[input]
+	c[input] = on
+	return pulse
+}
+
+func Test_Counter(t *testing.T) {
+	e := New(clock.NewFake(start))
+	e.SetCounter(mockCounter{"udin_44-i1": true})
+	_, err := e.Add(Rule{Input: "udin_44-i1", Event: Rising,
+		Device: "light", Command: "toggle"})
+	assert.NoError(t, err)
+	assert.Nil(t, e.Update("udin_44-i1", false, start))
+	got := e.Update("udin_44-i1", true, start.Add(time.Second))
+	assert.Equal(t, []Event{{Input: "udin_44-i1", Type: Pulse,
+		Time: start.Add(time.Second)}}, got, "counted inputs skip rules")
+	assert.False(t, got[0].IsPress())
+	assert.Nil(t, e.Update("udin_44-i1", true, start.Add(2*time.Second)))
+}
+
+type mockWatcher map[string]bool
+
+func (w mockWatcher) Watches(input string) bool {
+	return w[input]
+}
+
+func Test_Watcher(t *testing.T) {
+	e := New(clock.NewFake(start))
+	e.SetWatcher(mockWatcher{"udin_44-i1": true})
+	assert.Nil(t, e.Update("udin_44-i1", false, start))
+	assert.Nil(t, e.Update("udin_44-i2", false, start))
+	at := start.Add(time.Second)
+	assert.Equal(t, []Event{{Input: "udin_44-i1", Type: Rising, Time: at,
+		Rules: []Rule{}}}, e.Update("udin_44-i1", true, at),
+		"watched edges are reported without rules")
+	assert.Equal(t, []Event{}, e.Update("udin_44-i2", true, at))
+	at = start.Add(2 * time.Second)
+	got := e.Update("udin_44-i1", false, at)
+	if assert.NotEmpty(t, got) {
+		assert.Equal(t, Falling, got[0].Type)
+	}
+}
@@ -0,0 +1,290 @@
+// Package broker is the connection to the MQTT broker. It behaves like
+// the Home Assistant MQTT client but also supports TLS, client
+// certificates and username/password authentication.
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Config is the Home Assistant MQTT client configuration with the
+// security settings of the broker connection. TLS is used for mqtts,
+// ssl, tls and wss broker URLs.
+type Config struct {
+	mqtt.ClientConfig
+	Username string
+	Password string
+	// PasswordFile is read for the password so that it need not be in
+	// the configuration file
+	PasswordFile string
+	// CAFile is a PEM bundle of the CAs trusted to sign the broker
+	// certificate. The system CAs are trusted if it is not set.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// TLSConfig returns the TLS configuration for the broker connection.
+func (cfg *Config) TLSConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s",
+				cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf(
+				"client certificate and key files must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed to load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// Credentials returns the username and password for the broker
+// reading the password from the password file if it is set.
+func (cfg *Config) Credentials() (string, []byte, error) {
+	if cfg.PasswordFile == "" {
+		return cfg.Username, []byte(cfg.Password), nil
+	}
+	if cfg.Password != "" {
+		return "", nil, fmt.Errorf(
+			"only one of password and password file may be set")
+	}
+	b, err := os.ReadFile(cfg.PasswordFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read password file: %w", err)
+	}
+	return cfg.Username, []byte(strings.TrimRight(string(b), "\r\n")), nil
+}
+
+// Client publishes the messages sent to it and forwards the messages
+// received on its subscriptions.
+type Client struct {
+	broker   *url.URL
+	config   *Config
+	logger   *log.Logger
+	tls      *tls.Config
+	username string
+	password []byte
+	cm       *autopaho.ConnectionManager
+}
+
+// NewClient validates the configuration and loads the certificates and
+// password so that errors are reported before connecting.
+func NewClient(cfg *Config, logger *log.Logger) (*Client, error) {
+	err := mqtt.ValidateConfig(&cfg.ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	brokerURL, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %w", err)
+	}
+	tc, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	username, password, err := cfg.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		broker:   brokerURL,
+		config:   cfg,
+		logger:   logger,
+		tls:      tc,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// connectionConfig returns the configuration of the connection manager
+// that forwards received messages to out.
+func (c *Client) connectionConfig(childCtx context.Context,
+	out chan *mqtt.Msg) autopaho.ClientConfig {
+	bridgeAvailabilityTopic := mqtt.AvailabilityTopic(
+		c.config.DataTopicPrefix, "bridge")
+	cmCfg := autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{c.broker},
+		TlsCfg:            c.tls,
+		KeepAlive:         uint16(c.config.KeepAlive),
+		ConnectRetryDelay: c.config.ConnectRetryDelay,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+			c.logger.Println("MQTT connection up")
+			c.cm = cm
+
+			subs := make(map[string]paho.SubscribeOptions,
+				len(c.config.Subs))
+			for _, sub := range c.config.Subs {
+				subs[sub.Topic] = paho.SubscribeOptions{QoS: sub.QoS}
+			}
+			if len(subs) > 0 {
+				_, err := cm.Subscribe(context.Background(),
+					&paho.Subscribe{Subscriptions: subs})
+				if err != nil {
+					c.logger.Printf("failed to subscribe (%s)\n", err)
+				}
+			}
+
+			err := c.publish(childCtx, bridgeAvailabilityTopic, "online",
+				true)
+			if err != nil {
+				c.logger.Printf("failed to publish bridge availability "+
+					"online message: %s\n", err)
+			}
+		},
+		OnConnectError: func(err error) {
+			c.logger.Printf("error whilst attempting connection: %s\n", err)
+		},
+		Debug: paho.NOOPLogger{},
+		ClientConfig: paho.ClientConfig{
+			ClientID: c.config.ClientID,
+			Router: paho.NewSingleHandlerRouter(func(m *paho.Publish) {
+				out <- &mqtt.Msg{Topic: m.Topic, Body: m.Payload,
+					Retain: m.Retain}
+			}),
+			OnClientError: func(err error) {
+				c.logger.Printf("client error: %s\n", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if d.Properties != nil {
+					c.logger.Printf("server requested disconnect: %s\n",
+						d.Properties.ReasonString)
+				} else {
+					c.logger.Printf(
+						"server requested disconnect; reason code: %d\n",
+						d.ReasonCode)
+				}
+			},
+		},
+	}
+	cmCfg.SetUsernamePassword(c.username, c.password)
+	c.logger.Printf("setting will message %s: %s\n",
+		bridgeAvailabilityTopic, "offline")
+	cmCfg.SetWillMessage(bridgeAvailabilityTopic, []byte("offline"), 1, true)
+	return cmCfg
+}
+
+// Run connects to the broker and publishes the messages from in until
+// ctx is done. The bridge availability is set online when connected
+// and offline on shutdown.
+func (c *Client) Run(ctx context.Context, in chan *mqtt.Msg,
+	out chan *mqtt.Msg) error {
+	c.logger.Printf("%s v%s\n", c.config.AppName, c.config.Version)
+	c.logger.Println("Starting Home Assistant MQTT client")
+
+	childCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, err := autopaho.NewConnection(childCtx,
+		c.connectionConfig(childCtx, out))
+	if err != nil {
+		return err
+	}
+	c.cm = cm
+
+LOOP:
+	for {
+		err = cm.AwaitConnection(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break LOOP
+			}
+			return fmt.Errorf("broker connection error: %s", err)
+		}
+
+		select {
+		case m := <-in:
+			err = c.publish(ctx, m.Topic, m.Body, m.Retain)
+			if err != nil {
+				c.logger.Printf("failed to publish message for %s: %s\n",
+					m.Topic, err)
+			}
+		case <-ctx.Done():
+			break LOOP
+		}
+	}
+	c.logger.Println("shutting down")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(childCtx,
+		5*time.Second)
+	defer shutdownCancel()
+
+	pr, err := cm.Publish(shutdownCtx, &paho.Publish{
+		QoS:     1,
+		Topic:   mqtt.AvailabilityTopic(c.config.DataTopicPrefix, "bridge"),
+		Payload: []byte("offline"),
+		Retain:  true,
+	})
+	if err != nil {
+		c.logger.Printf(
+			"failed to publish availability offline message: %s\n", err)
+	} else if pr.ReasonCode != 0 && pr.ReasonCode != 16 {
+		// 16 = Server received message but there are no subscribers
+		c.logger.Printf("publish availability offline reason code %d\n",
+			pr.ReasonCode)
+	}
+	_ = cm.Disconnect(shutdownCtx)
+
+	return nil
+}
+
+func (c *Client) publish(ctx context.Context, topic string,
+	body interface{}, retain bool) error {
+	var b []byte
+	var err error
+	if s, ok := body.(string); ok {
+		b = []byte(s)
+	} else {
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	go func(msg []byte) {
+		pr, err := c.cm.Publish(ctx, &paho.Publish{
+			QoS:     1,
+			Topic:   topic,
+			Payload: msg,
+			Retain:  retain,
+		})
+		if err != nil {
+			c.logger.Printf("error publishing: %s\n", err)
+		} else if pr.ReasonCode != 0 && pr.ReasonCode != 16 {
+			// 16 = Server received message but there are no subscribers
+			c.logger.Printf("reason code %d received\n", pr.ReasonCode)
+		}
+	}(b)
+	return nil
+}
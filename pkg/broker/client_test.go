@@ -0,0 +1,308 @@
+package broker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCerts are the files of a CA and of a broker and client
+// certificate signed by it.
+type testCerts struct {
+	ca, cert, key         string
+	serverCert, serverKey string
+	caPool                *x509.CertPool
+	serverTLS             tls.Certificate
+}
+
+func writePEM(t *testing.T, path, kind string, b []byte) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: kind, Bytes: b}))
+	assert.NoError(t, f.Close())
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl,
+		&caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+	tc := &testCerts{ca: filepath.Join(dir, "ca.pem"),
+		caPool: x509.NewCertPool()}
+	tc.caPool.AddCert(caCert)
+	writePEM(t, tc.ca, "CERTIFICATE", caDER)
+
+	issue := func(serial int64, name string, ip net.IP,
+		usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		if ip != nil {
+			tmpl.IPAddresses = []net.IP{ip}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert,
+			&key.PublicKey, caKey)
+		assert.NoError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	tc.serverCert, tc.serverKey = issue(2, "broker", net.ParseIP("127.0.0.1"),
+		x509.ExtKeyUsageServerAuth)
+	tc.cert, tc.key = issue(3, "udin2mqtt", nil, x509.ExtKeyUsageClientAuth)
+	tc.serverTLS, err = tls.LoadX509KeyPair(tc.serverCert, tc.serverKey)
+	assert.NoError(t, err)
+	return tc
+}
+
+// listen starts a TLS listener that requires a client certificate.
+func (tc *testCerts) listen(t *testing.T) net.Listener {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{tc.serverTLS},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    tc.caPool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	assert.NoError(t, err)
+	return l
+}
+
+func Test_TLSConfig(t *testing.T) {
+	tc := newTestCerts(t)
+	cfg := &Config{CAFile: tc.ca, CertFile: tc.cert, KeyFile: tc.key}
+	tlsCfg, err := cfg.TLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tlsCfg.Certificates))
+	assert.False(t, tlsCfg.InsecureSkipVerify)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"missing CA", Config{CAFile: "/no/such/ca.pem"},
+			"failed to read CA file: "},
+		{"invalid CA", Config{CAFile: tc.key},
+			"no certificates found in CA file "},
+		{"certificate without key", Config{CertFile: tc.cert},
+			"client certificate and key files must both be set"},
+		{"mismatched key", Config{CertFile: tc.cert, KeyFile: tc.serverKey},
+			"failed to load client certificate: "},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.cfg.TLSConfig()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.want)
+			}
+		})
+	}
+}
+
+func Test_Credentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("s3cret\n"), 0600))
+
+	cfg := &Config{Username: "udin", Password: "pass"}
+	user, pass, err := cfg.Credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "udin", user)
+	assert.Equal(t, []byte("pass"), pass)
+
+	cfg = &Config{Username: "udin", PasswordFile: file}
+	_, pass, err = cfg.Credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("s3cret"), pass)
+
+	cfg.Password = "pass"
+	_, _, err = cfg.Credentials()
+	assert.EqualError(t, err,
+		"only one of password and password file may be set")
+
+	cfg = &Config{PasswordFile: file + ".missing"}
+	_, _, err = cfg.Credentials()
+	assert.Error(t, err)
+}
+
+func Test_VerifyBroker(t *testing.T) {
+	tc := newTestCerts(t)
+	l := tc.listen(t)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	dial := func(cfg *Config) error {
+		tlsCfg, err := cfg.TLSConfig()
+		assert.NoError(t, err)
+		conn, err := tls.Dial("tcp", l.Addr().String(), tlsCfg)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	assert.Error(t, dial(&Config{CertFile: tc.cert, KeyFile: tc.key}),
+		"broker certificate is not signed by a system CA")
+	assert.NoError(t, dial(&Config{CAFile: tc.ca, CertFile: tc.cert,
+		KeyFile: tc.key}))
+	assert.NoError(t, dial(&Config{InsecureSkipVerify: true,
+		CertFile: tc.cert, KeyFile: tc.key}))
+}
+
+// fakeBroker accepts one connection, acknowledges the connect and
+// QoS 1 publishes and reports what it received.
+func fakeBroker(t *testing.T, l net.Listener, connects chan *packets.Connect,
+	clientCNs chan string, publishes chan *packets.Publish) {
+	conn, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			state := conn.(*tls.Conn).ConnectionState()
+			clientCNs <- state.PeerCertificates[0].Subject.CommonName
+			connects <- p
+			_, err = (&packets.Connack{
+				Properties: &packets.Properties{},
+			}).WriteTo(conn)
+		case *packets.Publish:
+			// the flags are only decoded into the fixed header
+			p.QoS = (cp.Flags >> 1) & 0x03
+			p.Retain = cp.Flags&0x01 != 0
+			publishes <- p
+			if p.QoS == 1 {
+				_, err = (&packets.Puback{
+					PacketID:   p.PacketID,
+					Properties: &packets.Properties{},
+				}).WriteTo(conn)
+			}
+		case *packets.Disconnect:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func Test_Run(t *testing.T) {
+	tc := newTestCerts(t)
+	l := tc.listen(t)
+	defer l.Close()
+	connects := make(chan *packets.Connect, 1)
+	clientCNs := make(chan string, 1)
+	publishes := make(chan *packets.Publish, 10)
+	go fakeBroker(t, l, connects, clientCNs, publishes)
+
+	password := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, ioutil.WriteFile(password, []byte("s3cret\n"), 0600))
+	c, err := NewClient(&Config{
+		ClientConfig: mqtt.ClientConfig{
+			AppName:         "udin2mqtt",
+			ClientID:        "test",
+			Broker:          "mqtts://" + l.Addr().String(),
+			DataTopicPrefix: "udin",
+		},
+		Username:     "udin",
+		PasswordFile: password,
+		CAFile:       tc.ca,
+		CertFile:     tc.cert,
+		KeyFile:      tc.key,
+	}, log.New(ioutil.Discard, "", 0))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan *mqtt.Msg, 1)
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx, in, make(chan *mqtt.Msg, 1))
+	}()
+
+	connect := <-connects
+	assert.Equal(t, "udin2mqtt", <-clientCNs)
+	assert.Equal(t, "udin", connect.Username)
+	assert.Equal(t, []byte("s3cret"), connect.Password)
+	assert.Equal(t, "test", connect.ClientID)
+	online := <-publishes
+	assert.Equal(t, "udin/bridge/availability", online.Topic)
+	assert.Equal(t, "online", string(online.Payload))
+
+	in <- &mqtt.Msg{Topic: "udin/blind/state", Body: "open", Retain: true}
+	state := <-publishes
+	assert.Equal(t, "udin/blind/state", state.Topic)
+	assert.Equal(t, "open", string(state.Payload))
+	assert.True(t, state.Retain)
+
+	cancel()
+	offline := <-publishes
+	assert.Equal(t, "udin/bridge/availability", offline.Topic)
+	assert.Equal(t, "offline", string(offline.Payload))
+	assert.NoError(t, <-done)
+}
+
+func Test_NewClientErrors(t *testing.T) {
+	_, err := NewClient(&Config{ClientConfig: mqtt.ClientConfig{
+		ClientID: "test", Broker: "mqtts://127.0.0.1:8883"},
+		CAFile: "/no/such/ca.pem"}, nil)
+	assert.Error(t, err)
+	_, err = NewClient(&Config{ClientConfig: mqtt.ClientConfig{
+		ClientID: "test", Broker: "mqtts://127.0.0.1:8883"},
+		Password: "a", PasswordFile: "b"}, nil)
+	assert.Error(t, err)
+	_, err = NewClient(&Config{ClientConfig: mqtt.ClientConfig{
+		Broker: "mqtts://127.0.0.1:8883"}}, nil)
+	assert.EqualError(t, err, "ClientConfig is missing required ClientID")
+}
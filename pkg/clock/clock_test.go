@@ -0,0 +1,42 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Fake(t *testing.T) {
+	start := time.Date(2021, 11, 29, 7, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	assert.Equal(t, start, f.Now())
+
+	now := f.After(0)
+	assert.Equal(t, start, <-now)
+
+	a := f.After(2 * time.Minute)
+	b := f.After(time.Minute)
+	done := make(chan struct{})
+	go func() {
+		f.BlockUntil(2)
+		close(done)
+	}()
+	<-done
+
+	f.Advance(30 * time.Second)
+	assert.Empty(t, a)
+	assert.Empty(t, b)
+	f.Advance(30 * time.Second)
+	assert.Empty(t, a)
+	assert.Equal(t, start.Add(time.Minute), <-b)
+	f.Advance(5 * time.Minute)
+	assert.Equal(t, start.Add(6*time.Minute), <-a)
+	assert.Equal(t, start.Add(6*time.Minute), f.Now())
+}
+
+func Test_Real(t *testing.T) {
+	before := time.Now()
+	assert.False(t, Real.Now().Before(before))
+	assert.False(t, (<-Real.After(time.Millisecond)).Before(before))
+}
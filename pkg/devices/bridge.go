@@ -0,0 +1,154 @@
+package devices
+
+import (
+	"fmt"
+	"sort"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/automation"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+)
+
+const udinManufacturer = "Audon Electronics"
+
+// triggerTypes maps press types to Home Assistant device trigger types.
+var triggerTypes = map[string]string{
+	automation.SinglePress: "button_short_press",
+	automation.DoublePress: "button_double_press",
+	automation.LongPress:   "button_long_press",
+}
+
+// UdinInfo is the body of the retained <bridge>/<udin>/info message
+// used as the attributes of the UDIN connectivity sensor.
+type UdinInfo struct {
+	Model  string `json:"model"`
+	Path   string `json:"path"`
+	Relays uint   `json:"relays"`
+	Inputs uint   `json:"inputs"`
+}
+
+// BridgeName is used in the topics of the bridge in place of a device
+// name so it can not be the name of a device or meter.
+const BridgeName = "bridge"
+
+// BridgeID returns the Home Assistant device identifier of the bridge.
+func BridgeID(cfg types.SimpleStringConfig) string {
+	return cfg.GetString("Bridge_Topic") + "_bridge"
+}
+
+// UdinID returns the Home Assistant device identifier of a UDIN.
+func UdinID(cfg types.SimpleStringConfig, name string) string {
+	return cfg.GetString("Bridge_Topic") + "_" + name
+}
+
+// InputActionTopic is the topic that presses of an input are published
+// to with the press type as the payload.
+func InputActionTopic(cfg types.SimpleStringConfig, input string) string {
+	return cfg.GetString("Bridge_Topic") + "/" + input + "/action"
+}
+
+// AlertTopic is the topic that alerts, such as relays switched off by
+// the watchdog, are published to.
+func AlertTopic(cfg types.SimpleStringConfig) string {
+	return cfg.GetString("Bridge_Topic") + "/bridge/alert"
+}
+
+// BridgeMessages returns the retained discovery messages for the bridge
+// and UDIN devices that entities are linked to with via_device, the
+// info messages for each UDIN and the device triggers for the presses
+// of their inputs.
+func (d *Devices) BridgeMessages(cfg types.SimpleStringConfig) []*mqtt.Msg {
+	bridge := cfg.GetString("Bridge_Topic")
+	availability := mqtt.AvailabilityTopic(bridge, "bridge")
+	version := fmt.Sprintf("%s v%s",
+		cfg.GetString("App_Name"), cfg.GetString("Version"))
+	configURL := "http://" + cfg.GetString("UI_Advertise")
+	id := BridgeID(cfg)
+	res := []*mqtt.Msg{
+		{
+			Topic: cfg.GetString("Discovery_Prefix") +
+				"/binary_sensor/" + id + "/config",
+			Body: ha.BinarySensor{
+				Device: ha.Device{
+					Identifiers:      []string{id},
+					Name:             cfg.GetString("App_Name"),
+					SwVersion:        version,
+					ConfigurationURL: configURL,
+				},
+				DeviceClass:    "connectivity",
+				EntityCategory: ha.DiagnosticEntity,
+				Name:           id + " connection",
+				UniqueID:       id + "_connection",
+				StateTopic:     availability,
+				PayloadOn:      "online",
+				PayloadOff:     "offline",
+			},
+			Retain: true,
+		},
+	}
+	names := make([]string, 0, len(d.udins))
+	for name := range d.udins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := d.udins[name]
+		uid := UdinID(cfg, name)
+		infoTopic := bridge + "/" + name + "/info"
+		res = append(res,
+			&mqtt.Msg{
+				Topic: cfg.GetString("Discovery_Prefix") +
+					"/binary_sensor/" + uid + "/config",
+				Body: ha.BinarySensor{
+					Device: ha.Device{
+						Identifiers:      []string{uid},
+						Name:             name,
+						Manufacturer:     udinManufacturer,
+						Model:            u.Model(),
+						SwVersion:        version,
+						ConfigurationURL: configURL,
+						ViaDevice:        id,
+					},
+					DeviceClass:         "connectivity",
+					EntityCategory:      ha.DiagnosticEntity,
+					Name:                name + " connection",
+					UniqueID:            uid + "_connection",
+					StateTopic:          availability,
+					PayloadOn:           "online",
+					PayloadOff:          "offline",
+					JSONAttributesTopic: infoTopic,
+				},
+				Retain: true,
+			},
+			&mqtt.Msg{
+				Topic: infoTopic,
+				Body: UdinInfo{
+					Model:  u.Model(),
+					Path:   u.Path(),
+					Relays: u.NumRelays(),
+					Inputs: u.NumInputs(),
+				},
+				Retain: true,
+			})
+		for i := uint(1); i <= u.NumInputs(); i++ {
+			input := fmt.Sprintf("%s-i%d", name, i)
+			for _, press := range automation.PressTypes {
+				res = append(res, &mqtt.Msg{
+					Topic: fmt.Sprintf("%s/device_automation/%s/%s_%s/config",
+						cfg.GetString("Discovery_Prefix"), uid, input, press),
+					Body: ha.DeviceTrigger{
+						AutomationType: "trigger",
+						Topic:          InputActionTopic(cfg, input),
+						Payload:        press,
+						Type:           triggerTypes[press],
+						Subtype:        fmt.Sprintf("button_%d", i),
+						Device:         ha.Device{Identifiers: []string{uid}},
+					},
+					Retain: true,
+				})
+			}
+		}
+	}
+	return res
+}
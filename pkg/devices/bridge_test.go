@@ -0,0 +1,102 @@
+package devices
+
+import (
+	"testing"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BridgeMessages(t *testing.T) {
+	devs := testDevices(t)
+	cfg := MockCfg{
+		"App_Name":         "udin2mqtt",
+		"Version":          "0.0.1",
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+		"UI_Advertise":     "10.0.0.1:8094",
+	}
+
+	msgs := devs.BridgeMessages(cfg)
+	assert.Equal(t, 3, len(msgs))
+
+	assert.Equal(t, "homeassistant/binary_sensor/udin_bridge/config",
+		msgs[0].Topic)
+	assert.True(t, msgs[0].Retain)
+	bridge := msgs[0].Body.(ha.BinarySensor)
+	assert.Equal(t, []string{"udin_bridge"}, bridge.Device.Identifiers)
+	assert.Equal(t, "udin2mqtt", bridge.Device.Name)
+	assert.Equal(t, "udin/bridge/availability", bridge.StateTopic)
+	assert.Equal(t, ha.DiagnosticEntity, bridge.EntityCategory)
+
+	assert.Equal(t, "homeassistant/binary_sensor/udin_udin_8r/config",
+		msgs[1].Topic)
+	udin8r := msgs[1].Body.(ha.BinarySensor)
+	assert.Equal(t, ha.Device{
+		Identifiers:      []string{"udin_udin_8r"},
+		Name:             "udin_8r",
+		Manufacturer:     "Audon Electronics",
+		Model:            "UDIN-8R 8 x Relay V1.0",
+		SwVersion:        "udin2mqtt v0.0.1",
+		ConfigurationURL: "http://10.0.0.1:8094",
+		ViaDevice:        "udin_bridge",
+	}, udin8r.Device)
+	assert.Equal(t, "udin/udin_8r/info", udin8r.JSONAttributesTopic)
+
+	assert.Equal(t, "udin/udin_8r/info", msgs[2].Topic)
+	assert.True(t, msgs[2].Retain)
+	assert.Equal(t, UdinInfo{
+		Model:  "UDIN-8R 8 x Relay V1.0",
+		Path:   "mock",
+		Relays: 8,
+		Inputs: 0,
+	}, msgs[2].Body)
+
+	// entities are linked to the UDIN of their first relay and groups
+	// to the bridge
+	for name, via := range map[string]string{
+		"blind1": "udin_udin_8r",
+		"vent":   "udin_udin_8r",
+		"blinds": "udin_bridge",
+	} {
+		msg, err := devs.DiscoveryMessage(name, cfg)
+		assert.NoError(t, err)
+		var dev ha.Device
+		switch body := msg.Body.(type) {
+		case ha.Cover:
+			dev = body.Device
+		case ha.Fan:
+			dev = body.Device
+		}
+		assert.Equal(t, via, dev.ViaDevice, name)
+	}
+}
+
+func Test_InputTriggers(t *testing.T) {
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	devs := NewDevices(map[string]*udin.UdinDevice{"udin_44": u44})
+	cfg := MockCfg{
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+	}
+	msgs := devs.BridgeMessages(cfg)
+	// bridge, UDIN, info and three presses for each input
+	assert.Equal(t, 3+4*3, len(msgs))
+	assert.Equal(t,
+		"homeassistant/device_automation/udin_udin_44/udin_44-i2_double/config",
+		msgs[7].Topic)
+	assert.True(t, msgs[7].Retain)
+	assert.Equal(t, ha.DeviceTrigger{
+		AutomationType: "trigger",
+		Topic:          "udin/udin_44-i2/action",
+		Payload:        "double",
+		Type:           "button_double_press",
+		Subtype:        "button_2",
+		Device:         ha.Device{Identifiers: []string{"udin_udin_44"}},
+	}, msgs[7].Body)
+	assert.Equal(t, "udin/udin_44-i4/action",
+		InputActionTopic(cfg, "udin_44-i4"))
+	assert.Equal(t, "udin/bridge/alert", AlertTopic(cfg))
+}
@@ -0,0 +1,158 @@
+package devices
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/limit"
+)
+
+// Config is the persisted form of a device as held in the device store
+// and, before the store existed, in the "device" section of the
+// configuration file.
+type Config struct {
+	Kind         string   `json:"kind" yaml:"kind" mapstructure:"kind"`
+	Def          []string `json:"def" yaml:"def" mapstructure:"def"`
+	Enabled      bool     `json:"enabled" yaml:"enabled" mapstructure:"enabled"`
+	Icon         string   `json:"icon,omitempty" yaml:"icon,omitempty" mapstructure:"icon"`
+	Code         string   `json:"code,omitempty" yaml:"code,omitempty" mapstructure:"code"`
+	Pulse        string   `json:"pulse,omitempty" yaml:"pulse,omitempty" mapstructure:"pulse"`
+	Guard        string   `json:"guard,omitempty" yaml:"guard,omitempty" mapstructure:"guard"`
+	RateLimit    string   `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty" mapstructure:"rate_limit"`
+	RatePolicy   string   `json:"rate_policy,omitempty" yaml:"rate_policy,omitempty" mapstructure:"rate_policy"`
+	Area         string   `json:"area,omitempty" yaml:"area,omitempty" mapstructure:"area"`
+	Manufacturer string   `json:"manufacturer,omitempty" yaml:"manufacturer,omitempty" mapstructure:"manufacturer"`
+	Model        string   `json:"model,omitempty" yaml:"model,omitempty" mapstructure:"model"`
+}
+
+// RedactedCode replaces lock codes in exported device configurations.
+// Importing it keeps the code of the existing device.
+const RedactedCode = "REDACTED"
+
+// Configs returns the persisted form of all devices.
+func (d *Devices) Configs() map[string]Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make(map[string]Config, len(d.dev))
+	for name, dev := range d.dev {
+		res[name] = dev.config()
+	}
+	return res
+}
+
+// RedactCodes replaces the lock codes in cfgs with RedactedCode.
+func RedactCodes(cfgs map[string]Config) map[string]Config {
+	for name, cfg := range cfgs {
+		if cfg.Code != "" {
+			cfg.Code = RedactedCode
+			cfgs[name] = cfg
+		}
+	}
+	return cfgs
+}
+
+func (d *Device) config() Config {
+	cfg := Config{
+		Kind:         d.Type.String(),
+		Def:          d.Def,
+		Enabled:      d.Enabled,
+		Icon:         d.Icon,
+		Code:         d.Code,
+		Area:         d.Info.Area,
+		Manufacturer: d.Info.Manufacturer,
+		Model:        d.Info.Model,
+	}
+	if d.Timing.Pulse != 0 {
+		cfg.Pulse = d.Timing.Pulse.String()
+	}
+	if d.Timing.Guard != 0 {
+		cfg.Guard = d.Timing.Guard.String()
+	}
+	if d.Limit.Interval != 0 {
+		cfg.RateLimit = d.Limit.Interval.String()
+		cfg.RatePolicy = d.Limit.Policy
+	}
+	return cfg
+}
+
+// Load creates devices from their persisted form. Groups are created
+// after the devices they refer to so that they validate.
+func (d *Devices) Load(cfgs map[string]Config) error {
+	names := []string{}
+	groups := []string{}
+	for name, cfg := range cfgs {
+		if IsGroupKind(cfg.Kind) {
+			groups = append(groups, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(groups)
+	for _, name := range append(names, groups...) {
+		cfg := cfgs[name]
+		args := append([]string{name, cfg.Kind}, cfg.Def...)
+		_, err := d.Create(args, cfg.Enabled, cfg.Icon)
+		if err != nil {
+			return fmt.Errorf("unable to create device %s: %w", name, err)
+		}
+		timing, err := cfg.timing()
+		if err != nil {
+			return fmt.Errorf("invalid timing for device %s: %w", name, err)
+		}
+		err = d.SetTiming(name, timing)
+		if err != nil {
+			return err
+		}
+		l, err := cfg.limit()
+		if err != nil {
+			return fmt.Errorf("invalid rate limit for device %s: %w", name,
+				err)
+		}
+		err = d.SetLimit(name, l)
+		if err != nil {
+			return err
+		}
+		err = d.SetInfo(name, Info{
+			Area:         cfg.Area,
+			Manufacturer: cfg.Manufacturer,
+			Model:        cfg.Model,
+		})
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.replace(name, func(dev *Device) { dev.Code = cfg.Code })
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+func (cfg Config) timing() (Timing, error) {
+	var t Timing
+	var err error
+	if cfg.Pulse != "" {
+		t.Pulse, err = time.ParseDuration(cfg.Pulse)
+		if err != nil {
+			return t, err
+		}
+	}
+	if cfg.Guard != "" {
+		t.Guard, err = time.ParseDuration(cfg.Guard)
+		if err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+func (cfg Config) limit() (limit.Limit, error) {
+	l := limit.Limit{Policy: cfg.RatePolicy}
+	if cfg.RateLimit == "" {
+		return l, nil
+	}
+	var err error
+	l.Interval, err = time.ParseDuration(cfg.RateLimit)
+	return l, err
+}
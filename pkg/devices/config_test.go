@@ -0,0 +1,135 @@
+package devices
+
+import (
+	"testing"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/limit"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Configs(t *testing.T) {
+	devs := testDevices(t)
+	err := devs.SetTiming("blind1", Timing{
+		Pulse: 300 * time.Millisecond,
+		Guard: time.Second,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, devs.SetLimit("blinds", limit.Limit{
+		Interval: 2 * time.Second,
+		Policy:   limit.Coalesce,
+	}))
+	assert.EqualError(t, devs.SetLimit("blinds", limit.Limit{
+		Interval: time.Second,
+		Policy:   "ignore",
+	}), `invalid rate limit for device blinds: invalid policy "ignore", `+
+		`expected drop, coalesce or queue`)
+	assert.Error(t, devs.SetLimit("nope", limit.Limit{}))
+	// the bridge policy applies to a limit without a policy
+	assert.NoError(t, devs.SetLimit("vent", limit.Limit{
+		Interval: time.Second,
+	}))
+	devs.Device("vent").Icon = "mdi:fan-speed-1"
+	devs.Device("vent").Code = "1234"
+	assert.NoError(t, devs.SetInfo("vent", Info{Area: "Bathroom",
+		Manufacturer: "Acme", Model: "X2"}))
+	assert.Error(t, devs.SetInfo("nope", Info{}))
+	_, err = devs.EnableDisable("blind2", false, MockCfg{})
+	assert.NoError(t, err)
+
+	want := map[string]Config{
+		"blind1": {
+			Kind:    "momentaryopenclose",
+			Def:     []string{"udin_8r-r1", "udin_8r-r2"},
+			Enabled: true,
+			Pulse:   "300ms",
+			Guard:   "1s",
+		},
+		"blind2": {
+			Kind: "momentaryopenclose",
+			Def:  []string{"udin_8r-r3", "udin_8r-r4"},
+		},
+		"vent": {
+			Kind:         "multispeedfan",
+			Def:          []string{"udin_8r-r5", "udin_8r-r6"},
+			Enabled:      true,
+			Icon:         "mdi:fan-speed-1",
+			Code:         "1234",
+			Area:         "Bathroom",
+			Manufacturer: "Acme",
+			Model:        "X2",
+			RateLimit:    "1s",
+		},
+		"blinds": {
+			Kind:       "devicegroup",
+			Def:        []string{"blind1", "blind2"},
+			Enabled:    true,
+			RateLimit:  "2s",
+			RatePolicy: "coalesce",
+		},
+	}
+	assert.Equal(t, want, devs.Configs())
+
+	// loading the configs recreates the same devices
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	loaded := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	assert.NoError(t, loaded.Load(want))
+	assert.Equal(t, want, loaded.Configs())
+	assert.Equal(t, 300*time.Millisecond, loaded.Device("blind1").PulseTime())
+}
+
+func Test_LoadError(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	tests := []struct {
+		name string
+		cfgs map[string]Config
+	}{
+		{
+			name: "invalid definition",
+			cfgs: map[string]Config{
+				"blind": {Kind: "0", Def: []string{"udin_8r-r1"}},
+			},
+		},
+		{
+			name: "invalid pulse",
+			cfgs: map[string]Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r1"}, Pulse: "x"},
+			},
+		},
+		{
+			name: "invalid guard",
+			cfgs: map[string]Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r1"}, Guard: "y"},
+			},
+		},
+		{
+			name: "negative pulse",
+			cfgs: map[string]Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r1"}, Pulse: "-1s"},
+			},
+		},
+		{
+			name: "invalid rate limit",
+			cfgs: map[string]Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r1"},
+					RateLimit: "fast"},
+			},
+		},
+		{
+			name: "invalid rate policy",
+			cfgs: map[string]Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r1"},
+					RateLimit: "1s", RatePolicy: "ignore"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			devs := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+			assert.Error(t, devs.Load(tc.cfgs))
+		})
+	}
+}
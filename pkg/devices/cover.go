@@ -0,0 +1,116 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+)
+
+// Cover states published on the state topic of a cover.
+const (
+	CoverOpening = "opening"
+	CoverClosing = "closing"
+	CoverOpen    = "open"
+	CoverClosed  = "closed"
+)
+
+// coverType is a cover driven by pulsing an open and a close relay.
+type coverType struct{}
+
+func (coverType) Name() string      { return "momentaryopenclose" }
+func (coverType) Aliases() []string { return nil }
+func (coverType) Component() string { return "cover" }
+
+func (coverType) Relays(d *Device) []string {
+	if len(d.Def) > 2 {
+		return d.Def[:2]
+	}
+	return d.Def
+}
+
+func (coverType) Validate(d *Device, v *Validation) {
+	if len(d.Def) != 2 {
+		v.Add("def", strings.Join(d.Def, ","),
+			"expected open and close relays")
+	}
+}
+
+func (coverType) Command(d *Device, cmd string) ([]*Action, error) {
+	var relay string
+	switch strings.ToLower(cmd) {
+	case "open":
+		relay = d.Def[0]
+	case "close":
+		relay = d.Def[1]
+	default:
+		return nil, fmt.Errorf("invalid command on %s: %s", d.Name, cmd)
+	}
+	act, err := relayAction(relay, "pulse")
+	if err != nil {
+		return nil, err
+	}
+	act.Duration = d.PulseTime()
+	return []*Action{act}, nil
+}
+
+func (coverType) Discovery(d *Device, e *Entity) (interface{}, error) {
+	return ha.Cover{
+		CommandTopic: e.CommandTopic,
+		StateTopic:   e.StateTopic,
+		Device:       e.Device,
+		Availability: e.Availability,
+		UniqueID:     e.UniqueID,
+		Name:         e.Name,
+		Icon:         e.icon("mdi:blinds"),
+	}, nil
+}
+
+func (coverType) State(d *Device, src StateSource) interface{} {
+	if len(d.Def) < 2 {
+		return nil
+	}
+	switch {
+	case src.RelayOn(d.Def[0]):
+		return CoverOpening
+	case src.RelayOn(d.Def[1]):
+		return CoverClosing
+	}
+	// the position of a cover is unknown until it is moved or
+	// restored from the retained state
+	if pos := src.Position(d.Name); pos != "" {
+		return pos
+	}
+	return nil
+}
+
+// Toggle closes an open or opening cover and otherwise opens it.
+func (coverType) Toggle(d *Device, state interface{}) (string, error) {
+	if state == CoverOpen || state == CoverOpening {
+		return "close", nil
+	}
+	return "open", nil
+}
+
+// AggregateState reports a moving member first, then the group is
+// open if any member is.
+func (coverType) AggregateState(states []interface{}) interface{} {
+	for _, want := range []string{CoverOpening, CoverClosing, CoverOpen} {
+		for _, st := range states {
+			if st == want {
+				return want
+			}
+		}
+	}
+	return CoverClosed
+}
+
+func (coverType) Form() Form {
+	return Form{
+		Label: "Momentary open/close (cover)",
+		Fields: []FormField{
+			{Name: "open", Label: "Open", Kind: RelayField},
+			{Name: "close", Label: "Close", Kind: RelayField},
+		},
+	}
+}
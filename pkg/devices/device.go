@@ -4,26 +4,50 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
 	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/limit"
 	"github.com/beanz/udin2mqtt-go/pkg/types"
 )
 
+// RelayType identifies a registered DeviceType.
 type RelayType int
 
-const (
-	MomentaryOpenClose RelayType = iota
-	UnsupportedRelayType
+// The built in device types.
+var (
+	MomentaryOpenClose = Register(coverType{})
+	MultiSpeedFan      = Register(fanType{})
+	ElectricLock       = Register(lockType{})
+	DeviceGroup        = Register(groupType{})
 )
 
-func (r RelayType) String() string {
-	switch r {
-	case MomentaryOpenClose:
-		return "momentaryopenclose"
-	default:
-		return "unsupportedrelaytype"
-	}
+// UnsupportedRelayType is the type of kinds that are not registered.
+const UnsupportedRelayType RelayType = -1
+
+// DefaultPulseTime is how long a relay is energised for a momentary
+// action if the device has no pulse time configured.
+const DefaultPulseTime = time.Second
+
+// DefaultUnlockTime is how long an ElectricLock relay is energised if
+// neither the definition nor the timing include a duration.
+const DefaultUnlockTime = 5 * time.Second
+
+// Timing holds the per-device relay timing settings. Pulse is how long
+// a relay is energised for a momentary action and Guard is how long to
+// wait after switching relays off before switching another relay on,
+// or before reversing the direction of a cover.
+type Timing struct {
+	Pulse time.Duration
+	Guard time.Duration
+}
+
+// Info holds the optional Home Assistant device registry settings.
+type Info struct {
+	Area         string
+	Manufacturer string
+	Model        string
 }
 
 type Device struct {
@@ -32,40 +56,140 @@ type Device struct {
 	Def     []string
 	Enabled bool
 	Icon    string
+	Code    string
+	Timing  Timing
+	Limit   limit.Limit
+	Info    Info
+	// group is set on the template used for discovery of a group so
+	// that it is linked to the bridge rather than to a UDIN
+	group bool
+}
+
+func (d *Device) PulseTime() time.Duration {
+	if d.Timing.Pulse > 0 {
+		return d.Timing.Pulse
+	}
+	return DefaultPulseTime
 }
 
 type Action struct {
-	Udin   string
-	Relay  uint
-	Action string
+	Device   string
+	Udin     string
+	Relay    uint
+	Action   string
+	Duration time.Duration
+	Delay    time.Duration
 }
 
 func (a *Action) String() string {
 	return fmt.Sprintf("%s[%d].%s", a.Udin, a.Relay, a.Action)
 }
 
-func (d *Device) Command(cmd string) (*Action, error) {
-	switch d.Type {
-	case MomentaryOpenClose:
-		var relay string
-		switch strings.ToLower(cmd) {
-		case "open":
-			relay = d.Def[0]
-		case "close":
-			relay = d.Def[1]
-		default:
-			return nil, fmt.Errorf("invalid command on %s: %s", d.Name, cmd)
-		}
-		rs := strings.SplitN(relay, "-", 2)
-		i, err := strconv.Atoi(rs[1][1:])
-		if err != nil {
-			return nil, fmt.Errorf("invalid instance %s: %w", rs[1], err)
-		}
-		return &Action{Udin: rs[0], Relay: uint(i), Action: "pulse"}, nil
-	default:
+func (a *Action) RelayName() string {
+	return fmt.Sprintf("%s-r%d", a.Udin, a.Relay)
+}
+
+// ParseRelay splits a relay name of the form <udin>-r<number>.
+func ParseRelay(relay string) (string, uint, error) {
+	return parseRelay(relay)
+}
+
+func parseRelay(relay string) (string, uint, error) {
+	rs := strings.SplitN(relay, "-", 2)
+	if len(rs) != 2 || rs[0] == "" || !strings.HasPrefix(rs[1], "r") {
+		return "", 0, fmt.Errorf("invalid relay %s", relay)
+	}
+	i, err := strconv.ParseUint(rs[1][1:], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid instance %s: %w", rs[1], err)
+	}
+	return rs[0], uint(i), nil
+}
+
+// ParseInput splits an input name of the form <udin>-i<number>.
+func ParseInput(input string) (string, uint, error) {
+	is := strings.SplitN(input, "-", 2)
+	if len(is) != 2 || is[0] == "" || !strings.HasPrefix(is[1], "i") {
+		return "", 0, fmt.Errorf("invalid input %s", input)
+	}
+	i, err := strconv.ParseUint(is[1][1:], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid instance %s: %w", is[1], err)
+	}
+	return is[0], uint(i), nil
+}
+
+func relayAction(relay, action string) (*Action, error) {
+	u, i, err := parseRelay(relay)
+	if err != nil {
+		return nil, err
+	}
+	return &Action{Udin: u, Relay: i, Action: action}, nil
+}
+
+// Command maps a payload from the command topic to relay actions.
+func (d *Device) Command(cmd string) ([]*Action, error) {
+	t := d.Type.deviceType()
+	if t == nil {
 		return nil, fmt.Errorf("unsupported device type for command on %s: %s",
 			d.Name, d.Type)
 	}
+	return t.Command(d, cmd)
+}
+
+// StateSource provides the recorded relay and input states and cover
+// positions that device states are derived from.
+type StateSource interface {
+	RelayOn(relay string) bool
+	InputOn(input string) bool
+	Position(name string) string
+}
+
+// State returns the current state of the device or nil if the device
+// type does not report state or the state is not known.
+func (d *Device) State(src StateSource) interface{} {
+	t := d.Type.deviceType()
+	if t == nil {
+		return nil
+	}
+	return t.State(d, src)
+}
+
+// aggregateState combines the states of the members of a group of
+// devices of type t into a single state for the group.
+func aggregateState(t RelayType, states []interface{}) interface{} {
+	dt := t.deviceType()
+	if len(states) == 0 || dt == nil {
+		return nil
+	}
+	return dt.AggregateState(states)
+}
+
+func (d *Device) StateTopic(cfg types.SimpleStringConfig) string {
+	return mqtt.StateTopic(cfg.GetString("Bridge_Topic"), d.Name)
+}
+
+func (d *Device) CommandTopic(cfg types.SimpleStringConfig) string {
+	return fmt.Sprintf("%s/%s/set", cfg.GetString("Bridge_Topic"), d.Name)
+}
+
+func (d *Device) DiscoveryTopic(cfg types.SimpleStringConfig) string {
+	return fmt.Sprintf("%s/%s/%s/config",
+		cfg.GetString("Discovery_Prefix"), d.Type.Component(), d.Name)
+}
+
+// viaDevice returns the identifier of the UDIN device that the first
+// relay of the device is on or of the bridge if it has no relays.
+func (d *Device) viaDevice(cfg types.SimpleStringConfig) string {
+	relays := d.Relays()
+	if d.group || len(relays) == 0 {
+		return BridgeID(cfg)
+	}
+	u, _, err := parseRelay(relays[0])
+	if err != nil {
+		return BridgeID(cfg)
+	}
+	return UdinID(cfg, u)
 }
 
 func (d *Device) DiscoveryMessage(cfg types.SimpleStringConfig) (*mqtt.Msg, error) {
@@ -76,6 +200,10 @@ func (d *Device) DiscoveryMessage(cfg types.SimpleStringConfig) (*mqtt.Msg, erro
 		Name:             d.Name,
 		SwVersion:        defaultVersion,
 		ConfigurationURL: "http://" + cfg.GetString("UI_Advertise"),
+		Manufacturer:     d.Info.Manufacturer,
+		Model:            d.Info.Model,
+		SuggestedArea:    d.Info.Area,
+		ViaDevice:        d.viaDevice(cfg),
 	}
 	defaultAvailability := []ha.Availability{
 		{
@@ -84,27 +212,25 @@ func (d *Device) DiscoveryMessage(cfg types.SimpleStringConfig) (*mqtt.Msg, erro
 			),
 		},
 	}
-	icon := d.Icon
-	if icon == "" {
-		icon = "mdi:blinds"
+	var body interface{}
+	if t := d.Type.deviceType(); t != nil {
+		var err error
+		body, err = t.Discovery(d, &Entity{
+			Name:         d.Name,
+			UniqueID:     d.Name,
+			Icon:         d.Icon,
+			CommandTopic: d.CommandTopic(cfg),
+			StateTopic:   d.StateTopic(cfg),
+			Device:       defaultHADevice,
+			Availability: defaultAvailability,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	switch d.Type {
-	case MomentaryOpenClose:
-		return &mqtt.Msg{
-			Topic: fmt.Sprintf("%s/cover/%s/config",
-				cfg.GetString("Discovery_Prefix"), d.Name),
-			Body: ha.Cover{
-				CommandTopic: fmt.Sprintf("%s/%s/set",
-					cfg.GetString("Bridge_Topic"), d.Name),
-				Device:       defaultHADevice,
-				Availability: defaultAvailability,
-				UniqueID:     d.Name,
-				Name:         d.Name,
-				Icon:         icon,
-			},
-		}, nil
-	default:
+	if body == nil {
 		return nil, fmt.Errorf("unsupported device type on device %s: %v",
 			d.Name, d.Type)
 	}
+	return &mqtt.Msg{Topic: d.DiscoveryTopic(cfg), Body: body}, nil
 }
@@ -50,14 +50,123 @@ func Test_DiscoveryMessage(t *testing.T) {
 						Name:             "blind1",
 						ConfigurationURL: "http://10.0.0.1:8094",
 						SwVersion:        "app v0.0.1",
+						ViaDevice:        "foo_bridge",
 					},
 					UniqueID:     "blind1",
 					Name:         "blind1",
 					CommandTopic: "foo/blind1/set",
+					StateTopic:   "foo/blind1/state",
 					Icon:         "mdi:blinds",
 				},
 			},
 		},
+		{
+			name: "fan",
+			dev: Device{
+				Name: "vent",
+				Type: MultiSpeedFan,
+				Def:  []string{"udin_8r-r1", "udin_8r-r2"},
+			},
+			cfg: []string{
+				"App_Name=app",
+				"Version=0.0.1",
+				"Bridge_Topic=foo",
+				"Discovery_Prefix=baz",
+				"UI_Advertise=10.0.0.1:8094",
+			},
+			want: &mqtt.Msg{
+				Topic: "baz/fan/vent/config",
+				Body: ha.Fan{
+					Availability: []ha.Availability{
+						{
+							Topic: "foo/bridge/availability",
+						},
+					},
+					Device: ha.Device{
+						Identifiers:      []string{"vent"},
+						Name:             "vent",
+						ConfigurationURL: "http://10.0.0.1:8094",
+						SwVersion:        "app v0.0.1",
+						ViaDevice:        "foo_udin_8r",
+					},
+					UniqueID:                  "vent",
+					Name:                      "vent",
+					CommandTopic:              "foo/vent/set",
+					StateTopic:                "foo/vent/state",
+					StateValueTemplate:        "{{ value_json.state }}",
+					PercentageCommandTopic:    "foo/vent/set",
+					PercentageCommandTemplate: "speed:{{ value }}",
+					PercentageStateTopic:      "foo/vent/state",
+					PercentageValueTemplate:   "{{ value_json.speed }}",
+					SpeedRangeMin:             1,
+					SpeedRangeMax:             2,
+					PresetModeCommandTopic:    "foo/vent/set",
+					PresetModeCommandTemplate: "preset:{{ value }}",
+					PresetModeStateTopic:      "foo/vent/state",
+					PresetModeValueTemplate:   "{{ value_json.preset_mode }}",
+					PresetModes:               []string{"speed1", "speed2"},
+					Icon:                      "mdi:fan",
+				},
+			},
+		},
+		{
+			name: "lock with code",
+			dev: Device{
+				Name: "door",
+				Type: ElectricLock,
+				Def:  []string{"udin_8r-r1"},
+				Code: "1234",
+				Info: Info{
+					Area:         "Hall",
+					Manufacturer: "Acme",
+					Model:        "Strike 12V",
+				},
+			},
+			cfg: []string{
+				"App_Name=app",
+				"Version=0.0.1",
+				"Bridge_Topic=foo",
+				"Discovery_Prefix=baz",
+				"UI_Advertise=10.0.0.1:8094",
+			},
+			want: &mqtt.Msg{
+				Topic: "baz/lock/door/config",
+				Body: lockConfig{
+					Lock: ha.Lock{
+						Availability: []ha.Availability{
+							{
+								Topic: "foo/bridge/availability",
+							},
+						},
+						Device: ha.Device{
+							Identifiers:      []string{"door"},
+							Name:             "door",
+							ConfigurationURL: "http://10.0.0.1:8094",
+							SwVersion:        "app v0.0.1",
+							ViaDevice:        "foo_udin_8r",
+							SuggestedArea:    "Hall",
+							Manufacturer:     "Acme",
+							Model:            "Strike 12V",
+						},
+						UniqueID:     "door",
+						Name:         "door",
+						CommandTopic: "foo/door/set",
+						StateTopic:   "foo/door/state",
+						Icon:         "mdi:door-closed-lock",
+					},
+					CodeFormat:      ".+",
+					CommandTemplate: "{{ value }}:{{ code }}",
+				},
+			},
+		},
+		{
+			name: "unsupported",
+			dev: Device{
+				Name: "bad",
+				Type: UnsupportedRelayType,
+			},
+			wantErr: true,
+		},
 	}
 	for _, tc := range tests {
 		cfg := make(MockCfg)
@@ -3,45 +3,89 @@ package devices
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/beanz/udin2mqtt-go/pkg/limit"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
 	"github.com/beanz/udin2mqtt-go/pkg/udin"
 )
 
 type Devices struct {
-	relays []string
-	types  []string
-	dev    map[string]*Device
-	mu     sync.Mutex
+	udins     map[string]*udin.UdinDevice
+	relays    []string
+	numRelays map[string]uint
+	inputs    []string
+	numInputs map[string]uint
+	dev       map[string]*Device
+	relayOn   map[string]bool
+	inputOn   map[string]bool
+	invert    map[string]bool
+	maxOn     map[string]time.Duration
+	position  map[string]string
+	names     NameChecker
+	mu        sync.Mutex
+}
+
+// NameChecker reports whether a name is used by an entity that is not
+// a device, such as a meter, but whose topics would clash with those
+// of a device with that name.
+type NameChecker interface {
+	NameInUse(name string) bool
+}
+
+// SetNameChecker sets the checker of the names of new devices.
+func (d *Devices) SetNameChecker(c NameChecker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.names = c
 }
 
 func NewDevices(udins map[string]*udin.UdinDevice) *Devices {
 	relays := []string{}
+	numRelays := make(map[string]uint, len(udins))
 	for name, dev := range udins {
+		numRelays[name] = dev.NumRelays()
 		var i uint
 		for i = 1; i <= dev.NumRelays(); i++ {
 			relays = append(relays, fmt.Sprintf("%s-r%d", name, i))
 		}
 	}
 	sort.Strings(relays)
-	return &Devices{
-		relays: relays,
-		types:  []string{"MomentaryOpenClose"},
-		dev:    make(map[string]*Device),
+	inputs := []string{}
+	numInputs := make(map[string]uint, len(udins))
+	for name, dev := range udins {
+		numInputs[name] = dev.NumInputs()
+		var i uint
+		for i = 1; i <= dev.NumInputs(); i++ {
+			inputs = append(inputs, fmt.Sprintf("%s-i%d", name, i))
+		}
 	}
-}
-
-func kindFromArg(kind string) (RelayType, error) {
-	switch kind {
-	case "0", "momentaryopenclose":
-		return MomentaryOpenClose, nil
+	sort.Strings(inputs)
+	return &Devices{
+		udins:     udins,
+		relays:    relays,
+		numRelays: numRelays,
+		inputs:    inputs,
+		numInputs: numInputs,
+		dev:       make(map[string]*Device),
+		relayOn:   make(map[string]bool),
+		inputOn:   make(map[string]bool),
+		invert:    make(map[string]bool),
+		maxOn:     make(map[string]time.Duration),
+		position:  make(map[string]string),
 	}
-	return UnsupportedRelayType, fmt.Errorf("invalid relay type: %s", kind)
 }
 
 func (d *Devices) Create(def []string, enabled bool, icon string) (*Device, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	err := d.validate(def)
+	if err != nil {
+		return nil, err
+	}
 	name := def[0]
 	t, err := kindFromArg(def[1])
 	if err != nil {
@@ -63,12 +107,76 @@ func (d *Devices) Update(n Device) {
 	d.dev[n.Name] = &n
 }
 
-func (d *Devices) EnableDisable(name string, val bool) {
+// replace stores a changed copy of a device rather than changing the
+// device in place as commands may be running on the old device. It
+// must be called with d.mu held.
+func (d *Devices) replace(name string, change func(dev *Device)) *Device {
+	dev := *d.dev[name]
+	change(&dev)
+	d.dev[dev.Name] = &dev
+	return &dev
+}
+
+func (d *Devices) SetTiming(name string, t Timing) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.dev[name].Enabled = val
+	if d.dev[name] == nil {
+		return fmt.Errorf("invalid device %s", name)
+	}
+	if t.Pulse < 0 || t.Guard < 0 {
+		return fmt.Errorf("invalid timing for device %s: %+v", name, t)
+	}
+	d.replace(name, func(dev *Device) { dev.Timing = t })
+	return nil
 }
 
+// SetLimit sets the command rate limit of a device. A zero interval
+// uses the default limit of the bridge.
+func (d *Devices) SetLimit(name string, l limit.Limit) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dev[name] == nil {
+		return fmt.Errorf("invalid device %s", name)
+	}
+	if err := l.Validate(); err != nil {
+		return fmt.Errorf("invalid rate limit for device %s: %w", name, err)
+	}
+	d.replace(name, func(dev *Device) { dev.Limit = l })
+	return nil
+}
+
+// SetInfo sets the Home Assistant device registry settings of a device.
+func (d *Devices) SetInfo(name string, info Info) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dev[name] == nil {
+		return fmt.Errorf("invalid device %s", name)
+	}
+	d.replace(name, func(dev *Device) { dev.Info = info })
+	return nil
+}
+
+// EnableDisable enables or disables a device and returns the messages
+// that announce it to, or remove it from, Home Assistant.
+func (d *Devices) EnableDisable(name string, val bool, cfg types.SimpleStringConfig) ([]*mqtt.Msg, error) {
+	d.mu.Lock()
+	found := d.dev[name] != nil
+	if found {
+		d.replace(name, func(dev *Device) { dev.Enabled = val })
+	}
+	d.mu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("invalid device %s", name)
+	}
+	if val {
+		return d.AnnounceMessages(name, cfg)
+	}
+	return d.RemovalMessages(name, cfg)
+}
+
+// Device returns the named device. The device must not be changed as
+// the setters replace a device rather than change it so that it can be
+// used without holding the lock.
 func (d *Devices) Device(name string) *Device {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -76,6 +184,8 @@ func (d *Devices) Device(name string) *Device {
 }
 
 func (d *Devices) Devices() []*Device {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	res := []*Device{}
 	for _, dev := range d.dev {
 		res = append(res, dev)
@@ -89,20 +199,361 @@ func (d *Devices) Relays() []string {
 	return d.relays
 }
 
-func (d *Devices) Types() []string {
+// Inputs returns the names of the inputs of the UDIN devices.
+func (d *Devices) Inputs() []string {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return d.types
+	return d.inputs
 }
 
-func (d *Devices) ActionForDevice(name, cmd string) (*Action, error) {
+// Types returns the registered device types for the UI.
+func (d *Devices) Types() []DeviceType {
+	return DeviceTypes()
+}
+
+func (d *Devices) ActionForDevice(name, cmd string) ([]*Action, error) {
 	dev := d.Device(name)
 	if dev == nil {
 		return nil, fmt.Errorf("invalid device %s", name)
 	}
-	act, err := dev.Command(cmd)
+	if !dev.Enabled {
+		return nil, fmt.Errorf("device %s is disabled", name)
+	}
+	if strings.EqualFold(cmd, ToggleCommand) {
+		var err error
+		cmd, err = d.toggleCommand(dev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dev.Type == DeviceGroup {
+		return d.groupActions(dev, cmd)
+	}
+	acts, err := dev.Command(cmd)
 	if err != nil {
 		return nil, fmt.Errorf("invalid action on device %s: %w", name, err)
 	}
-	return act, nil
+	for _, act := range acts {
+		act.Device = name
+	}
+	d.guardReversal(dev, cmd, acts)
+	return acts, nil
+}
+
+// guardReversal delays a cover command that reverses the last
+// direction of the cover by its guard time so that the motor can stop
+// before it is driven the other way.
+func (d *Devices) guardReversal(dev *Device, cmd string, acts []*Action) {
+	if dev.Type != MomentaryOpenClose || dev.Timing.Guard == 0 ||
+		len(acts) == 0 {
+		return
+	}
+	pos := d.Position(dev.Name)
+	switch strings.ToLower(cmd) {
+	case "open":
+		if pos != CoverClosed {
+			return
+		}
+	case "close":
+		if pos != CoverOpen {
+			return
+		}
+	default:
+		return
+	}
+	acts[0].Delay += dev.Timing.Guard
+}
+
+// groupActions returns the actions for cmd on every enabled member of
+// group with the first action of each member after the first delayed
+// by the stagger time of the group.
+func (d *Devices) groupActions(group *Device, cmd string) ([]*Action, error) {
+	members, stagger, err := d.groupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+	res := []*Action{}
+	for _, dev := range members {
+		if !dev.Enabled {
+			continue
+		}
+		acts, err := dev.Command(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action on device %s in group %s: %w",
+				dev.Name, group.Name, err)
+		}
+		for _, act := range acts {
+			act.Device = dev.Name
+		}
+		d.guardReversal(dev, cmd, acts)
+		if len(res) > 0 && len(acts) > 0 {
+			acts[0].Delay += stagger
+		}
+		res = append(res, acts...)
+	}
+	return res, nil
+}
+
+func (d *Devices) groupMembers(group *Device) ([]*Device, time.Duration, error) {
+	names, stagger, err := group.groupDef()
+	if err != nil {
+		return nil, 0, err
+	}
+	members := make([]*Device, 0, len(names))
+	for _, name := range names {
+		dev := d.Device(name)
+		if dev == nil {
+			return nil, 0, fmt.Errorf("invalid device %s in group %s",
+				name, group.Name)
+		}
+		if dev.Type == DeviceGroup {
+			return nil, 0, fmt.Errorf("nested group %s in group %s",
+				name, group.Name)
+		}
+		if len(members) > 0 && dev.Type != members[0].Type {
+			return nil, 0, fmt.Errorf(
+				"device %s in group %s is not of type %s",
+				name, group.Name, members[0].Type)
+		}
+		members = append(members, dev)
+	}
+	return members, stagger, nil
+}
+
+// groupTemplate returns a copy of the first member of a group renamed
+// to match the group so that it can be used to generate discovery
+// messages for the group.
+func (d *Devices) groupTemplate(group *Device) (*Device, error) {
+	members, _, err := d.groupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := *members[0]
+	tmpl.Name = group.Name
+	tmpl.Icon = group.Icon
+	tmpl.Enabled = group.Enabled
+	tmpl.Info = group.Info
+	tmpl.group = true
+	return &tmpl, nil
+}
+
+func (d *Devices) DiscoveryMessage(name string, cfg types.SimpleStringConfig) (*mqtt.Msg, error) {
+	dev := d.Device(name)
+	if dev == nil {
+		return nil, fmt.Errorf("invalid device %s", name)
+	}
+	if dev.Type == DeviceGroup {
+		tmpl, err := d.groupTemplate(dev)
+		if err != nil {
+			return nil, err
+		}
+		dev = tmpl
+	}
+	return dev.DiscoveryMessage(cfg)
+}
+
+// SetRelay records the state of a relay. Switching on the open or
+// close relay of a cover records the position it is moving to.
+func (d *Devices) SetRelay(relay string, on bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.relayOn[relay] = on
+	if !on {
+		return
+	}
+	for name, dev := range d.dev {
+		if dev.Type != MomentaryOpenClose || len(dev.Def) < 2 {
+			continue
+		}
+		switch relay {
+		case dev.Def[0]:
+			d.position[name] = CoverOpen
+		case dev.Def[1]:
+			d.position[name] = CoverClosed
+		}
+	}
+}
+
+func (d *Devices) RelayOn(relay string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.relayOn[relay]
+}
+
+// SetInput records the state of an input and returns the devices that
+// use the input if its state changed.
+func (d *Devices) SetInput(input string, on bool) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.inputOn[input]; ok && old == on {
+		return nil
+	}
+	d.inputOn[input] = on
+	return d.inputDevices(input)
+}
+
+// InputOn reports whether an input was last seen active.
+func (d *Devices) InputOn(input string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inputOn[input]
+}
+
+// Watches reports whether an input is used by a device so that the
+// automation engine reports every change of the input.
+func (d *Devices) Watches(input string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.inputDevices(input)) > 0
+}
+
+func (d *Devices) inputDevices(input string) []string {
+	res := []string{}
+	for name, dev := range d.dev {
+		if dev.Type == DeviceGroup {
+			continue
+		}
+		for _, v := range dev.Def {
+			if v == input {
+				res = append(res, name)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Position returns the last known position of a cover or "" if it
+// is not known.
+func (d *Devices) Position(name string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.position[name]
+}
+
+// RestoreState sets the position of a cover from a previously
+// published state, such as the retained message on its state topic,
+// if the position is not already known. A cover that was moving is
+// assumed to have finished moving. It returns true if the position
+// was restored.
+func (d *Devices) RestoreState(name, state string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev := d.dev[name]
+	if dev == nil || dev.Type != MomentaryOpenClose ||
+		d.position[name] != "" {
+		return false
+	}
+	switch state {
+	case CoverOpen, CoverOpening:
+		d.position[name] = CoverOpen
+	case CoverClosed, CoverClosing:
+		d.position[name] = CoverClosed
+	default:
+		return false
+	}
+	return true
+}
+
+func (d *Devices) StateMessage(name string, cfg types.SimpleStringConfig) (*mqtt.Msg, error) {
+	dev := d.Device(name)
+	if dev == nil {
+		return nil, fmt.Errorf("invalid device %s", name)
+	}
+	st, err := d.state(dev)
+	if err != nil {
+		return nil, err
+	}
+	if st == nil {
+		return nil, nil
+	}
+	return &mqtt.Msg{Topic: dev.StateTopic(cfg), Body: st, Retain: true}, nil
+}
+
+// state returns the state of a device, or the aggregate state of the
+// members of a group, or nil if the state is not known.
+func (d *Devices) state(dev *Device) (interface{}, error) {
+	if dev.Type != DeviceGroup {
+		return dev.State(d), nil
+	}
+	members, _, err := d.groupMembers(dev)
+	if err != nil {
+		return nil, err
+	}
+	states := []interface{}{}
+	for _, m := range members {
+		if mst := m.State(d); mst != nil {
+			states = append(states, mst)
+		}
+	}
+	return aggregateState(members[0].Type, states), nil
+}
+
+// toggleCommand returns the command that reverses the current state of
+// a device or group.
+func (d *Devices) toggleCommand(dev *Device) (string, error) {
+	// a group is toggled on its aggregate state if every member can be
+	targets := []*Device{dev}
+	if dev.Type == DeviceGroup {
+		members, _, err := d.groupMembers(dev)
+		if err != nil {
+			return "", err
+		}
+		targets = members
+	}
+	kind := targets[0].Type
+	t, ok := kind.deviceType().(Toggler)
+	if !ok {
+		return "", fmt.Errorf("device %s of type %s can not be toggled",
+			dev.Name, kind)
+	}
+	st, err := d.state(dev)
+	if err != nil {
+		return "", err
+	}
+	var cmd string
+	for _, target := range targets {
+		cmd, err = t.Toggle(target, st)
+		if err != nil {
+			return "", err
+		}
+	}
+	return cmd, nil
+}
+
+// StateMessages returns the state messages for a device and for any
+// groups that contain it.
+func (d *Devices) StateMessages(name string, cfg types.SimpleStringConfig) ([]*mqtt.Msg, error) {
+	names := []string{name}
+	for _, dev := range d.Devices() {
+		if dev.Type != DeviceGroup {
+			continue
+		}
+		members, _, err := dev.groupDef()
+		if err != nil {
+			continue
+		}
+		for _, m := range members {
+			if m == name {
+				names = append(names, dev.Name)
+				break
+			}
+		}
+	}
+	res := []*mqtt.Msg{}
+	for i, n := range names {
+		msg, err := d.StateMessage(n, cfg)
+		if err != nil {
+			if i > 0 {
+				// a broken group should not hide the member state
+				continue
+			}
+			return nil, err
+		}
+		if msg != nil {
+			res = append(res, msg)
+		}
+	}
+	return res, nil
 }
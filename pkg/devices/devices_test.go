@@ -2,7 +2,10 @@ package devices
 
 import (
 	"testing"
+	"time"
 
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
 	"github.com/beanz/udin2mqtt-go/pkg/udin"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,7 +34,18 @@ func Test_Devices(t *testing.T) {
 		"udin_8r-r7",
 		"udin_8r-r8",
 	}, devs.Relays())
-	assert.Equal(t, []string{"MomentaryOpenClose"}, devs.Types())
+	names := []string{}
+	for _, dt := range devs.Types() {
+		names = append(names, dt.Name())
+	}
+	assert.Equal(t,
+		[]string{
+			"momentaryopenclose",
+			"multispeedfan",
+			"electriclock",
+			"devicegroup",
+		},
+		names[:4])
 }
 
 func Test_Create(t *testing.T) {
@@ -52,16 +66,22 @@ func Test_Create(t *testing.T) {
 	assert.Equal(t, "momentaryopenclose", dev.Type.String())
 
 	assert.False(t, dev.Enabled)
-	devs.EnableDisable("foobar", true)
-	assert.True(t, dev.Enabled)
+	_, err = devs.ActionForDevice("foobar", "open")
+	assert.Error(t, err, "disabled device should reject commands")
+	_, err = devs.EnableDisable("foobar", true, MockCfg{})
+	assert.NoError(t, err)
+	assert.False(t, dev.Enabled, "devices are replaced not changed")
+	assert.True(t, devs.Device("foobar").Enabled)
 
-	act, err := devs.ActionForDevice("foobar", "OPEN")
+	acts, err := devs.ActionForDevice("foobar", "OPEN")
 	assert.NoError(t, err)
-	assert.Equal(t, "udin_8r[1].pulse", act.String())
+	assert.Equal(t, 1, len(acts))
+	assert.Equal(t, "udin_8r[1].pulse", acts[0].String())
 
-	act, err = devs.ActionForDevice("foobar", "close")
+	acts, err = devs.ActionForDevice("foobar", "close")
 	assert.NoError(t, err)
-	assert.Equal(t, "udin_8r[2].pulse", act.String())
+	assert.Equal(t, 1, len(acts))
+	assert.Equal(t, "udin_8r[2].pulse", acts[0].String())
 
 	_, err = devs.ActionForDevice("quux", "open")
 	assert.Error(t, err)
@@ -70,6 +90,357 @@ func Test_Create(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func Test_Fan(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+	}
+	devs := NewDevices(udins)
+	dev, err := devs.Create([]string{"vent", "multispeedfan",
+		"udin_8r-r3", "udin_8r-r4", "udin_8r-r5"}, true, "")
+	assert.NoError(t, err)
+	assert.Equal(t, MultiSpeedFan, dev.Type)
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"ON", []string{"udin_8r[4].off", "udin_8r[5].off", "udin_8r[3].on"}},
+		{"speed:2",
+			[]string{"udin_8r[3].off", "udin_8r[5].off", "udin_8r[4].on"}},
+		{"preset:speed3",
+			[]string{"udin_8r[3].off", "udin_8r[4].off", "udin_8r[5].on"}},
+		{"speed:0",
+			[]string{"udin_8r[3].off", "udin_8r[4].off", "udin_8r[5].off"}},
+		{"off",
+			[]string{"udin_8r[3].off", "udin_8r[4].off", "udin_8r[5].off"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.cmd, func(t *testing.T) {
+			acts, err := devs.ActionForDevice("vent", tc.cmd)
+			assert.NoError(t, err)
+			got := []string{}
+			for _, act := range acts {
+				got = append(got, act.String())
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	for _, cmd := range []string{"speed:4", "speed:x", "preset:turbo", "up"} {
+		_, err = devs.ActionForDevice("vent", cmd)
+		assert.Error(t, err, cmd)
+	}
+
+	cfg := MockCfg{"Bridge_Topic": "udin"}
+	msg, err := devs.StateMessage("vent", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "udin/vent/state", msg.Topic)
+	assert.True(t, msg.Retain)
+	assert.Equal(t,
+		FanState{State: "OFF", Speed: 0, PresetMode: "None"}, msg.Body)
+
+	devs.SetRelay("udin_8r-r4", true)
+	msg, err = devs.StateMessage("vent", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		FanState{State: "ON", Speed: 2, PresetMode: "speed2"}, msg.Body)
+
+	_, err = devs.StateMessage("quux", cfg)
+	assert.Error(t, err)
+}
+
+func Test_Lock(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+	}
+	devs := NewDevices(udins)
+	dev, err := devs.Create(
+		[]string{"door", "2", "udin_8r-r6", "3s"}, true, "")
+	assert.NoError(t, err)
+	assert.Equal(t, ElectricLock, dev.Type)
+
+	acts, err := devs.ActionForDevice("door", "UNLOCK")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "door", Udin: "udin_8r", Relay: 6, Action: "pulse",
+			Duration: 3 * time.Second},
+	}, acts)
+
+	acts, err = devs.ActionForDevice("door", "LOCK")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "door", Udin: "udin_8r", Relay: 6, Action: "off"},
+	}, acts)
+
+	_, err = devs.ActionForDevice("door", "jiggle")
+	assert.Error(t, err)
+
+	dev.Code = "1234"
+	_, err = devs.ActionForDevice("door", "UNLOCK")
+	assert.Error(t, err)
+	_, err = devs.ActionForDevice("door", "UNLOCK:4321")
+	assert.Error(t, err)
+	acts, err = devs.ActionForDevice("door", "UNLOCK:1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "udin_8r[6].pulse", acts[0].String())
+
+	cfg := MockCfg{"Bridge_Topic": "udin"}
+	msg, err := devs.StateMessage("door", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "LOCKED", msg.Body)
+	devs.SetRelay("udin_8r-r6", true)
+	msg, err = devs.StateMessage("door", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "UNLOCKED", msg.Body)
+
+	dev, err = devs.Create([]string{"gate", "electriclock", "udin_8r-r7"},
+		true, "")
+	assert.NoError(t, err)
+	acts, err = devs.ActionForDevice("gate", "open")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultUnlockTime, acts[0].Duration)
+
+	dev.Def = []string{"udin_8r-r7", "soon"}
+	_, err = devs.ActionForDevice("gate", "open")
+	assert.Error(t, err)
+}
+
+func Test_Group(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+	}
+	devs := NewDevices(udins)
+	_, err = devs.Create(
+		[]string{"blind1", "0", "udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"blind2", "0", "udin_8r-r3", "udin_8r-r4"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"all", "group", "blind1", "blind2", "stagger=2s"}, true, "")
+	assert.NoError(t, err)
+
+	acts, err := devs.ActionForDevice("all", "open")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "blind1", Udin: "udin_8r", Relay: 1, Action: "pulse",
+			Duration: time.Second},
+		{Device: "blind2", Udin: "udin_8r", Relay: 3, Action: "pulse",
+			Duration: time.Second, Delay: 2 * time.Second},
+	}, acts)
+
+	_, err = devs.ActionForDevice("all", "sideways")
+	assert.Error(t, err)
+
+	cfg := MockCfg{
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+	}
+	msg, err := devs.DiscoveryMessage("all", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "homeassistant/cover/all/config", msg.Topic)
+	assert.Equal(t, "udin/all/set", msg.Body.(ha.Cover).CommandTopic)
+	assert.Equal(t, "mdi:blinds", msg.Body.(ha.Cover).Icon)
+
+	msg, err = devs.StateMessage("all", cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+
+	// definitions that fail validation can still be loaded directly
+	// so check they are also rejected when used
+	devs.Update(Device{Name: "bad", Type: DeviceGroup,
+		Def: []string{"blind1", "nope"}})
+	_, err = devs.ActionForDevice("bad", "open")
+	assert.Error(t, err)
+	_, err = devs.DiscoveryMessage("bad", cfg)
+	assert.Error(t, err)
+
+	devs.Update(Device{Name: "nested", Type: DeviceGroup,
+		Def: []string{"all"}})
+	_, err = devs.ActionForDevice("nested", "open")
+	assert.Error(t, err)
+
+	devs.Update(Device{Name: "slow", Type: DeviceGroup,
+		Def: []string{"blind1", "stagger=x"}})
+	_, err = devs.ActionForDevice("slow", "open")
+	assert.Error(t, err)
+
+	devs.Update(Device{Name: "empty", Type: DeviceGroup})
+	_, err = devs.ActionForDevice("empty", "open")
+	assert.Error(t, err)
+}
+
+func Test_GroupState(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+	}
+	devs := NewDevices(udins)
+	_, err = devs.Create(
+		[]string{"fan1", "1", "udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"fan2", "1", "udin_8r-r3", "udin_8r-r4"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"fans", "3", "fan1", "fan2"}, true, "mdi:fan-chevron-up")
+	assert.NoError(t, err)
+	_, err = devs.Create([]string{"door", "2", "udin_8r-r5"}, true, "")
+	assert.NoError(t, err)
+	devs.Update(Device{Name: "mixed", Type: DeviceGroup,
+		Def: []string{"fan1", "door"}})
+
+	cfg := MockCfg{"Bridge_Topic": "udin"}
+	msg, err := devs.StateMessage("fans", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "udin/fans/state", msg.Topic)
+	assert.Equal(t,
+		FanState{State: "OFF", Speed: 0, PresetMode: "None"}, msg.Body)
+
+	devs.SetRelay("udin_8r-r4", true)
+	msgs, err := devs.StateMessages("fan2", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "udin/fan2/state", msgs[0].Topic)
+	assert.Equal(t, "udin/fans/state", msgs[1].Topic)
+	assert.Equal(t,
+		FanState{State: "ON", Speed: 2, PresetMode: "speed2"}, msgs[1].Body)
+
+	msg, err = devs.DiscoveryMessage("fans", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "mdi:fan-chevron-up", msg.Body.(ha.Fan).Icon)
+
+	_, err = devs.StateMessage("mixed", cfg)
+	assert.Error(t, err)
+	msgs, err = devs.StateMessages("door", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(msgs))
+}
+
+func Test_EnableDisable(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+	}
+	devs := NewDevices(udins)
+	_, err = devs.Create(
+		[]string{"blind1", "0", "udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"blind2", "0", "udin_8r-r3", "udin_8r-r4"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create([]string{"door", "2", "udin_8r-r5"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"blinds", "group", "blind1", "blind2"}, true, "")
+	assert.NoError(t, err)
+	cfg := MockCfg{
+		"App_Name":         "app",
+		"Version":          "0.0.1",
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+		"UI_Advertise":     "10.0.0.1:8094",
+	}
+
+	msgs, err := devs.EnableDisable("door", false, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "homeassistant/lock/door/config", Body: "", Retain: true},
+		{Topic: "udin/door/state", Body: "", Retain: true},
+	}, msgs)
+	_, err = devs.ActionForDevice("door", "unlock")
+	assert.Error(t, err)
+
+	msgs, err = devs.EnableDisable("door", true, cfg)
+	assert.NoError(t, err)
+	disc, err := devs.Device("door").DiscoveryMessage(cfg)
+	assert.NoError(t, err)
+	disc.Retain = true
+	assert.Equal(t, []*mqtt.Msg{
+		disc,
+		{Topic: "udin/door/state", Body: "LOCKED", Retain: true},
+	}, msgs)
+	_, err = devs.ActionForDevice("door", "unlock")
+	assert.NoError(t, err)
+
+	msgs, err = devs.EnableDisable("blinds", false, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "homeassistant/cover/blinds/config", Body: "", Retain: true},
+		{Topic: "udin/blinds/state", Body: "", Retain: true},
+	}, msgs)
+	_, err = devs.ActionForDevice("blinds", "open")
+	assert.Error(t, err)
+
+	_, err = devs.EnableDisable("blinds", true, cfg)
+	assert.NoError(t, err)
+	_, err = devs.EnableDisable("blind1", false, cfg)
+	assert.NoError(t, err)
+	acts, err := devs.ActionForDevice("blinds", "open")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(acts), "disabled members are skipped")
+	assert.Equal(t, "blind2", acts[0].Device)
+
+	_, err = devs.EnableDisable("nope", true, cfg)
+	assert.Error(t, err)
+}
+
+func Test_Timing(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+	}
+	devs := NewDevices(udins)
+	_, err = devs.Create(
+		[]string{"blind", "0", "udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create(
+		[]string{"vent", "1", "udin_8r-r3", "udin_8r-r4"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create([]string{"gate", "2", "udin_8r-r5"}, true, "")
+	assert.NoError(t, err)
+
+	acts, err := devs.ActionForDevice("blind", "open")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultPulseTime, acts[0].Duration)
+
+	err = devs.SetTiming("blind", Timing{Pulse: 300 * time.Millisecond})
+	assert.NoError(t, err)
+	acts, err = devs.ActionForDevice("blind", "close")
+	assert.NoError(t, err)
+	assert.Equal(t, 300*time.Millisecond, acts[0].Duration)
+
+	err = devs.SetTiming("vent", Timing{Guard: 500 * time.Millisecond})
+	assert.NoError(t, err)
+	acts, err = devs.ActionForDevice("vent", "speed:2")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "vent", Udin: "udin_8r", Relay: 3, Action: "off"},
+		{Device: "vent", Udin: "udin_8r", Relay: 4, Action: "on",
+			Delay: 500 * time.Millisecond},
+	}, acts)
+
+	err = devs.SetTiming("gate", Timing{Pulse: 2 * time.Second})
+	assert.NoError(t, err)
+	acts, err = devs.ActionForDevice("gate", "unlock")
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, acts[0].Duration)
+
+	err = devs.SetTiming("quux", Timing{})
+	assert.Error(t, err)
+	err = devs.SetTiming("blind", Timing{Pulse: -time.Second})
+	assert.Error(t, err)
+}
+
 func Test_CreateError(t *testing.T) {
 	u8r, err := udin.NewUdin("mock", nil)
 	assert.NoError(t, err)
@@ -83,3 +454,177 @@ func Test_CreateError(t *testing.T) {
 
 	assert.Equal(t, "unsupportedrelaytype", UnsupportedRelayType.String())
 }
+
+func Test_CoverState(t *testing.T) {
+	devs := testDevices(t)
+	cfg := MockCfg{"Bridge_Topic": "udin"}
+
+	// no state is published until the position is known
+	msg, err := devs.StateMessage("blind1", cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+	msg, err = devs.StateMessage("blinds", cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+
+	devs.SetRelay("udin_8r-r1", true)
+	msgs, err := devs.StateMessages("blind1", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "udin/blind1/state", msgs[0].Topic)
+	assert.True(t, msgs[0].Retain)
+	assert.Equal(t, CoverOpening, msgs[0].Body)
+	assert.Equal(t, "udin/blinds/state", msgs[1].Topic)
+	assert.Equal(t, CoverOpening, msgs[1].Body)
+
+	devs.SetRelay("udin_8r-r1", false)
+	msg, err = devs.StateMessage("blind1", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, CoverOpen, msg.Body)
+	msg, err = devs.StateMessage("blinds", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, CoverOpen, msg.Body)
+
+	devs.SetRelay("udin_8r-r2", true)
+	msg, err = devs.StateMessage("blind1", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, CoverClosing, msg.Body)
+	devs.SetRelay("udin_8r-r2", false)
+	msg, err = devs.StateMessage("blind1", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, CoverClosed, msg.Body)
+
+	// restoring only applies to covers whose position is unknown
+	assert.False(t, devs.RestoreState("blind1", CoverOpen))
+	assert.False(t, devs.RestoreState("vent", CoverOpen))
+	assert.False(t, devs.RestoreState("nope", CoverOpen))
+	assert.False(t, devs.RestoreState("blind2", "bogus"))
+	assert.True(t, devs.RestoreState("blind2", CoverOpening))
+	assert.Equal(t, CoverOpen, devs.Position("blind2"))
+	msg, err = devs.StateMessage("blinds", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, CoverOpen, msg.Body)
+
+	// the position follows renames and is dropped on delete
+	_, err = devs.Rename("blind1", "blind3")
+	assert.NoError(t, err)
+	assert.Equal(t, CoverClosed, devs.Position("blind3"))
+	assert.NoError(t, devs.Delete("blinds"))
+	assert.NoError(t, devs.Delete("blind3"))
+	assert.Equal(t, "", devs.Position("blind3"))
+}
+
+func Test_Toggle(t *testing.T) {
+	devs := testDevices(t)
+	_, err := devs.Create([]string{"door", "2", "udin_8r-r7"}, true, "")
+	assert.NoError(t, err)
+
+	// a cover of unknown position is opened
+	acts, err := devs.ActionForDevice("blind1", "TOGGLE")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), acts[0].Relay)
+	devs.SetRelay("udin_8r-r1", true)
+	acts, err = devs.ActionForDevice("blind1", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2), acts[0].Relay)
+
+	// a group toggles on its aggregate state
+	acts, err = devs.ActionForDevice("blinds", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(acts))
+	assert.Equal(t, uint(2), acts[0].Relay)
+	assert.Equal(t, uint(4), acts[1].Relay)
+
+	acts, err = devs.ActionForDevice("vent", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, "on", acts[len(acts)-1].Action)
+	devs.SetRelay("udin_8r-r5", true)
+	acts, err = devs.ActionForDevice("vent", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(acts))
+	assert.Equal(t, "off", acts[0].Action)
+
+	acts, err = devs.ActionForDevice("door", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, "pulse", acts[0].Action)
+
+	// a lock with a code can be locked but not unlocked by toggle
+	_, err = devs.Create([]string{"gate", "2", "udin_8r-r8"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create([]string{"locks", "group", "door", "gate"}, true, "")
+	assert.NoError(t, err)
+	devs.Device("gate").Code = "1234"
+	_, err = devs.ActionForDevice("gate", "toggle")
+	assert.EqualError(t, err,
+		"lock gate has a code and can not be unlocked by toggle")
+	_, err = devs.ActionForDevice("locks", "toggle")
+	assert.EqualError(t, err,
+		"lock gate has a code and can not be unlocked by toggle")
+	devs.SetRelay("udin_8r-r8", true)
+	acts, err = devs.ActionForDevice("gate", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, "off", acts[0].Action)
+	acts, err = devs.ActionForDevice("locks", "toggle")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(acts))
+
+	devs.Update(Device{Name: "bad", Type: DeviceGroup, Enabled: true,
+		Def: []string{"nope"}})
+	_, err = devs.ActionForDevice("bad", "toggle")
+	assert.Error(t, err)
+}
+
+func Test_CoverGuard(t *testing.T) {
+	devs := testDevices(t)
+	assert.NoError(t, devs.SetTiming("blind1",
+		Timing{Guard: 500 * time.Millisecond}))
+
+	// the guard only applies when the direction is reversed
+	acts, err := devs.ActionForDevice("blind1", "close")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), acts[0].Delay)
+	devs.SetRelay("udin_8r-r1", true)
+	devs.SetRelay("udin_8r-r1", false)
+	acts, err = devs.ActionForDevice("blind1", "open")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), acts[0].Delay)
+	acts, err = devs.ActionForDevice("blind1", "close")
+	assert.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, acts[0].Delay)
+
+	// group members are guarded too
+	acts, err = devs.ActionForDevice("blinds", "close")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(acts))
+	assert.Equal(t, 500*time.Millisecond, acts[0].Delay)
+	assert.Equal(t, time.Duration(0), acts[1].Delay)
+}
+
+// Test_ConcurrentChanges is meant to be run with -race as commands run
+// on devices outside the main loop that changes them.
+func Test_ConcurrentChanges(t *testing.T) {
+	devs := testDevices(t)
+	blind, group := devs.Device("blind2"), devs.Device("blinds")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		acts, err := blind.Command("open")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, acts)
+		devs.guardReversal(blind, "open", acts)
+		assert.Equal(t, []string{"blind1", "blind2"}, group.Def)
+		assert.True(t, blind.Enabled)
+		_, err = devs.ActionForDevice("vent", "toggle")
+		assert.NoError(t, err)
+	}()
+	assert.NoError(t, devs.SetTiming("blind2", Timing{Guard: time.Second}))
+	_, err := devs.Rename("blind2", "blind3")
+	assert.NoError(t, err)
+	_, err = devs.EnableDisable("blind3", false, MockCfg{})
+	assert.NoError(t, err)
+	_, err = devs.Edit([]string{"vent", "1", "udin_8r-r6", "udin_8r-r5"})
+	assert.NoError(t, err)
+	<-done
+	assert.Equal(t, "blind2", blind.Name, "the old device is unchanged")
+	assert.Equal(t, []string{"blind1", "blind3"}, devs.Device("blinds").Def)
+}
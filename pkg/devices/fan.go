@@ -0,0 +1,164 @@
+package devices
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+)
+
+type FanState struct {
+	State      string `json:"state"`
+	Speed      int    `json:"speed"`
+	PresetMode string `json:"preset_mode"`
+}
+
+// fanType is a fan with one relay per speed.
+type fanType struct{}
+
+func (fanType) Name() string      { return "multispeedfan" }
+func (fanType) Aliases() []string { return nil }
+func (fanType) Component() string { return "fan" }
+
+func (fanType) Relays(d *Device) []string {
+	return d.Def
+}
+
+func (fanType) Validate(d *Device, v *Validation) {
+	if len(d.Def) < 1 {
+		v.Add("def", "", "expected at least one relay")
+	}
+}
+
+func (fanType) Command(d *Device, cmd string) ([]*Action, error) {
+	speed, err := d.fanSpeed(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return d.fanActions(speed)
+}
+
+func (fanType) Discovery(d *Device, e *Entity) (interface{}, error) {
+	return ha.Fan{
+		CommandTopic:              e.CommandTopic,
+		StateTopic:                e.StateTopic,
+		StateValueTemplate:        "{{ value_json.state }}",
+		PercentageCommandTopic:    e.CommandTopic,
+		PercentageCommandTemplate: "speed:{{ value }}",
+		PercentageStateTopic:      e.StateTopic,
+		PercentageValueTemplate:   "{{ value_json.speed }}",
+		SpeedRangeMin:             1,
+		SpeedRangeMax:             len(d.Def),
+		PresetModeCommandTopic:    e.CommandTopic,
+		PresetModeCommandTemplate: "preset:{{ value }}",
+		PresetModeStateTopic:      e.StateTopic,
+		PresetModeValueTemplate:   "{{ value_json.preset_mode }}",
+		PresetModes:               d.presetModes(),
+		Device:                    e.Device,
+		Availability:              e.Availability,
+		UniqueID:                  e.UniqueID,
+		Name:                      e.Name,
+		Icon:                      e.icon("mdi:fan"),
+	}, nil
+}
+
+func (fanType) State(d *Device, src StateSource) interface{} {
+	st := FanState{State: "OFF", PresetMode: "None"}
+	for i, relay := range d.Def {
+		if src.RelayOn(relay) {
+			st.State = "ON"
+			st.Speed = i + 1
+			st.PresetMode = d.presetModes()[i]
+			break
+		}
+	}
+	return st
+}
+
+func (fanType) Toggle(d *Device, state interface{}) (string, error) {
+	if st, ok := state.(FanState); ok && st.State == "ON" {
+		return "off", nil
+	}
+	return "on", nil
+}
+
+// AggregateState reports the fastest member.
+func (fanType) AggregateState(states []interface{}) interface{} {
+	var agg FanState
+	for _, st := range states {
+		fs := st.(FanState)
+		if agg.State == "" || fs.Speed > agg.Speed {
+			agg = fs
+		}
+	}
+	return agg
+}
+
+func (fanType) Form() Form {
+	return Form{
+		Label: "Multi-speed fan",
+		Fields: []FormField{
+			{Name: "speeds", Label: "Speed relays", Kind: RelayListField},
+		},
+	}
+}
+
+// fanSpeed maps a fan command to a speed where 0 is off and 1..N
+// select the relay at that position in the definition.
+func (d *Device) fanSpeed(cmd string) (int, error) {
+	lc := strings.ToLower(cmd)
+	switch {
+	case lc == "off":
+		return 0, nil
+	case lc == "on":
+		return 1, nil
+	case strings.HasPrefix(lc, "speed:"):
+		speed, err := strconv.Atoi(lc[6:])
+		if err != nil || speed < 0 || speed > len(d.Def) {
+			return 0, fmt.Errorf("invalid speed on %s: %s", d.Name, cmd)
+		}
+		return speed, nil
+	case strings.HasPrefix(lc, "preset:"):
+		for i, mode := range d.presetModes() {
+			if mode == lc[7:] {
+				return i + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid preset mode on %s: %s", d.Name, cmd)
+	}
+	return 0, fmt.Errorf("invalid command on %s: %s", d.Name, cmd)
+}
+
+// fanActions switches off every speed relay before switching on the
+// selected one so that two speeds are never energised together.
+func (d *Device) fanActions(speed int) ([]*Action, error) {
+	acts := make([]*Action, 0, len(d.Def)+1)
+	for i, relay := range d.Def {
+		if i+1 == speed {
+			continue
+		}
+		act, err := relayAction(relay, "off")
+		if err != nil {
+			return nil, err
+		}
+		acts = append(acts, act)
+	}
+	if speed > 0 {
+		act, err := relayAction(d.Def[speed-1], "on")
+		if err != nil {
+			return nil, err
+		}
+		act.Delay = d.Timing.Guard
+		acts = append(acts, act)
+	}
+	return acts, nil
+}
+
+func (d *Device) presetModes() []string {
+	modes := make([]string, len(d.Def))
+	for i := range d.Def {
+		modes[i] = fmt.Sprintf("speed%d", i+1)
+	}
+	return modes
+}
@@ -0,0 +1,102 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// groupType is a group of devices of the same type. Commands, state
+// and discovery of groups are handled by Devices using the members.
+type groupType struct{}
+
+func (groupType) Name() string      { return "devicegroup" }
+func (groupType) Aliases() []string { return []string{"group"} }
+
+// Component is empty as groups take the component of their members.
+func (groupType) Component() string { return "" }
+
+func (groupType) Relays(d *Device) []string {
+	return nil
+}
+
+func (groupType) Validate(group *Device, v *Validation) {
+	kind := UnsupportedRelayType
+	members := 0
+	for i, m := range group.Def {
+		field := fmt.Sprintf("def[%d]", i)
+		if strings.HasPrefix(m, "stagger=") {
+			s, err := time.ParseDuration(m[8:])
+			if err != nil || s < 0 {
+				v.Add(field, m, "invalid stagger duration")
+			}
+			continue
+		}
+		members++
+		dev := v.Device(m)
+		switch {
+		case dev == nil:
+			v.Add(field, m, "unknown device")
+		case dev.Type == DeviceGroup:
+			v.Add(field, m, "groups may not contain groups")
+		case kind != UnsupportedRelayType && dev.Type != kind:
+			v.Add(field, m, "group members must all be of type "+kind.String())
+		default:
+			kind = dev.Type
+		}
+	}
+	if members == 0 {
+		v.Add("def", "", "expected at least one member device")
+	}
+}
+
+func (groupType) Command(d *Device, cmd string) ([]*Action, error) {
+	return nil, fmt.Errorf("group %s has no relays of its own", d.Name)
+}
+
+func (groupType) Discovery(d *Device, e *Entity) (interface{}, error) {
+	return nil, nil
+}
+
+func (groupType) State(d *Device, src StateSource) interface{} {
+	return nil
+}
+
+func (groupType) AggregateState(states []interface{}) interface{} {
+	return nil
+}
+
+func (groupType) Form() Form {
+	return Form{
+		Label: "Device group",
+		Fields: []FormField{
+			{Name: "members", Label: "Members", Kind: DeviceListField},
+			{Name: "stagger", Label: "Stagger", Kind: DurationField,
+				Optional: true, Prefix: "stagger="},
+		},
+	}
+}
+
+// groupDef returns the member device names of a DeviceGroup and the
+// delay between dispatching to each member from a "stagger=<duration>"
+// entry in the definition.
+func (d *Device) groupDef() ([]string, time.Duration, error) {
+	members := make([]string, 0, len(d.Def))
+	var stagger time.Duration
+	for _, m := range d.Def {
+		if strings.HasPrefix(m, "stagger=") {
+			s, err := time.ParseDuration(m[8:])
+			if err != nil || s < 0 {
+				return nil, 0, fmt.Errorf("invalid stagger on %s: %s",
+					d.Name, m)
+			}
+			stagger = s
+			continue
+		}
+		members = append(members, m)
+	}
+	if len(members) == 0 {
+		return nil, 0, fmt.Errorf("group %s has no members", d.Name)
+	}
+	return members, stagger, nil
+}
@@ -0,0 +1,155 @@
+package devices
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+)
+
+// lockType is an electric strike released by pulsing a relay.
+type lockType struct{}
+
+func (lockType) Name() string      { return "electriclock" }
+func (lockType) Aliases() []string { return nil }
+func (lockType) Component() string { return "lock" }
+
+func (lockType) Relays(d *Device) []string {
+	if len(d.Def) > 1 {
+		return d.Def[:1]
+	}
+	return d.Def
+}
+
+func (lockType) Validate(d *Device, v *Validation) {
+	if len(d.Def) < 1 || len(d.Def) > 2 {
+		v.Add("def", strings.Join(d.Def, ","),
+			"expected a relay and optional unlock time")
+	} else if len(d.Def) == 2 {
+		if _, err := d.unlockTime(); err != nil {
+			v.Add("def[1]", d.Def[1], "invalid unlock time")
+		}
+	}
+}
+
+func (lockType) Command(d *Device, cmd string) ([]*Action, error) {
+	return d.lockActions(cmd)
+}
+
+// lockConfig adds the fields missing from ha.Lock that are needed to
+// pass a code through to the command topic.
+type lockConfig struct {
+	ha.Lock
+	CodeFormat      string `json:"code_format,omitempty"`
+	CommandTemplate string `json:"command_template,omitempty"`
+}
+
+func (lockType) Discovery(d *Device, e *Entity) (interface{}, error) {
+	cfg := lockConfig{
+		Lock: ha.Lock{
+			CommandTopic: e.CommandTopic,
+			StateTopic:   e.StateTopic,
+			Device:       e.Device,
+			Availability: e.Availability,
+			UniqueID:     e.UniqueID,
+			Name:         e.Name,
+			Icon:         e.icon("mdi:door-closed-lock"),
+		},
+	}
+	if d.Code != "" {
+		cfg.CodeFormat = ".+"
+		cfg.CommandTemplate = "{{ value }}:{{ code }}"
+	}
+	return cfg, nil
+}
+
+func (lockType) State(d *Device, src StateSource) interface{} {
+	if src.RelayOn(d.Def[0]) {
+		return "UNLOCKED"
+	}
+	return "LOCKED"
+}
+
+// Toggle unlocks a locked lock. A lock with a code can only be locked
+// as the command does not include the code.
+func (lockType) Toggle(d *Device, state interface{}) (string, error) {
+	if state == "UNLOCKED" {
+		return "lock", nil
+	}
+	if d.Code != "" {
+		return "", fmt.Errorf("lock %s has a code and can not be "+
+			"unlocked by toggle", d.Name)
+	}
+	return "unlock", nil
+}
+
+// AggregateState reports a group as unlocked if any member is.
+func (lockType) AggregateState(states []interface{}) interface{} {
+	for _, st := range states {
+		if st == "UNLOCKED" {
+			return st
+		}
+	}
+	return "LOCKED"
+}
+
+func (lockType) Form() Form {
+	return Form{
+		Label: "Electric lock",
+		Fields: []FormField{
+			{Name: "relay", Label: "Strike", Kind: RelayField},
+			{Name: "unlock", Label: "Unlock time", Kind: DurationField,
+				Optional: true},
+		},
+	}
+}
+
+// lockActions pulses the strike relay for the unlock time. If the
+// device has a code, the payload must be of the form UNLOCK:<code>.
+func (d *Device) lockActions(cmd string) ([]*Action, error) {
+	verb, code := cmd, ""
+	if i := strings.Index(cmd, ":"); i != -1 {
+		verb, code = cmd[:i], cmd[i+1:]
+	}
+	switch strings.ToLower(verb) {
+	case "unlock", "open":
+		if d.Code != "" &&
+			subtle.ConstantTimeCompare([]byte(code), []byte(d.Code)) != 1 {
+			return nil, fmt.Errorf("invalid code on %s", d.Name)
+		}
+		dur, err := d.unlockTime()
+		if err != nil {
+			return nil, err
+		}
+		act, err := relayAction(d.Def[0], "pulse")
+		if err != nil {
+			return nil, err
+		}
+		act.Duration = dur
+		return []*Action{act}, nil
+	case "lock":
+		act, err := relayAction(d.Def[0], "off")
+		if err != nil {
+			return nil, err
+		}
+		return []*Action{act}, nil
+	}
+	return nil, fmt.Errorf("invalid command on %s: %s", d.Name, verb)
+}
+
+func (d *Device) unlockTime() (time.Duration, error) {
+	if len(d.Def) < 2 || d.Def[1] == "" {
+		if d.Timing.Pulse > 0 {
+			return d.Timing.Pulse, nil
+		}
+		return DefaultUnlockTime, nil
+	}
+	dur, err := time.ParseDuration(d.Def[1])
+	if err != nil || dur <= 0 {
+		return 0, fmt.Errorf("invalid unlock time on %s: %s",
+			d.Name, d.Def[1])
+	}
+	return dur, nil
+}
@@ -0,0 +1,188 @@
+package devices
+
+import (
+	"fmt"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+)
+
+// groupsContaining returns the names of the groups that have name as a
+// member. The caller must hold the lock.
+func (d *Devices) groupsContaining(name string) []string {
+	res := []string{}
+	for _, dev := range d.dev {
+		if dev.Type != DeviceGroup {
+			continue
+		}
+		for _, m := range dev.Def {
+			if m == name {
+				res = append(res, dev.Name)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// ValidateRename checks that the device oldName exists and can be renamed
+// to newName.
+func (d *Devices) ValidateRename(oldName, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.validateRename(oldName, newName)
+}
+
+func (d *Devices) validateRename(oldName, newName string) error {
+	reason := ""
+	switch {
+	case d.dev[oldName] == nil:
+		reason = "unknown device " + oldName
+	case !validName(newName):
+		reason = invalidNameReason
+	case newName == BridgeName:
+		reason = reservedNameReason
+	case d.dev[newName] != nil:
+		reason = "device " + newName + " already exists"
+	case d.nameInUse(newName):
+		reason = nameInUseReason
+	default:
+		return nil
+	}
+	return ValidationErrors{
+		{Device: oldName, Field: "name", Value: newName, Reason: reason},
+	}
+}
+
+// Rename renames a device updating the membership of any groups that
+// contain it.
+func (d *Devices) Rename(oldName, newName string) (*Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.validateRename(oldName, newName)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range d.groupsContaining(oldName) {
+		d.replace(g, func(group *Device) {
+			def := make([]string, len(group.Def))
+			for i, m := range group.Def {
+				if m == oldName {
+					m = newName
+				}
+				def[i] = m
+			}
+			group.Def = def
+		})
+	}
+	if pos, ok := d.position[oldName]; ok {
+		delete(d.position, oldName)
+		d.position[newName] = pos
+	}
+	dev := d.replace(oldName, func(dev *Device) { dev.Name = newName })
+	delete(d.dev, oldName)
+	return dev, nil
+}
+
+// Edit replaces the kind and definition of an existing device keeping
+// its other settings. The def is of the form name, kind, def... as for
+// Create.
+func (d *Devices) Edit(def []string) (*Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(def) == 0 {
+		return nil, unknownDevice("")
+	}
+	if d.dev[def[0]] == nil {
+		return nil, unknownDevice(def[0])
+	}
+	err := d.validate(def)
+	if err != nil {
+		return nil, err
+	}
+	t, err := kindFromArg(def[1])
+	if err != nil {
+		return nil, err
+	}
+	if t != d.dev[def[0]].Type && len(d.groupsContaining(def[0])) > 0 {
+		return nil, ValidationErrors{
+			{Device: def[0], Field: "kind", Value: def[1],
+				Reason: "cannot change the kind of a group member"},
+		}
+	}
+	return d.replace(def[0], func(dev *Device) {
+		dev.Type = t
+		dev.Def = def[2:]
+	}), nil
+}
+
+// ValidateDelete checks that the device exists and is not a member of
+// any group.
+func (d *Devices) ValidateDelete(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.validateDelete(name)
+}
+
+func (d *Devices) validateDelete(name string) error {
+	if d.dev[name] == nil {
+		return unknownDevice(name)
+	}
+	if groups := d.groupsContaining(name); len(groups) > 0 {
+		return ValidationErrors{
+			{Device: name, Field: "name", Value: name,
+				Reason: fmt.Sprintf("device is a member of groups %v",
+					groups)},
+		}
+	}
+	return nil
+}
+
+func (d *Devices) Delete(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.validateDelete(name)
+	if err != nil {
+		return err
+	}
+	delete(d.dev, name)
+	delete(d.position, name)
+	return nil
+}
+
+// AnnounceMessages returns the retained discovery message and, if the
+// device has state, the state message for a device.
+func (d *Devices) AnnounceMessages(name string, cfg types.SimpleStringConfig) ([]*mqtt.Msg, error) {
+	msg, err := d.DiscoveryMessage(name, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate discovery message: %w",
+			err)
+	}
+	msg.Retain = true
+	res := []*mqtt.Msg{msg}
+	msg, err = d.StateMessage(name, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate state message: %w", err)
+	}
+	if msg != nil {
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+// RemovalMessages returns empty retained messages for the discovery
+// and state topics of a device so that Home Assistant drops the
+// entity. It must be called before the device is renamed, edited or
+// deleted.
+func (d *Devices) RemovalMessages(name string, cfg types.SimpleStringConfig) ([]*mqtt.Msg, error) {
+	msg, err := d.DiscoveryMessage(name, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate discovery message: %w",
+			err)
+	}
+	return []*mqtt.Msg{
+		{Topic: msg.Topic, Body: "", Retain: true},
+		{Topic: mqtt.StateTopic(cfg.GetString("Bridge_Topic"), name),
+			Body: "", Retain: true},
+	}, nil
+}
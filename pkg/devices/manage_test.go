@@ -0,0 +1,180 @@
+package devices
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDevices(t *testing.T) *Devices {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	devs := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	for _, def := range [][]string{
+		{"blind1", "0", "udin_8r-r1", "udin_8r-r2"},
+		{"blind2", "0", "udin_8r-r3", "udin_8r-r4"},
+		{"vent", "1", "udin_8r-r5", "udin_8r-r6"},
+		{"blinds", "group", "blind1", "blind2"},
+	} {
+		_, err := devs.Create(def, true, "")
+		assert.NoError(t, err)
+	}
+	return devs
+}
+
+func Test_Rename(t *testing.T) {
+	devs := testDevices(t)
+
+	err := devs.ValidateRename("blind1", "blind3")
+	assert.NoError(t, err)
+	dev, err := devs.Rename("blind1", "blind3")
+	assert.NoError(t, err)
+	assert.Equal(t, "blind3", dev.Name)
+	assert.Nil(t, devs.Device("blind1"))
+	assert.Equal(t, dev, devs.Device("blind3"))
+	assert.Equal(t, []string{"blind3", "blind2"}, devs.Device("blinds").Def)
+
+	tests := []struct {
+		oldName string
+		newName string
+		reason  string
+	}{
+		{"nope", "blind4", "unknown device nope"},
+		{"blind2", "blind3", "device blind3 already exists"},
+		{"blind2", "a/b", invalidNameReason},
+		{"blind2", "bridge", reservedNameReason},
+	}
+	for _, tc := range tests {
+		t.Run(tc.oldName+"->"+tc.newName, func(t *testing.T) {
+			want := ValidationErrors{
+				{tc.oldName, "name", tc.newName, tc.reason},
+			}
+			assert.Equal(t, want, devs.ValidateRename(tc.oldName, tc.newName))
+			_, err := devs.Rename(tc.oldName, tc.newName)
+			assert.Equal(t, want, err)
+		})
+	}
+}
+
+// meterNames is a NameChecker for the names of meters.
+type meterNames map[string]bool
+
+func (m meterNames) NameInUse(name string) bool { return m[name] }
+
+func Test_NameInUse(t *testing.T) {
+	devs := testDevices(t)
+	devs.SetNameChecker(meterNames{"water": true, "blind2": true})
+
+	want := ValidationErrors{{"water", "name", "water", nameInUseReason}}
+	assert.Equal(t, want,
+		devs.Validate([]string{"water", "2", "udin_8r-r7"}))
+	_, err := devs.Create([]string{"water", "2", "udin_8r-r7"}, true, "")
+	assert.Equal(t, want, err)
+	_, err = devs.Import(map[string]Config{
+		"water": {Kind: "2", Def: []string{"udin_8r-r7"}}})
+	var verrs ValidationErrors
+	assert.True(t, errors.As(err, &verrs), "%v", err)
+	assert.Equal(t, want, verrs)
+
+	assert.Equal(t, ValidationErrors{
+		{"blind1", "name", "water", nameInUseReason},
+	}, devs.ValidateRename("blind1", "water"))
+	_, err = devs.Rename("blind1", "water")
+	assert.Error(t, err)
+
+	// existing devices can still be edited
+	assert.NoError(t,
+		devs.Validate([]string{"blind2", "0", "udin_8r-r3", "udin_8r-r4"}))
+}
+
+func Test_Edit(t *testing.T) {
+	devs := testDevices(t)
+	err := devs.SetTiming("vent", Timing{Guard: time.Second})
+	assert.NoError(t, err)
+
+	dev, err := devs.Edit([]string{"vent", "1",
+		"udin_8r-r5", "udin_8r-r6", "udin_8r-r7"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"udin_8r-r5", "udin_8r-r6", "udin_8r-r7"},
+		dev.Def)
+	assert.Equal(t, time.Second, dev.Timing.Guard)
+	assert.True(t, dev.Enabled)
+
+	dev, err = devs.Edit([]string{"vent", "2", "udin_8r-r8"})
+	assert.NoError(t, err)
+	assert.Equal(t, ElectricLock, dev.Type)
+
+	_, err = devs.Edit([]string{"nope", "2", "udin_8r-r8"})
+	assert.Equal(t, ValidationErrors{
+		{"nope", "name", "nope", "unknown device nope"},
+	}, err)
+	_, err = devs.Edit([]string{"vent", "2", "udin_8r-r1"})
+	assert.Equal(t, ValidationErrors{
+		{"vent", "def[0]", "udin_8r-r1", "relay already used by blind1"},
+	}, err)
+	_, err = devs.Edit([]string{"blind1", "2", "udin_8r-r1"})
+	assert.Equal(t, ValidationErrors{
+		{"blind1", "kind", "2", "cannot change the kind of a group member"},
+	}, err)
+}
+
+func Test_Delete(t *testing.T) {
+	devs := testDevices(t)
+
+	err := devs.Delete("blind1")
+	assert.Equal(t, ValidationErrors{
+		{"blind1", "name", "blind1",
+			"device is a member of groups [blinds]"},
+	}, err)
+	assert.NoError(t, devs.ValidateDelete("blinds"))
+	assert.NoError(t, devs.Delete("blinds"))
+	assert.NoError(t, devs.Delete("blind1"))
+	assert.Nil(t, devs.Device("blind1"))
+
+	// the relays of a deleted device can be reused
+	_, err = devs.Create([]string{"door", "2", "udin_8r-r1"}, true, "")
+	assert.NoError(t, err)
+
+	err = devs.ValidateDelete("blind1")
+	assert.Equal(t, ValidationErrors{
+		{"blind1", "name", "blind1", "unknown device blind1"},
+	}, err)
+}
+
+func Test_AnnounceAndRemovalMessages(t *testing.T) {
+	devs := testDevices(t)
+	cfg := MockCfg{
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+	}
+
+	msgs, err := devs.AnnounceMessages("vent", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "homeassistant/fan/vent/config", msgs[0].Topic)
+	assert.True(t, msgs[0].Retain)
+	assert.Equal(t, "udin/vent/state", msgs[1].Topic)
+
+	msgs, err = devs.RemovalMessages("vent", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "homeassistant/fan/vent/config", Body: "", Retain: true},
+		{Topic: "udin/vent/state", Body: "", Retain: true},
+	}, msgs)
+
+	msgs, err = devs.RemovalMessages("blinds", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "homeassistant/cover/blinds/config", Body: "", Retain: true},
+		{Topic: "udin/blinds/state", Body: "", Retain: true},
+	}, msgs)
+
+	_, err = devs.AnnounceMessages("nope", cfg)
+	assert.Error(t, err)
+	_, err = devs.RemovalMessages("nope", cfg)
+	assert.Error(t, err)
+}
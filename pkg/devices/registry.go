@@ -0,0 +1,228 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+)
+
+// DeviceType implements a kind of device. Types are registered with
+// Register and selected by the kind in a device definition.
+type DeviceType interface {
+	// Name is the canonical kind written to the device store.
+	Name() string
+	// Aliases are other kinds accepted in definitions.
+	Aliases() []string
+	// Component is the Home Assistant component of the entity.
+	Component() string
+	// Relays returns the relays referenced by the definition which
+	// are checked against the UDIN devices by the caller.
+	Relays(d *Device) []string
+	// Validate checks the rest of the definition.
+	Validate(d *Device, v *Validation)
+	// Command maps a payload from the command topic to relay actions.
+	Command(d *Device, cmd string) ([]*Action, error)
+	// Discovery returns the body of the discovery message or nil if
+	// the type is not announced.
+	Discovery(d *Device, e *Entity) (interface{}, error)
+	// State returns the body of the state message or nil if the
+	// state is not known.
+	State(d *Device, src StateSource) interface{}
+	// AggregateState combines the states of the members of a group.
+	AggregateState(states []interface{}) interface{}
+	// Form describes the definition for the UI.
+	Form() Form
+}
+
+// ToggleCommand is the command that switches a device to the opposite
+// of its current state. It is supported by types implementing Toggler.
+const ToggleCommand = "toggle"
+
+// Toggler is implemented by device types that support ToggleCommand.
+type Toggler interface {
+	// Toggle returns the command that reverses state, which is nil if
+	// the state is not known, or an error if d can not be toggled.
+	Toggle(d *Device, state interface{}) (string, error)
+}
+
+// Entity holds the discovery settings common to every entity.
+type Entity struct {
+	Name         string
+	UniqueID     string
+	Icon         string
+	CommandTopic string
+	StateTopic   string
+	Device       ha.Device
+	Availability []ha.Availability
+}
+
+// icon returns the icon of the entity or def if it has none.
+func (e *Entity) icon(def string) string {
+	if e.Icon != "" {
+		return e.Icon
+	}
+	return def
+}
+
+// Validation collects the problems found with a definition.
+type Validation struct {
+	name      string
+	errs      ValidationErrors
+	devices   map[string]*Device
+	numInputs map[string]uint
+}
+
+// Add records a problem with a field of the definition.
+func (v *Validation) Add(field, value, reason string) {
+	v.errs = append(v.errs, &ValidationError{
+		Device: v.name,
+		Field:  field,
+		Value:  value,
+		Reason: reason,
+	})
+}
+
+// Device returns the named existing device or nil.
+func (v *Validation) Device(name string) *Device {
+	return v.devices[name]
+}
+
+// Input checks that the input of a definition field exists.
+func (v *Validation) Input(field, input string) {
+	u, i, err := ParseInput(input)
+	if err != nil {
+		v.Add(field, input, "invalid input, expected <udin>-i<number>")
+		return
+	}
+	num, ok := v.numInputs[u]
+	switch {
+	case !ok:
+		v.Add(field, input, "unknown UDIN device "+u)
+	case i < 1 || i > num:
+		v.Add(field, input,
+			fmt.Sprintf("input must be between 1 and %d", num))
+	}
+}
+
+// Kinds of definition field used to render the UI form.
+const (
+	RelayField      = "relay"
+	RelayListField  = "relays"
+	InputField      = "input"
+	DurationField   = "duration"
+	DeviceListField = "devices"
+)
+
+// FormField describes one part of a definition. List fields expand to
+// several definition entries and Prefix is prepended to the value.
+type FormField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Kind     string `json:"kind"`
+	Optional bool   `json:"optional,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+}
+
+// Form describes a device type definition for the UI create form.
+type Form struct {
+	Label  string      `json:"label"`
+	Fields []FormField `json:"fields"`
+}
+
+// JSON returns the form for use by the UI javascript.
+func (f Form) JSON() string {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []DeviceType
+)
+
+// Register adds a device type and returns the RelayType for it. The
+// index of the type is also accepted as a kind. It panics if a type
+// with the same name or alias is already registered.
+func Register(t DeviceType) RelayType {
+	r, err := register(t)
+	if err != nil {
+		panic("devices: Register called twice for " + err.Error())
+	}
+	return r
+}
+
+func register(t DeviceType) (RelayType, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, kind := range append([]string{t.Name()}, t.Aliases()...) {
+		if _, err := lookupKind(kind); err == nil {
+			return UnsupportedRelayType,
+				fmt.Errorf("kind %s already registered", kind)
+		}
+	}
+	registry = append(registry, t)
+	return RelayType(len(registry) - 1), nil
+}
+
+// DeviceTypes returns the registered device types in the order they
+// were registered.
+func DeviceTypes() []DeviceType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]DeviceType(nil), registry...)
+}
+
+func (r RelayType) deviceType() DeviceType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if r < 0 || int(r) >= len(registry) {
+		return nil
+	}
+	return registry[r]
+}
+
+func kindFromArg(kind string) (RelayType, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return lookupKind(kind)
+}
+
+// lookupKind finds a registered type by index, name or alias. The
+// caller must hold registryMu.
+func lookupKind(kind string) (RelayType, error) {
+	if i, err := strconv.Atoi(kind); err == nil &&
+		i >= 0 && i < len(registry) {
+		return RelayType(i), nil
+	}
+	for i, t := range registry {
+		if t.Name() == kind {
+			return RelayType(i), nil
+		}
+		for _, a := range t.Aliases() {
+			if a == kind {
+				return RelayType(i), nil
+			}
+		}
+	}
+	return UnsupportedRelayType, fmt.Errorf("invalid relay type: %s", kind)
+}
+
+func (r RelayType) String() string {
+	if t := r.deviceType(); t != nil {
+		return t.Name()
+	}
+	return "unsupportedrelaytype"
+}
+
+func (r RelayType) Component() string {
+	if t := r.deviceType(); t != nil && t.Component() != "" {
+		return t.Component()
+	}
+	return "unsupported"
+}
@@ -0,0 +1,145 @@
+package devices
+
+import (
+	"testing"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+// switchType is a minimal device type used to test registration.
+type switchType struct{}
+
+func (switchType) Name() string                             { return "testswitch" }
+func (switchType) Aliases() []string                        { return []string{"tsw"} }
+func (switchType) Component() string                        { return "switch" }
+func (switchType) Relays(d *Device) []string                { return d.Def }
+func (switchType) Form() Form                               { return Form{Label: "Switch"} }
+func (switchType) AggregateState([]interface{}) interface{} { return nil }
+
+func (switchType) Validate(d *Device, v *Validation) {
+	if len(d.Def) != 1 {
+		v.Add("def", "", "expected one relay")
+	}
+}
+
+func (switchType) Command(d *Device, cmd string) ([]*Action, error) {
+	act, err := relayAction(d.Def[0], map[string]string{
+		"ON": "on", "OFF": "off"}[cmd])
+	if err != nil {
+		return nil, err
+	}
+	return []*Action{act}, nil
+}
+
+func (switchType) Discovery(d *Device, e *Entity) (interface{}, error) {
+	return ha.Switch{
+		CommandTopic: e.CommandTopic,
+		StateTopic:   e.StateTopic,
+		Name:         e.Name,
+		UniqueID:     e.UniqueID,
+		Device:       e.Device,
+		Icon:         e.icon("mdi:toggle-switch"),
+	}, nil
+}
+
+func (switchType) State(d *Device, src StateSource) interface{} {
+	if src.RelayOn(d.Def[0]) {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// isolateRegistry removes the types registered by a test when it
+// ends so that tests do not depend on the order or number of runs.
+func isolateRegistry(t *testing.T) {
+	registryMu.RLock()
+	n := len(registry)
+	registryMu.RUnlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		registry = registry[:n]
+	})
+}
+
+// registerTestSwitch registers switchType for the duration of a test.
+func registerTestSwitch(t *testing.T) RelayType {
+	isolateRegistry(t)
+	return Register(switchType{})
+}
+
+func Test_Registry(t *testing.T) {
+	testSwitch := registerTestSwitch(t)
+	assert.Equal(t, "testswitch", testSwitch.String())
+	assert.Equal(t, "switch", testSwitch.Component())
+	assert.Equal(t, "unsupported", DeviceGroup.Component())
+	assert.Equal(t, "unsupported", UnsupportedRelayType.Component())
+
+	for kind, want := range map[string]RelayType{
+		"0":                  MomentaryOpenClose,
+		"momentaryopenclose": MomentaryOpenClose,
+		"2":                  ElectricLock,
+		"group":              DeviceGroup,
+		"tsw":                testSwitch,
+		"testswitch":         testSwitch,
+	} {
+		got, err := kindFromArg(kind)
+		assert.NoError(t, err, kind)
+		assert.Equal(t, want, got, kind)
+	}
+	_, err := kindFromArg("-1")
+	assert.Error(t, err)
+
+	assert.Panics(t, func() { Register(switchType{}) })
+	assert.Panics(t, func() { Register(aliasClash{}) })
+
+	assert.Equal(t,
+		`{"label":"Electric lock","fields":[`+
+			`{"name":"relay","label":"Strike","kind":"relay"},`+
+			`{"name":"unlock","label":"Unlock time","kind":"duration",`+
+			`"optional":true}]}`,
+		ElectricLock.deviceType().Form().JSON())
+}
+
+type aliasClash struct{ switchType }
+
+func (aliasClash) Name() string      { return "other" }
+func (aliasClash) Aliases() []string { return []string{"group"} }
+
+func Test_RegisteredType(t *testing.T) {
+	registerTestSwitch(t)
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	devs := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = devs.Create([]string{"pump", "tsw", "udin_8r-r1", "udin_8r-r2"},
+		true, "")
+	assert.Equal(t, ValidationErrors{
+		{"pump", "def", "", "expected one relay"},
+	}, err)
+	_, err = devs.Create([]string{"pump", "tsw", "udin_8r-r1"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create([]string{"door", "2", "udin_8r-r1"}, true, "")
+	assert.Equal(t, ValidationErrors{
+		{"door", "def[0]", "udin_8r-r1", "relay already used by pump"},
+	}, err)
+
+	acts, err := devs.ActionForDevice("pump", "ON")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "pump", Udin: "udin_8r", Relay: 1, Action: "on"},
+	}, acts)
+
+	cfg := MockCfg{"Bridge_Topic": "udin", "Discovery_Prefix": "ha"}
+	msg, err := devs.DiscoveryMessage("pump", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "ha/switch/pump/config", msg.Topic)
+	assert.Equal(t, "udin/pump/state", msg.Body.(ha.Switch).StateTopic)
+
+	devs.SetRelay("udin_8r-r1", true)
+	msg, err = devs.StateMessage("pump", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "ON", msg.Body)
+	assert.Equal(t, "testswitch", devs.Configs()["pump"].Kind)
+}
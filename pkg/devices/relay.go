@@ -0,0 +1,167 @@
+package devices
+
+import (
+	"fmt"
+	"time"
+)
+
+// RelayConfig is the persisted form of the settings of a relay.
+type RelayConfig struct {
+	// Invert is set for relays wired through the normally closed
+	// contact so that the load is on when the relay is not energised.
+	Invert bool `json:"invert,omitempty" yaml:"invert,omitempty" mapstructure:"invert"`
+	// MaxOn is how long the relay may stay energised before the
+	// watchdog switches it off.
+	MaxOn string `json:"max_on,omitempty" yaml:"max_on,omitempty" mapstructure:"max_on"`
+}
+
+// RelayInfo describes a relay for the UI.
+type RelayInfo struct {
+	Name   string
+	Device string
+	Invert bool
+	MaxOn  time.Duration
+}
+
+// RelayConfigs returns the persisted form of the relay settings.
+func (d *Devices) RelayConfigs() map[string]RelayConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make(map[string]RelayConfig, len(d.invert))
+	for relay, inv := range d.invert {
+		if inv {
+			res[relay] = RelayConfig{Invert: inv}
+		}
+	}
+	for relay, maxOn := range d.maxOn {
+		if maxOn > 0 {
+			cfg := res[relay]
+			cfg.MaxOn = maxOn.String()
+			res[relay] = cfg
+		}
+	}
+	return res
+}
+
+// LoadRelays sets the relay settings from their persisted form. The
+// settings of relays on UDIN devices that are not present are kept so
+// that they are not lost when a device is unplugged.
+func (d *Devices) LoadRelays(cfgs map[string]RelayConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for relay, cfg := range cfgs {
+		if _, _, err := parseRelay(relay); err != nil {
+			return err
+		}
+		d.invert[relay] = cfg.Invert
+		if cfg.MaxOn == "" {
+			continue
+		}
+		maxOn, err := time.ParseDuration(cfg.MaxOn)
+		if err != nil || maxOn < 0 {
+			return fmt.Errorf("invalid maximum on-time %q for relay %s",
+				cfg.MaxOn, relay)
+		}
+		d.maxOn[relay] = maxOn
+	}
+	return nil
+}
+
+// SetInvert sets whether a relay is wired through its normally closed
+// contact.
+func (d *Devices) SetInvert(relay string, invert bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.validRelay(relay); err != nil {
+		return err
+	}
+	d.invert[relay] = invert
+	return nil
+}
+
+// SetMaxOn sets how long a relay may stay energised before the
+// watchdog switches it off. A zero duration is no limit.
+func (d *Devices) SetMaxOn(relay string, maxOn time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.validRelay(relay); err != nil {
+		return err
+	}
+	if maxOn < 0 {
+		return fmt.Errorf("invalid maximum on-time %s for relay %s",
+			maxOn, relay)
+	}
+	d.maxOn[relay] = maxOn
+	return nil
+}
+
+// MaxOns returns the maximum on-times of the relays that have one.
+func (d *Devices) MaxOns() map[string]time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := map[string]time.Duration{}
+	for relay, maxOn := range d.maxOn {
+		if maxOn > 0 {
+			res[relay] = maxOn
+		}
+	}
+	return res
+}
+
+// RelayDevice returns the device using a relay, if any.
+func (d *Devices) RelayDevice(relay string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.claimedRelays("")[relay]
+}
+
+// ValidateRelay checks that the relay is on one of the UDIN devices.
+func (d *Devices) ValidateRelay(relay string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.validRelay(relay)
+}
+
+func (d *Devices) validRelay(relay string) error {
+	u, r, err := parseRelay(relay)
+	if err != nil {
+		return err
+	}
+	if num, ok := d.numRelays[u]; !ok || r < 1 || r > num {
+		return fmt.Errorf("invalid relay %s", relay)
+	}
+	return nil
+}
+
+// Inverted returns true if the relay is wired through its normally
+// closed contact.
+func (d *Devices) Inverted(relay string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.invert[relay]
+}
+
+// UdinState maps between the state of the load on a relay and the
+// state of the relay in the UDIN protocol. As the mapping is its own
+// inverse it is used for both commands and status readback.
+func (d *Devices) UdinState(relay string, on bool) bool {
+	return on != d.Inverted(relay)
+}
+
+// RelayInfos returns the relays of the UDIN devices with the device
+// using them and their settings.
+func (d *Devices) RelayInfos() []RelayInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	claimed := d.claimedRelays("")
+	res := make([]RelayInfo, 0, len(d.relays))
+	for _, relay := range d.relays {
+		res = append(res, RelayInfo{
+			Name:   relay,
+			Device: claimed[relay],
+			Invert: d.invert[relay],
+			MaxOn:  d.maxOn[relay],
+		})
+	}
+	return res
+}
@@ -0,0 +1,87 @@
+package devices
+
+import (
+	"testing"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RelayInvert(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	devs := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = devs.Create([]string{"lock", "electriclock", "udin_8r-r2"},
+		true, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, devs.LoadRelays(map[string]RelayConfig{
+		"udin_8r-r2": {Invert: true},
+		// settings of missing UDIN devices are kept
+		"udin_44-r1": {Invert: true},
+	}))
+	assert.Error(t, devs.LoadRelays(map[string]RelayConfig{
+		"bogus": {Invert: true},
+	}))
+	assert.True(t, devs.Inverted("udin_8r-r2"))
+	assert.False(t, devs.Inverted("udin_8r-r1"))
+	assert.True(t, devs.UdinState("udin_8r-r1", true))
+	assert.False(t, devs.UdinState("udin_8r-r2", true))
+	assert.True(t, devs.UdinState("udin_8r-r2", false))
+
+	assert.NoError(t, devs.SetInvert("udin_8r-r3", true))
+	assert.NoError(t, devs.SetInvert("udin_8r-r2", false))
+	assert.EqualError(t, devs.SetInvert("udin_8r-r9", true),
+		"invalid relay udin_8r-r9")
+	assert.EqualError(t, devs.SetInvert("udin_44-r1", false),
+		"invalid relay udin_44-r1")
+	assert.Error(t, devs.ValidateRelay("udin_8r"))
+	assert.NoError(t, devs.ValidateRelay("udin_8r-r8"))
+	assert.Equal(t, map[string]RelayConfig{
+		"udin_8r-r3": {Invert: true},
+		"udin_44-r1": {Invert: true},
+	}, devs.RelayConfigs())
+
+	infos := devs.RelayInfos()
+	assert.Equal(t, 8, len(infos))
+	assert.Equal(t, RelayInfo{Name: "udin_8r-r2", Device: "lock"}, infos[1])
+	assert.Equal(t, RelayInfo{Name: "udin_8r-r3", Invert: true}, infos[2])
+}
+
+func Test_RelayMaxOn(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	devs := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = devs.Create([]string{"lock", "electriclock", "udin_8r-r2"},
+		true, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, devs.LoadRelays(map[string]RelayConfig{
+		"udin_8r-r2": {Invert: true, MaxOn: "10s"},
+	}))
+	assert.EqualError(t, devs.LoadRelays(map[string]RelayConfig{
+		"udin_8r-r1": {MaxOn: "forever"},
+	}), `invalid maximum on-time "forever" for relay udin_8r-r1`)
+	assert.NoError(t, devs.SetMaxOn("udin_8r-r4", time.Minute))
+	assert.EqualError(t, devs.SetMaxOn("udin_8r-r4", -time.Minute),
+		"invalid maximum on-time -1m0s for relay udin_8r-r4")
+	assert.EqualError(t, devs.SetMaxOn("udin_8r-r9", time.Minute),
+		"invalid relay udin_8r-r9")
+	assert.Equal(t, map[string]time.Duration{
+		"udin_8r-r2": 10 * time.Second,
+		"udin_8r-r4": time.Minute,
+	}, devs.MaxOns())
+	assert.Equal(t, map[string]RelayConfig{
+		"udin_8r-r2": {Invert: true, MaxOn: "10s"},
+		"udin_8r-r4": {MaxOn: "1m0s"},
+	}, devs.RelayConfigs())
+	assert.NoError(t, devs.SetMaxOn("udin_8r-r4", 0))
+	assert.Equal(t, map[string]time.Duration{
+		"udin_8r-r2": 10 * time.Second,
+	}, devs.MaxOns())
+	assert.Equal(t, RelayInfo{Name: "udin_8r-r2", Device: "lock",
+		Invert: true, MaxOn: 10 * time.Second}, devs.RelayInfos()[1])
+	assert.Equal(t, "lock", devs.RelayDevice("udin_8r-r2"))
+	assert.Equal(t, "", devs.RelayDevice("udin_8r-r1"))
+}
@@ -0,0 +1,66 @@
+package devices
+
+import (
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+)
+
+// Outcomes of a command.
+const (
+	// ResultOK means every relay action of the command was taken.
+	ResultOK = "ok"
+	// ResultError means the command was invalid or an action failed.
+	ResultError = "error"
+	// ResultDeferred means the rate limit of the device deferred the
+	// command. Another result follows when it runs.
+	ResultDeferred = "deferred"
+	// ResultDropped means the rate limit of the device discarded the
+	// command.
+	ResultDropped = "dropped"
+)
+
+// Sources of commands.
+const (
+	SourceMQTT       = "mqtt"
+	SourceSchedule   = "schedule"
+	SourceAutomation = "automation"
+	SourceRateLimit  = "rate_limit"
+)
+
+// Result is the body of the <bridge>/<device>/result message published
+// for each command.
+type Result struct {
+	Device  string `json:"device"`
+	Command string `json:"command"`
+	Source  string `json:"source"`
+	Outcome string `json:"outcome"`
+	// Actions are the relay actions taken
+	Actions  []string  `json:"actions"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+}
+
+// ResultTopic is the topic that the results of commands to a device
+// are published to.
+func ResultTopic(cfg types.SimpleStringConfig, device string) string {
+	return cfg.GetString("Bridge_Topic") + "/" + device + "/result"
+}
+
+// LogTopic is the topic that the results of commands to every device
+// are published to if Bridge_Log is enabled.
+func LogTopic(cfg types.SimpleStringConfig) string {
+	return cfg.GetString("Bridge_Topic") + "/bridge/log"
+}
+
+// Messages returns the result message of the command and, if log is
+// set, the same result for the bridge log.
+func (r *Result) Messages(cfg types.SimpleStringConfig, log bool) []*mqtt.Msg {
+	res := []*mqtt.Msg{{Topic: ResultTopic(cfg, r.Device), Body: r}}
+	if log {
+		res = append(res, &mqtt.Msg{Topic: LogTopic(cfg), Body: r})
+	}
+	return res
+}
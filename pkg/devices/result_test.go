@@ -0,0 +1,29 @@
+package devices
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResultMessages(t *testing.T) {
+	cfg := MockCfg{"Bridge_Topic": "udin"}
+	res := &Result{
+		Device:   "blind",
+		Command:  "OPEN",
+		Source:   SourceMQTT,
+		Outcome:  ResultOK,
+		Actions:  []string{"udin_8r[1].pulse"},
+		Time:     time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC),
+		Duration: "300ms",
+	}
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "udin/blind/result", Body: res},
+	}, res.Messages(cfg, false))
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "udin/blind/result", Body: res},
+		{Topic: "udin/bridge/log", Body: res},
+	}, res.Messages(cfg, true))
+}
@@ -0,0 +1,544 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// ScriptExt is the file extension of device type scripts.
+const ScriptExt = ".star"
+
+// scriptMaxSteps limits the work a script may do in a single call so
+// that a broken script cannot stall the bridge.
+const scriptMaxSteps = 100000
+
+// scriptType is a device type defined by a Starlark script. The script
+// sets these globals:
+//
+//	name       kind used in definitions (required)
+//	aliases    list of other kinds
+//	component  Home Assistant component (required)
+//	label      label of the type in the UI
+//	icon       default icon of the entities
+//	relays     names of the relays in the definition
+//	inputs     names of the inputs that follow the relays
+//	command    function(dev, cmd) returning on, off and pulse actions
+//	discovery  function(dev, entity) returning the discovery payload
+//	state      function(dev, relays) returning the state or None, or
+//	           function(dev, relays, inputs) if the script has inputs
+//	aggregate  function(states) returning the state of a group
+//
+// Scripts cannot load other modules or read files and they only drive
+// the relays of the device being commanded.
+type scriptType struct {
+	file      string
+	name      string
+	aliases   []string
+	component string
+	label     string
+	icon      string
+	relays    []string
+	inputs    []string
+	command   starlark.Callable
+	discovery starlark.Callable
+	state     starlark.Callable
+	aggregate starlark.Callable
+}
+
+// LoadScripts registers the device types defined by the scripts in
+// dir. It returns the types registered before any error.
+func LoadScripts(dir string) ([]RelayType, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+ScriptExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	res := []RelayType{}
+	for _, file := range files {
+		st, err := loadScript(file)
+		if err != nil {
+			return res, err
+		}
+		r, err := register(st)
+		if err != nil {
+			return res, fmt.Errorf("script %s: %w", file, err)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// scriptBuiltins are the only names predeclared for scripts.
+var scriptBuiltins = starlark.StringDict{
+	"on":     starlark.NewBuiltin("on", scriptAction),
+	"off":    starlark.NewBuiltin("off", scriptAction),
+	"pulse":  starlark.NewBuiltin("pulse", scriptAction),
+	"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+}
+
+func scriptThread(name string) *starlark.Thread {
+	th := &starlark.Thread{
+		Name:  name,
+		Print: func(*starlark.Thread, string) {},
+		// Load is left nil so load statements fail
+	}
+	th.SetMaxExecutionSteps(scriptMaxSteps)
+	return th
+}
+
+func loadScript(file string) (*scriptType, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	g, err := starlark.ExecFile(scriptThread(file), file, src, scriptBuiltins)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %w", file, err)
+	}
+	g.Freeze()
+	st := &scriptType{file: file}
+	errs := []string{}
+	str := func(key string, required bool) string {
+		v, ok := g[key]
+		if !ok {
+			if required {
+				errs = append(errs, key+" is required")
+			}
+			return ""
+		}
+		s, ok := starlark.AsString(v)
+		if !ok || (required && s == "") {
+			errs = append(errs, key+" must be a non-empty string")
+		}
+		return s
+	}
+	list := func(key string) []string {
+		v, ok := g[key]
+		if !ok {
+			return nil
+		}
+		it, ok := v.(starlark.Indexable)
+		if !ok {
+			errs = append(errs, key+" must be a list of strings")
+			return nil
+		}
+		res := make([]string, it.Len())
+		for i := range res {
+			s, ok := starlark.AsString(it.Index(i))
+			if !ok || s == "" {
+				errs = append(errs, key+" must be a list of strings")
+				return nil
+			}
+			res[i] = s
+		}
+		return res
+	}
+	fn := func(key string, required bool) starlark.Callable {
+		v, ok := g[key]
+		if !ok {
+			if required {
+				errs = append(errs, key+" is required")
+			}
+			return nil
+		}
+		c, ok := v.(starlark.Callable)
+		if !ok {
+			errs = append(errs, key+" must be a function")
+		}
+		return c
+	}
+	st.name = strings.ToLower(str("name", true))
+	st.component = str("component", true)
+	st.label = str("label", false)
+	st.icon = str("icon", false)
+	st.aliases = list("aliases")
+	st.relays = list("relays")
+	st.inputs = list("inputs")
+	st.command = fn("command", true)
+	st.discovery = fn("discovery", false)
+	st.state = fn("state", false)
+	st.aggregate = fn("aggregate", false)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("script %s: %s", file, strings.Join(errs, ", "))
+	}
+	if st.label == "" {
+		st.label = st.name
+	}
+	return st, nil
+}
+
+func (t *scriptType) Name() string      { return t.name }
+func (t *scriptType) Aliases() []string { return t.aliases }
+func (t *scriptType) Component() string { return t.component }
+
+func (t *scriptType) Relays(d *Device) []string {
+	if len(d.Def) > len(t.relays) {
+		return d.Def[:len(t.relays)]
+	}
+	return d.Def
+}
+
+func (t *scriptType) Validate(d *Device, v *Validation) {
+	if len(d.Def) != len(t.relays)+len(t.inputs) {
+		v.Add("def", strings.Join(d.Def, ","), fmt.Sprintf(
+			"expected %s", strings.Join(append(t.relays, t.inputs...), ",")))
+		return
+	}
+	for i, input := range d.Def[len(t.relays):] {
+		v.Input(fmt.Sprintf("def[%d]", len(t.relays)+i), input)
+	}
+}
+
+func (t *scriptType) Command(d *Device, cmd string) ([]*Action, error) {
+	v, err := t.call(d, t.command, t.device(d), starlark.String(cmd))
+	if err != nil {
+		return nil, err
+	}
+	var vals []starlark.Value
+	switch v := v.(type) {
+	case starlark.NoneType:
+	case *actionValue:
+		vals = []starlark.Value{v}
+	case starlark.Indexable:
+		for i := 0; i < v.Len(); i++ {
+			vals = append(vals, v.Index(i))
+		}
+	default:
+		return nil, fmt.Errorf("command on %s returned %s, expected actions",
+			d.Name, v.Type())
+	}
+	acts := make([]*Action, 0, len(vals))
+	for _, v := range vals {
+		av, ok := v.(*actionValue)
+		if !ok {
+			return nil, fmt.Errorf(
+				"command on %s returned %s, expected actions", d.Name, v.Type())
+		}
+		if !t.hasRelay(d, av.relay) {
+			return nil, fmt.Errorf("relay %s is not part of %s",
+				av.relay, d.Name)
+		}
+		act, err := relayAction(av.relay, av.action)
+		if err != nil {
+			return nil, err
+		}
+		act.Duration = av.duration
+		if act.Action == "pulse" && act.Duration == 0 {
+			act.Duration = d.PulseTime()
+		}
+		act.Delay = av.delay
+		acts = append(acts, act)
+	}
+	return acts, nil
+}
+
+func (t *scriptType) hasRelay(d *Device, relay string) bool {
+	for _, r := range t.Relays(d) {
+		if r == relay {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *scriptType) Discovery(d *Device, e *Entity) (interface{}, error) {
+	entity := map[string]interface{}{
+		"name":          e.Name,
+		"unique_id":     e.UniqueID,
+		"command_topic": e.CommandTopic,
+		"state_topic":   e.StateTopic,
+		"device":        e.Device,
+		"availability":  e.Availability,
+	}
+	if icon := e.icon(t.icon); icon != "" {
+		entity["icon"] = icon
+	}
+	// round trip through JSON so the script sees the payload field names
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+	if t.discovery == nil {
+		return payload, nil
+	}
+	ev, err := toStarlark(payload)
+	if err != nil {
+		return nil, err
+	}
+	v, err := t.call(d, t.discovery, t.device(d), ev)
+	if err != nil {
+		return nil, err
+	}
+	res, err := fromStarlark(v)
+	if err != nil {
+		return nil, fmt.Errorf("discovery on %s returned %s: %w",
+			d.Name, v.Type(), err)
+	}
+	return res, nil
+}
+
+func (t *scriptType) State(d *Device, src StateSource) interface{} {
+	if t.state == nil {
+		return nil
+	}
+	relays := starlark.NewDict(len(t.relays))
+	for i, relay := range t.Relays(d) {
+		_ = relays.SetKey(starlark.String(t.relays[i]),
+			starlark.Bool(src.RelayOn(relay)))
+	}
+	args := []starlark.Value{t.device(d), relays}
+	if len(t.inputs) > 0 {
+		inputs := starlark.NewDict(len(t.inputs))
+		for i, input := range d.Def[len(t.Relays(d)):] {
+			if i < len(t.inputs) {
+				_ = inputs.SetKey(starlark.String(t.inputs[i]),
+					starlark.Bool(src.InputOn(input)))
+			}
+		}
+		args = append(args, inputs)
+	}
+	v, err := t.call(d, t.state, args...)
+	if err != nil {
+		return nil
+	}
+	res, err := fromStarlark(v)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// AggregateState uses the aggregate function of the script or else
+// reports the state of the first member.
+func (t *scriptType) AggregateState(states []interface{}) interface{} {
+	if t.aggregate == nil {
+		return states[0]
+	}
+	sv, err := toStarlark(states)
+	if err != nil {
+		return nil
+	}
+	v, err := starlark.Call(scriptThread(t.file), t.aggregate,
+		starlark.Tuple{sv}, nil)
+	if err != nil {
+		return nil
+	}
+	res, err := fromStarlark(v)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+func (t *scriptType) Form() Form {
+	f := Form{Label: t.label}
+	for _, r := range t.relays {
+		f.Fields = append(f.Fields, FormField{Name: r, Label: r,
+			Kind: RelayField})
+	}
+	for _, i := range t.inputs {
+		f.Fields = append(f.Fields, FormField{Name: i, Label: i,
+			Kind: InputField})
+	}
+	return f
+}
+
+// device returns the view of a device passed to script functions.
+func (t *scriptType) device(d *Device) starlark.Value {
+	relays := starlark.NewDict(len(t.relays))
+	inputs := starlark.NewDict(len(t.inputs))
+	for i, v := range d.Def {
+		if i < len(t.relays) {
+			_ = relays.SetKey(starlark.String(t.relays[i]), starlark.String(v))
+		} else if i-len(t.relays) < len(t.inputs) {
+			_ = inputs.SetKey(starlark.String(t.inputs[i-len(t.relays)]),
+				starlark.String(v))
+		}
+	}
+	guard := ""
+	if d.Timing.Guard > 0 {
+		guard = d.Timing.Guard.String()
+	}
+	dev := starlarkstruct.FromStringDict(starlarkstruct.Default,
+		starlark.StringDict{
+			"name":   starlark.String(d.Name),
+			"relays": relays,
+			"inputs": inputs,
+			"pulse":  starlark.String(d.PulseTime().String()),
+			"guard":  starlark.String(guard),
+		})
+	dev.Freeze()
+	return dev
+}
+
+func (t *scriptType) call(d *Device, fn starlark.Callable, args ...starlark.Value) (starlark.Value, error) {
+	v, err := starlark.Call(scriptThread(t.file), fn, args, nil)
+	if err != nil {
+		if ee, ok := err.(*starlark.EvalError); ok {
+			// errors from fail() are reported with just their message
+			return nil, fmt.Errorf("%s on %s failed: %s",
+				fn.Name(), d.Name, strings.TrimPrefix(ee.Msg, "fail: "))
+		}
+		return nil, fmt.Errorf("%s on %s failed: %w", fn.Name(), d.Name, err)
+	}
+	return v, nil
+}
+
+// actionValue is the result of the on, off and pulse builtins.
+type actionValue struct {
+	relay    string
+	action   string
+	duration time.Duration
+	delay    time.Duration
+}
+
+func (a *actionValue) String() string {
+	return fmt.Sprintf("%s(%q)", a.action, a.relay)
+}
+func (a *actionValue) Type() string         { return "action" }
+func (a *actionValue) Freeze()              {}
+func (a *actionValue) Truth() starlark.Bool { return starlark.True }
+func (a *actionValue) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: action")
+}
+
+// scriptAction implements on(relay, delay=""), off(relay, delay="")
+// and pulse(relay, duration="", delay="") where durations are strings
+// such as "500ms". A pulse without a duration uses the pulse time of
+// the device.
+func scriptAction(th *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var relay, duration, delay string
+	var err error
+	if b.Name() == "pulse" {
+		err = starlark.UnpackArgs(b.Name(), args, kwargs, "relay", &relay,
+			"duration?", &duration, "delay?", &delay)
+	} else {
+		err = starlark.UnpackArgs(b.Name(), args, kwargs, "relay", &relay,
+			"delay?", &delay)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := &actionValue{relay: relay, action: b.Name()}
+	for _, d := range []struct {
+		s   string
+		dst *time.Duration
+	}{{duration, &a.duration}, {delay, &a.delay}} {
+		if d.s == "" {
+			continue
+		}
+		*d.dst, err = time.ParseDuration(d.s)
+		if err != nil || *d.dst < 0 {
+			return nil, fmt.Errorf("%s: invalid duration %q", b.Name(), d.s)
+		}
+	}
+	return a, nil
+}
+
+// toStarlark converts JSON like Go values to Starlark values.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case []interface{}:
+		l := make([]starlark.Value, len(v))
+		for i, e := range v {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = sv
+		}
+		return starlark.NewList(l), nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(v))
+		for k, e := range v {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			_ = dict.SetKey(starlark.String(k), sv)
+		}
+		return dict, nil
+	}
+	// other values, such as states of built in types, go through JSON
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var j interface{}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	return toStarlark(j)
+}
+
+// fromStarlark converts a value returned by a script to a Go value
+// that can be encoded as JSON.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer out of range: %s", v)
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(v), nil
+	case *starlark.Dict:
+		res := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict key must be a string: %s",
+					item[0])
+			}
+			e, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			res[k] = e
+		}
+		return res, nil
+	case starlark.Indexable:
+		res := make([]interface{}, v.Len())
+		for i := range res {
+			e, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			res[i] = e
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unsupported value of type %s", v.Type())
+}
@@ -0,0 +1,215 @@
+package devices
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Scripts(t *testing.T) {
+	isolateRegistry(t)
+	types, err := LoadScripts("../../examples/types")
+	assert.NoError(t, err)
+	if !assert.Equal(t, 2, len(types)) {
+		return
+	}
+	assert.Equal(t, "garagedoor", types[0].String())
+	assert.Equal(t, "motorcover", types[1].String())
+	assert.Equal(t, "cover", types[1].Component())
+	assert.Equal(t, Form{
+		Label: "Garage door button (cover)",
+		Fields: []FormField{
+			{Name: "button", Label: "button", Kind: RelayField},
+			{Name: "closed", Label: "closed", Kind: InputField},
+		},
+	}, types[0].deviceType().Form())
+
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	devices := NewDevices(map[string]*udin.UdinDevice{
+		"udin_8r": u8r, "udin_44": u44})
+	assert.Equal(t, []string{"udin_44-i1", "udin_44-i2", "udin_44-i3",
+		"udin_44-i4"}, devices.Inputs())
+
+	_, err = devices.Create([]string{"shutter", "motorcover",
+		"udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devices.Create([]string{"garage", "garage",
+		"udin_44-r1", "udin_44-i1"}, true, "")
+	assert.NoError(t, err)
+	err = devices.Validate([]string{"bad", "garagedoor",
+		"udin_44-r2", "udin_44-i5"})
+	assert.EqualError(t, err,
+		`device bad: def[1] "udin_44-i5": input must be between 1 and 4`)
+	err = devices.Validate([]string{"bad", "motorcover", "udin_8r-r3"})
+	assert.EqualError(t, err,
+		`device bad: def "udin_8r-r3": expected power,direction`)
+	assert.NoError(t, devices.SetTiming("shutter", Timing{Guard: time.Second}))
+
+	acts, err := devices.ActionForDevice("shutter", "OPEN")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "shutter", Udin: "udin_8r", Relay: 1, Action: "off"},
+		{Device: "shutter", Udin: "udin_8r", Relay: 2, Action: "on"},
+		{Device: "shutter", Udin: "udin_8r", Relay: 1, Action: "on",
+			Delay: time.Second},
+	}, acts)
+	_, err = devices.ActionForDevice("shutter", "UP")
+	assert.EqualError(t, err, "invalid action on device shutter: "+
+		"command on shutter failed: invalid command: up")
+	acts, err = devices.ActionForDevice("garage", "STOP")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{
+		{Device: "garage", Udin: "udin_44", Relay: 1, Action: "pulse",
+			Duration: 500 * time.Millisecond},
+	}, acts)
+
+	cfg := MockCfg{"Bridge_Topic": "udin", "Discovery_Prefix": "homeassistant"}
+	msg, err := devices.DiscoveryMessage("garage", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "homeassistant/cover/garage/config", msg.Topic)
+	body := msg.Body.(map[string]interface{})
+	assert.Equal(t, "garage", body["device_class"])
+	assert.Equal(t, "STOP", body["payload_stop"])
+	assert.Equal(t, "mdi:garage", body["icon"])
+	assert.Equal(t, "udin/garage/set", body["command_topic"])
+	assert.Equal(t, "udin_udin_44",
+		body["device"].(map[string]interface{})["via_device"])
+
+	msg, err = devices.StateMessage("shutter", cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+
+	// the garage door reports the state of its closed input
+	assert.True(t, devices.Watches("udin_44-i1"))
+	assert.False(t, devices.Watches("udin_44-i2"))
+	assert.Equal(t, []string{"garage"}, devices.SetInput("udin_44-i1", true))
+	assert.Empty(t, devices.SetInput("udin_44-i1", true), "unchanged")
+	msg, err = devices.StateMessage("garage", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "closed", msg.Body)
+	assert.Equal(t, []string{"garage"}, devices.SetInput("udin_44-i1", false))
+	msg, err = devices.StateMessage("garage", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "open", msg.Body)
+	devices.SetRelay("udin_8r-r2", true)
+	devices.SetRelay("udin_8r-r1", true)
+	msg, err = devices.StateMessage("shutter", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "opening", msg.Body)
+	assert.Equal(t, "closing",
+		types[1].deviceType().AggregateState([]interface{}{"closing"}))
+
+	_, err = LoadScripts("../../examples/types")
+	assert.Error(t, err, "types may only be registered once")
+}
+
+func Test_ScriptErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{
+			name:   "syntax",
+			script: "name = ",
+			want:   "got end of file, want primary expression",
+		},
+		{
+			name:   "load",
+			script: `load("other.star", "x")`,
+			want:   "load not implemented",
+		},
+		{
+			name:   "missing",
+			script: `name = "x"`,
+			want:   "component is required, command is required",
+		},
+		{
+			name:   "types",
+			script: "name = 1\ncomponent = \"switch\"\nrelays = [1]\ncommand = 2",
+			want: "name must be a non-empty string, relays must be a list " +
+				"of strings, command must be a function",
+		},
+	}
+	dir := t.TempDir()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, tc.name+ScriptExt)
+			assert.NoError(t, os.WriteFile(file, []byte(tc.script), 0o600))
+			_, err := loadScript(file)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.want)
+			}
+		})
+	}
+}
+
+func Test_ScriptSandbox(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sandbox"+ScriptExt)
+	assert.NoError(t, os.WriteFile(file, []byte(`
+name = "sandboxtest"
+component = "switch"
+relays = ["relay"]
+
+def command(dev, cmd):
+    if cmd == "loop":
+        for i in range(1000000):
+            pass
+    if cmd == "other":
+        return on("udin_8r-r8")
+    if cmd == "bad":
+        return on(dev.relays["relay"], delay = "soon")
+    return [on(dev.relays["relay"])]
+`), 0o600))
+	st, err := loadScript(file)
+	assert.NoError(t, err)
+	dev := &Device{Name: "sw", Def: []string{"udin_8r-r1"}}
+	acts, err := st.Command(dev, "on")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Action{{Udin: "udin_8r", Relay: 1, Action: "on"}}, acts)
+	_, err = st.Command(dev, "loop")
+	assert.EqualError(t, err,
+		"command on sw failed: Starlark computation cancelled: "+
+			"too many steps")
+	_, err = st.Command(dev, "other")
+	assert.EqualError(t, err, "relay udin_8r-r8 is not part of sw")
+	_, err = st.Command(dev, "bad")
+	assert.EqualError(t, err,
+		`command on sw failed: on: invalid duration "soon"`)
+	assert.Nil(t, st.State(dev, nil))
+	assert.Equal(t, "ON", st.AggregateState([]interface{}{"ON", "OFF"}))
+}
+
+func Test_ScriptDiscoveryError(t *testing.T) {
+	isolateRegistry(t)
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken"+ScriptExt),
+		[]byte(`
+name = "brokendiscovery"
+component = "switch"
+relays = ["relay"]
+
+def command(dev, cmd):
+    return on(dev.relays["relay"])
+
+def discovery(dev, entity):
+    fail("no discovery for " + dev.name)
+`), 0o600))
+	_, err := LoadScripts(dir)
+	assert.NoError(t, err)
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	devices := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = devices.Create([]string{"sw", "brokendiscovery", "udin_8r-r1"},
+		true, "")
+	assert.NoError(t, err)
+	_, err = devices.DiscoveryMessage("sw", MockCfg{})
+	assert.EqualError(t, err, "discovery on sw failed: no discovery for sw")
+}
@@ -0,0 +1,146 @@
+package devices
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Actions in an ImportChange.
+const (
+	ImportAdd       = "add"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+)
+
+// ImportChange describes the effect of importing one device. Diff
+// lists the changed settings of an updated device.
+type ImportChange struct {
+	Device string   `json:"device"`
+	Action string   `json:"action"`
+	Diff   []string `json:"diff,omitempty"`
+}
+
+// PlanImport validates importing the given devices, which are added or
+// replace existing devices of the same name, and returns the changes
+// that Import would make. Devices that are not imported are kept, as
+// are the codes of imported devices that are RedactedCode.
+func (d *Devices) PlanImport(cfgs map[string]Config) ([]*ImportChange, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, changes, err := d.planImport(cfgs)
+	return changes, err
+}
+
+// Import adds or replaces the given devices after validating them as
+// for PlanImport.
+func (d *Devices) Import(cfgs map[string]Config) ([]*ImportChange, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cand, changes, err := d.planImport(cfgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		if c.Action != ImportUnchanged {
+			d.dev[c.Device] = cand.dev[c.Device]
+		}
+	}
+	return changes, nil
+}
+
+// planImport loads the imported devices into a copy of the current
+// devices so that they are validated together, for example a group
+// can refer to a device imported with it. The caller must hold the
+// lock.
+func (d *Devices) planImport(cfgs map[string]Config) (*Devices, []*ImportChange, error) {
+	cand := NewDevices(d.udins)
+	cand.names = d.names
+	for name, dev := range d.dev {
+		if _, ok := cfgs[name]; !ok {
+			cp := *dev
+			cand.dev[name] = &cp
+		}
+	}
+	cfgs, err := d.unredact(cfgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cand.Load(cfgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// groups that are kept must still be valid with the new members
+	for name, dev := range cand.dev {
+		if _, ok := cfgs[name]; ok || dev.Type != DeviceGroup {
+			continue
+		}
+		args := append([]string{name, dev.Type.String()}, dev.Def...)
+		if err := cand.Validate(args); err != nil {
+			return nil, nil, err
+		}
+	}
+	names := make([]string, 0, len(cfgs))
+	for name := range cfgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changes := make([]*ImportChange, 0, len(names))
+	for _, name := range names {
+		c := &ImportChange{Device: name, Action: ImportAdd}
+		if old := d.dev[name]; old != nil {
+			c.Diff = configDiff(old.config(), cand.dev[name].config())
+			c.Action = ImportUpdate
+			if len(c.Diff) == 0 {
+				c.Action = ImportUnchanged
+			}
+		}
+		changes = append(changes, c)
+	}
+	return cand, changes, nil
+}
+
+// unredact returns a copy of cfgs with redacted codes replaced by the
+// codes of the existing devices. The caller must hold the lock.
+func (d *Devices) unredact(cfgs map[string]Config) (map[string]Config, error) {
+	res := make(map[string]Config, len(cfgs))
+	for name, cfg := range cfgs {
+		if cfg.Code == RedactedCode {
+			old := d.dev[name]
+			if old == nil || old.Code == "" {
+				return nil, fmt.Errorf(
+					"device %s has a redacted code and no existing code",
+					name)
+			}
+			cfg.Code = old.Code
+		}
+		res[name] = cfg
+	}
+	return res, nil
+}
+
+// configDiff returns a description of each setting that differs
+// between two device configurations. Codes are not shown.
+func configDiff(a, b Config) []string {
+	diff := []string{}
+	add := func(field string, av, bv interface{}) {
+		if !reflect.DeepEqual(av, bv) {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", field, av, bv))
+		}
+	}
+	add("kind", a.Kind, b.Kind)
+	add("def", a.Def, b.Def)
+	add("enabled", a.Enabled, b.Enabled)
+	add("icon", a.Icon, b.Icon)
+	if a.Code != b.Code {
+		diff = append(diff, "code: changed")
+	}
+	add("pulse", a.Pulse, b.Pulse)
+	add("guard", a.Guard, b.Guard)
+	add("rate_limit", a.RateLimit, b.RateLimit)
+	add("rate_policy", a.RatePolicy, b.RatePolicy)
+	add("area", a.Area, b.Area)
+	add("manufacturer", a.Manufacturer, b.Manufacturer)
+	add("model", a.Model, b.Model)
+	return diff
+}
@@ -0,0 +1,149 @@
+package devices
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ImportRoundTrip(t *testing.T) {
+	devs := testDevices(t)
+	assert.NoError(t, devs.SetInfo("vent", Info{Area: "Bathroom"}))
+	exported := devs.Configs()
+
+	// importing into another bridge with the same layout
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	other := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	changes, err := other.PlanImport(exported)
+	assert.NoError(t, err)
+	assert.Equal(t, []*ImportChange{
+		{Device: "blind1", Action: ImportAdd},
+		{Device: "blind2", Action: ImportAdd},
+		{Device: "blinds", Action: ImportAdd},
+		{Device: "vent", Action: ImportAdd},
+	}, changes)
+	assert.Equal(t, 0, len(other.Devices()), "plan must not change devices")
+
+	_, err = other.Import(exported)
+	assert.NoError(t, err)
+	assert.Equal(t, exported, other.Configs())
+
+	// importing the same devices again changes nothing
+	changes, err = other.Import(exported)
+	assert.NoError(t, err)
+	for _, c := range changes {
+		assert.Equal(t, ImportUnchanged, c.Action, c.Device)
+	}
+}
+
+func Test_ImportUpdate(t *testing.T) {
+	devs := testDevices(t)
+	devs.SetRelay("udin_8r-r1", true)
+
+	// swap the relays of the blinds and add a lock
+	cfgs := map[string]Config{
+		"blind1": {Kind: "0", Def: []string{"udin_8r-r3", "udin_8r-r4"},
+			Enabled: true, Code: "1"},
+		"blind2": {Kind: "momentaryopenclose",
+			Def: []string{"udin_8r-r1", "udin_8r-r2"}},
+		"door": {Kind: "electriclock", Def: []string{"udin_8r-r7"},
+			Enabled: true, Pulse: "2s"},
+	}
+	changes, err := devs.Import(cfgs)
+	assert.NoError(t, err)
+	assert.Equal(t, []*ImportChange{
+		{Device: "blind1", Action: ImportUpdate, Diff: []string{
+			"def: [udin_8r-r1 udin_8r-r2] -> [udin_8r-r3 udin_8r-r4]",
+			"code: changed",
+		}},
+		{Device: "blind2", Action: ImportUpdate, Diff: []string{
+			"def: [udin_8r-r3 udin_8r-r4] -> [udin_8r-r1 udin_8r-r2]",
+			"enabled: true -> false",
+		}},
+		{Device: "door", Action: ImportAdd},
+	}, changes)
+	assert.Equal(t, []string{"udin_8r-r3", "udin_8r-r4"},
+		devs.Device("blind1").Def)
+	assert.True(t, devs.RelayOn("udin_8r-r1"), "relay state is kept")
+	assert.NotNil(t, devs.Device("vent"), "other devices are kept")
+}
+
+func Test_ImportRedacted(t *testing.T) {
+	devs := testDevices(t)
+	_, err := devs.Create([]string{"door", "electriclock", "udin_8r-r7"},
+		true, "")
+	assert.NoError(t, err)
+	devs.Device("door").Code = "1234"
+	exported := RedactCodes(devs.Configs())
+	assert.Equal(t, RedactedCode, exported["door"].Code)
+	assert.Equal(t, "", exported["vent"].Code)
+
+	// a redacted code keeps the code of the existing device
+	changes, err := devs.Import(exported)
+	assert.NoError(t, err)
+	for _, c := range changes {
+		assert.Equal(t, ImportUnchanged, c.Action, c.Device)
+	}
+	assert.Equal(t, RedactedCode, exported["door"].Code,
+		"import must not change its argument")
+	assert.Equal(t, "1234", devs.Device("door").Code)
+
+	// but cannot be used for a new device
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	other := NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = other.PlanImport(exported)
+	assert.EqualError(t, err,
+		"device door has a redacted code and no existing code")
+}
+
+func Test_ImportError(t *testing.T) {
+	tests := []struct {
+		name string
+		cfgs map[string]Config
+		want ValidationErrors
+	}{
+		{
+			name: "claimed relay",
+			cfgs: map[string]Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r5"}},
+			},
+			want: ValidationErrors{
+				{"door", "def[0]", "udin_8r-r5", "relay already used by vent"},
+			},
+		},
+		{
+			name: "group member changes kind",
+			cfgs: map[string]Config{
+				"blind1": {Kind: "2", Def: []string{"udin_8r-r1"}},
+			},
+			want: ValidationErrors{
+				{"blinds", "def[1]", "blind2",
+					"group members must all be of type electriclock"},
+			},
+		},
+		{
+			name: "bad kind",
+			cfgs: map[string]Config{
+				"x": {Kind: "toaster"},
+			},
+			want: ValidationErrors{
+				{"x", "kind", "toaster", "unsupported device kind"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			devs := testDevices(t)
+			before := devs.Configs()
+			_, err := devs.Import(tc.cfgs)
+			var verrs ValidationErrors
+			assert.True(t, errors.As(err, &verrs), "%v", err)
+			assert.Equal(t, tc.want, verrs)
+			assert.Equal(t, before, devs.Configs())
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError describes a problem with one field of a device
+// definition. Field is "name", "kind" or "def[<index>]".
+type ValidationError struct {
+	Device string `json:"device"`
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("device %s: %s %q: %s",
+		e.Device, e.Field, e.Value, e.Reason)
+}
+
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+const invalidNameReason = "name must be non-empty and contain no " +
+	"spaces, '/', '+' or '#'"
+
+const nameInUseReason = "name already used by a meter"
+
+const reservedNameReason = "name " + BridgeName + " is reserved for the bridge"
+
+// validName returns true if name can be used in MQTT topics.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/+# ")
+}
+
+// nameInUse returns true if a new device may not be called name as it
+// is used by another entity. The caller must hold the lock.
+func (d *Devices) nameInUse(name string) bool {
+	return d.names != nil && d.names.NameInUse(name)
+}
+
+// Relays returns the relays referenced by the definition of the device.
+func (d *Device) Relays() []string {
+	if t := d.Type.deviceType(); t != nil {
+		return t.Relays(d)
+	}
+	return nil
+}
+
+// IsGroupKind returns true if kind refers to the DeviceGroup type so
+// that groups can be created after the devices they refer to.
+func IsGroupKind(kind string) bool {
+	t, err := kindFromArg(kind)
+	return err == nil && t == DeviceGroup
+}
+
+// ValidateDevice checks that the named device exists.
+func (d *Devices) ValidateDevice(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dev[name] == nil {
+		return unknownDevice(name)
+	}
+	return nil
+}
+
+// ValidateInput checks that the input is on one of the UDIN devices.
+func (d *Devices) ValidateInput(input string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, i, err := ParseInput(input)
+	if err != nil {
+		return err
+	}
+	if num, ok := d.numInputs[u]; !ok || i < 1 || i > num {
+		return fmt.Errorf("invalid input %s", input)
+	}
+	return nil
+}
+
+func unknownDevice(name string) ValidationErrors {
+	return ValidationErrors{
+		{Device: name, Field: "name", Value: name,
+			Reason: "unknown device " + name},
+	}
+}
+
+// Validate checks a definition of the form name, kind, def... against
+// the available UDIN devices and the relays claimed by other devices.
+// It returns ValidationErrors describing every problem found.
+func (d *Devices) Validate(def []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.validate(def)
+}
+
+func (d *Devices) validate(def []string) error {
+	v := &Validation{devices: d.dev, numInputs: d.numInputs}
+	if len(def) > 0 {
+		v.name = def[0]
+	}
+	if len(def) < 2 {
+		v.Add("kind", "", "missing device kind")
+		return v.errs
+	}
+	name := def[0]
+	if !validName(name) {
+		v.Add("name", name, invalidNameReason)
+	} else if name == BridgeName {
+		v.Add("name", name, reservedNameReason)
+	} else if d.dev[name] == nil && d.nameInUse(name) {
+		v.Add("name", name, nameInUseReason)
+	}
+	t, err := kindFromArg(def[1])
+	if err != nil {
+		v.Add("kind", def[1], "unsupported device kind")
+		return v.errs
+	}
+	dev := &Device{Name: name, Type: t, Def: def[2:]}
+	t.deviceType().Validate(dev, v)
+	claimed := d.claimedRelays(name)
+	seen := map[string]bool{}
+	for i, relay := range dev.Relays() {
+		field := fmt.Sprintf("def[%d]", i)
+		u, r, err := parseRelay(relay)
+		if err != nil {
+			v.Add(field, relay, "invalid relay, expected <udin>-r<number>")
+			continue
+		}
+		num, ok := d.numRelays[u]
+		switch {
+		case !ok:
+			v.Add(field, relay, "unknown UDIN device "+u)
+		case r < 1 || r > num:
+			v.Add(field, relay,
+				fmt.Sprintf("relay must be between 1 and %d", num))
+		case seen[relay]:
+			v.Add(field, relay, "relay used more than once")
+		case claimed[relay] != "":
+			v.Add(field, relay, "relay already used by "+claimed[relay])
+		}
+		seen[relay] = true
+	}
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// claimedRelays returns a map of relay names to the name of the device
+// using them excluding the named device.
+func (d *Devices) claimedRelays(exclude string) map[string]string {
+	claimed := map[string]string{}
+	for name, dev := range d.dev {
+		if name == exclude {
+			continue
+		}
+		for _, relay := range dev.Relays() {
+			claimed[relay] = name
+		}
+	}
+	return claimed
+}
@@ -0,0 +1,196 @@
+package devices
+
+import (
+	"testing"
+
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Validate(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	u8i, err := udin.NewUdin("mock:UDIN-8I", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{
+		"udin_8r": u8r,
+		"udin_8i": u8i,
+	}
+	devs := NewDevices(udins)
+	_, err = devs.Create(
+		[]string{"blind", "0", "udin_8r-r1", "udin_8r-r2"}, true, "")
+	assert.NoError(t, err)
+	_, err = devs.Create([]string{"door", "2", "udin_8r-r3"}, true, "")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		def  []string
+		want ValidationErrors
+	}{
+		{
+			name: "valid cover",
+			def:  []string{"blind2", "0", "udin_8r-r4", "udin_8r-r5"},
+		},
+		{
+			name: "valid redefinition",
+			def:  []string{"blind", "0", "udin_8r-r2", "udin_8r-r1"},
+		},
+		{
+			name: "valid group",
+			def:  []string{"blinds", "group", "blind", "stagger=1s"},
+		},
+		{
+			name: "missing kind",
+			def:  []string{"blind2"},
+			want: ValidationErrors{
+				{"blind2", "kind", "", "missing device kind"},
+			},
+		},
+		{
+			name: "bad kind",
+			def:  []string{"blind2", "99"},
+			want: ValidationErrors{
+				{"blind2", "kind", "99", "unsupported device kind"},
+			},
+		},
+		{
+			name: "bad name",
+			def:  []string{"a/b", "2", "udin_8r-r4"},
+			want: ValidationErrors{
+				{"a/b", "name", "a/b", "name must be non-empty and " +
+					"contain no spaces, '/', '+' or '#'"},
+			},
+		},
+		{
+			name: "reserved name",
+			def:  []string{"bridge", "2", "udin_8r-r4"},
+			want: ValidationErrors{
+				{"bridge", "name", "bridge",
+					"name bridge is reserved for the bridge"},
+			},
+		},
+		{
+			name: "malformed relays",
+			def:  []string{"blind2", "0", "udin_8r", "udin_8r-x1"},
+			want: ValidationErrors{
+				{"blind2", "def[0]", "udin_8r",
+					"invalid relay, expected <udin>-r<number>"},
+				{"blind2", "def[1]", "udin_8r-x1",
+					"invalid relay, expected <udin>-r<number>"},
+			},
+		},
+		{
+			name: "unknown udin and out of range relay",
+			def:  []string{"blind2", "0", "udin_44-r1", "udin_8r-r9"},
+			want: ValidationErrors{
+				{"blind2", "def[0]", "udin_44-r1",
+					"unknown UDIN device udin_44"},
+				{"blind2", "def[1]", "udin_8r-r9",
+					"relay must be between 1 and 8"},
+			},
+		},
+		{
+			name: "input only udin",
+			def:  []string{"door2", "2", "udin_8i-r1"},
+			want: ValidationErrors{
+				{"door2", "def[0]", "udin_8i-r1",
+					"relay must be between 1 and 0"},
+			},
+		},
+		{
+			name: "claimed relay",
+			def:  []string{"blind2", "0", "udin_8r-r3", "udin_8r-r4"},
+			want: ValidationErrors{
+				{"blind2", "def[0]", "udin_8r-r3",
+					"relay already used by door"},
+			},
+		},
+		{
+			name: "duplicate relay",
+			def:  []string{"vent", "1", "udin_8r-r4", "udin_8r-r4"},
+			want: ValidationErrors{
+				{"vent", "def[1]", "udin_8r-r4", "relay used more than once"},
+			},
+		},
+		{
+			name: "wrong relay count",
+			def:  []string{"blind2", "0", "udin_8r-r4"},
+			want: ValidationErrors{
+				{"blind2", "def", "udin_8r-r4",
+					"expected open and close relays"},
+			},
+		},
+		{
+			name: "empty fan",
+			def:  []string{"vent", "1"},
+			want: ValidationErrors{
+				{"vent", "def", "", "expected at least one relay"},
+			},
+		},
+		{
+			name: "bad unlock time",
+			def:  []string{"door2", "2", "udin_8r-r4", "-1s"},
+			want: ValidationErrors{
+				{"door2", "def[1]", "-1s", "invalid unlock time"},
+			},
+		},
+		{
+			name: "bad group",
+			def: []string{"all", "group",
+				"blind", "door", "nope", "stagger=x"},
+			want: ValidationErrors{
+				{"all", "def[1]", "door",
+					"group members must all be of type momentaryopenclose"},
+				{"all", "def[2]", "nope", "unknown device"},
+				{"all", "def[3]", "stagger=x", "invalid stagger duration"},
+			},
+		},
+		{
+			name: "empty group",
+			def:  []string{"all", "group"},
+			want: ValidationErrors{
+				{"all", "def", "", "expected at least one member device"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := devs.Validate(tc.def)
+			if tc.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tc.want, err)
+			_, err = devs.Create(tc.def, false, "")
+			assert.Equal(t, tc.want, err)
+		})
+	}
+
+	assert.Equal(t,
+		`device x: def[0] "y": bad; device x: name "x": worse`,
+		ValidationErrors{
+			{"x", "def[0]", "y", "bad"},
+			{"x", "name", "x", "worse"},
+		}.Error())
+}
+
+func Test_ValidateInput(t *testing.T) {
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	devs := NewDevices(map[string]*udin.UdinDevice{"udin_44": u44})
+	assert.NoError(t, devs.ValidateInput("udin_44-i4"))
+	assert.EqualError(t, devs.ValidateInput("udin_44-i5"),
+		"invalid input udin_44-i5")
+	assert.EqualError(t, devs.ValidateInput("udin_8r-i1"),
+		"invalid input udin_8r-i1")
+	assert.EqualError(t, devs.ValidateInput("udin_44-r1"),
+		"invalid input udin_44-r1")
+}
+
+func Test_IsGroupKind(t *testing.T) {
+	assert.True(t, IsGroupKind("group"))
+	assert.True(t, IsGroupKind("3"))
+	assert.False(t, IsGroupKind("0"))
+	assert.False(t, IsGroupKind("bogus"))
+}
@@ -0,0 +1,236 @@
+// Package diag reports the state of the bridge, its UDIN devices and
+// recent errors as a retained diagnostics message.
+package diag
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	devs "github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+)
+
+// Error kinds counted in the state.
+const (
+	// CommandError is a device command that failed.
+	CommandError = "command"
+	// UdinError is a request to a UDIN device that failed.
+	UdinError = "udin"
+)
+
+// RecentWindow is how long errors are counted as recent.
+const RecentWindow = time.Hour
+
+// Udin is the state of a UDIN device.
+type Udin struct {
+	Model     string `json:"model"`
+	Relays    uint   `json:"relays"`
+	Inputs    uint   `json:"inputs"`
+	Healthy   bool   `json:"healthy"`
+	Errors    uint64 `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Device is the state of a device.
+type Device struct {
+	Kind    string `json:"kind"`
+	Enabled bool   `json:"enabled"`
+}
+
+// State is the body of the retained <bridge>/bridge/state message.
+type State struct {
+	Version string            `json:"version"`
+	Uptime  int64             `json:"uptime"`
+	Udins   map[string]Udin   `json:"udins"`
+	Devices map[string]Device `json:"devices"`
+	// Errors are the errors of each kind within the RecentWindow
+	Errors       map[string]int `json:"errors"`
+	RecentErrors int            `json:"recent_errors"`
+}
+
+// Diagnostics tracks the state of the bridge.
+type Diagnostics struct {
+	clock   clock.Clock
+	version string
+	started time.Time
+	udins   map[string]*udin.UdinDevice
+	devices *devs.Devices
+	mu      sync.Mutex
+	errors  map[string][]time.Time
+	// health is the last seen health of each UDIN so that new failures
+	// are counted as recent errors
+	health map[string]udin.Health
+	dirty  bool
+}
+
+// New creates the diagnostics of a bridge started now.
+func New(c clock.Clock, version string, udins map[string]*udin.UdinDevice,
+	devices *devs.Devices) *Diagnostics {
+	d := &Diagnostics{
+		clock:   c,
+		version: version,
+		started: c.Now(),
+		udins:   udins,
+		devices: devices,
+		errors:  make(map[string][]time.Time),
+		health:  make(map[string]udin.Health),
+	}
+	for name, u := range udins {
+		d.health[name] = u.Health()
+	}
+	return d
+}
+
+// Record counts an error of the given kind.
+func (d *Diagnostics) Record(kind string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors[kind] = append(d.errors[kind], d.clock.Now())
+	d.dirty = true
+}
+
+// Changed reports whether errors were recorded or the health of a UDIN
+// changed since it was last called.
+func (d *Diagnostics) Changed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sample()
+	dirty := d.dirty
+	d.dirty = false
+	return dirty
+}
+
+// sample records the UDIN failures since the last sample.
+func (d *Diagnostics) sample() {
+	now := d.clock.Now()
+	for name, u := range d.udins {
+		h := u.Health()
+		last := d.health[name]
+		for i := last.Errors; i < h.Errors; i++ {
+			d.errors[UdinError] = append(d.errors[UdinError], now)
+		}
+		if h != last {
+			d.health[name] = h
+			d.dirty = true
+		}
+	}
+}
+
+// State returns the current state of the bridge.
+func (d *Diagnostics) State() State {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sample()
+	now := d.clock.Now()
+	st := State{
+		Version: d.version,
+		Uptime:  int64(now.Sub(d.started) / time.Second),
+		Udins:   map[string]Udin{},
+		Devices: map[string]Device{},
+		Errors:  map[string]int{CommandError: 0, UdinError: 0},
+	}
+	for name, u := range d.udins {
+		h := d.health[name]
+		st.Udins[name] = Udin{
+			Model:     u.Model(),
+			Relays:    u.NumRelays(),
+			Inputs:    u.NumInputs(),
+			Healthy:   h.Healthy,
+			Errors:    h.Errors,
+			LastError: h.LastError,
+		}
+	}
+	for _, dev := range d.devices.Devices() {
+		st.Devices[dev.Name] = Device{
+			Kind:    dev.Type.String(),
+			Enabled: dev.Enabled,
+		}
+	}
+	since := now.Add(-RecentWindow)
+	for kind, times := range d.errors {
+		i := sort.Search(len(times), func(i int) bool {
+			return times[i].After(since)
+		})
+		d.errors[kind] = times[i:]
+		st.Errors[kind] = len(times) - i
+		st.RecentErrors += len(times) - i
+	}
+	return st
+}
+
+// StateTopic is the topic of the bridge state.
+func StateTopic(cfg types.SimpleStringConfig) string {
+	return mqtt.StateTopic(cfg.GetString("Bridge_Topic"), "bridge")
+}
+
+// StateMessage returns the retained bridge state message.
+func (d *Diagnostics) StateMessage(cfg types.SimpleStringConfig) *mqtt.Msg {
+	return &mqtt.Msg{Topic: StateTopic(cfg), Body: d.State(), Retain: true}
+}
+
+// DiscoveryMessages returns the discovery messages of the diagnostic
+// sensors of the bridge state: the version, uptime and recent errors of
+// the bridge and a problem sensor for each UDIN.
+func (d *Diagnostics) DiscoveryMessages(cfg types.SimpleStringConfig) []*mqtt.Msg {
+	prefix := cfg.GetString("Discovery_Prefix")
+	availability := []ha.Availability{
+		{Topic: mqtt.AvailabilityTopic(cfg.GetString("Bridge_Topic"),
+			"bridge")},
+	}
+	id := devs.BridgeID(cfg)
+	sensor := func(name, icon, unit, class, tmpl string) *mqtt.Msg {
+		return &mqtt.Msg{
+			Topic: mqtt.ConfigTopic(prefix, "sensor", id, name),
+			Body: ha.Sensor{
+				Availability:      availability,
+				Device:            ha.Device{Identifiers: []string{id}},
+				DeviceClass:       ha.DeviceClass(class),
+				EntityCategory:    ha.DiagnosticEntity,
+				Icon:              icon,
+				Name:              id + " " + name,
+				StateTopic:        StateTopic(cfg),
+				UniqueID:          id + "_" + name,
+				UnitOfMeasurement: unit,
+				ValueTemplate:     tmpl,
+			},
+			Retain: true,
+		}
+	}
+	res := []*mqtt.Msg{
+		sensor("version", "mdi:information-outline", "", "",
+			"{{ value_json.version }}"),
+		sensor("uptime", "mdi:timer-outline", "s", "duration",
+			"{{ value_json.uptime }}"),
+		sensor("recent_errors", "mdi:alert-circle-outline", "", "",
+			"{{ value_json.recent_errors }}"),
+	}
+	names := make([]string, 0, len(d.udins))
+	for name := range d.udins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		uid := devs.UdinID(cfg, name)
+		res = append(res, &mqtt.Msg{
+			Topic: mqtt.ConfigTopic(prefix, "binary_sensor", uid, "problem"),
+			Body: ha.BinarySensor{
+				Availability:   availability,
+				Device:         ha.Device{Identifiers: []string{uid}},
+				DeviceClass:    "problem",
+				EntityCategory: ha.DiagnosticEntity,
+				Name:           name + " problem",
+				StateTopic:     StateTopic(cfg),
+				UniqueID:       uid + "_problem",
+				ValueTemplate: "{{ 'OFF' if value_json.udins." + name +
+					".healthy else 'ON' }}",
+			},
+			Retain: true,
+		})
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package diag
+
+import (
+	"testing"
+	"time"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	devs "github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockCfg map[string]string
+
+func (cfg MockCfg) GetString(k string) string {
+	return cfg[k]
+}
+
+var start = time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+var cfg = MockCfg{
+	"Bridge_Topic":     "udin",
+	"Discovery_Prefix": "homeassistant",
+}
+
+func testDiagnostics(t *testing.T) (*Diagnostics, *udin.UdinDevice,
+	*clock.Fake) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{"udin_8r": u8r}
+	devices := devs.NewDevices(udins)
+	assert.NoError(t, devices.Load(map[string]devs.Config{
+		"door": {Kind: "electriclock", Def: []string{"udin_8r-r1"},
+			Enabled: true},
+		"blind": {Kind: "momentaryopenclose",
+			Def: []string{"udin_8r-r2", "udin_8r-r3"}},
+	}))
+	fake := clock.NewFake(start)
+	return New(fake, "1.2.3", udins, devices), u8r, fake
+}
+
+func Test_State(t *testing.T) {
+	d, u8r, fake := testDiagnostics(t)
+	assert.False(t, d.Changed())
+	fake.Advance(90 * time.Second)
+	assert.Equal(t, State{
+		Version: "1.2.3",
+		Uptime:  90,
+		Udins: map[string]Udin{
+			"udin_8r": {Model: "UDIN-8R 8 x Relay V1.0", Relays: 8,
+				Healthy: true},
+		},
+		Devices: map[string]Device{
+			"door":  {Kind: "electriclock", Enabled: true},
+			"blind": {Kind: "momentaryopenclose"},
+		},
+		Errors: map[string]int{CommandError: 0, UdinError: 0},
+	}, d.State())
+
+	d.Record(CommandError)
+	assert.True(t, d.Changed())
+	assert.False(t, d.Changed())
+	assert.NoError(t, u8r.Close())
+	assert.Error(t, u8r.On(1))
+	assert.True(t, d.Changed(), "UDIN became unhealthy")
+	fake.Advance(30 * time.Minute)
+	assert.Error(t, u8r.On(1))
+	st := d.State()
+	assert.False(t, st.Udins["udin_8r"].Healthy)
+	assert.Equal(t, uint64(2), st.Udins["udin_8r"].Errors)
+	assert.Contains(t, st.Udins["udin_8r"].LastError, "udin write failed")
+	assert.Equal(t, map[string]int{CommandError: 1, UdinError: 2}, st.Errors)
+	assert.Equal(t, 3, st.RecentErrors)
+
+	fake.Advance(45 * time.Minute)
+	st = d.State()
+	assert.Equal(t, map[string]int{CommandError: 0, UdinError: 1}, st.Errors,
+		"earlier errors are no longer recent")
+	assert.Equal(t, 1, st.RecentErrors)
+	assert.Equal(t, uint64(2), st.Udins["udin_8r"].Errors)
+}
+
+func Test_Messages(t *testing.T) {
+	d, u8r, _ := testDiagnostics(t)
+	defer u8r.Close()
+	msg := d.StateMessage(cfg)
+	assert.Equal(t, "udin/bridge/state", msg.Topic)
+	assert.True(t, msg.Retain)
+	assert.Equal(t, "1.2.3", msg.Body.(State).Version)
+
+	msgs := d.DiscoveryMessages(cfg)
+	topics := []string{}
+	for _, m := range msgs {
+		topics = append(topics, m.Topic)
+		assert.True(t, m.Retain)
+	}
+	assert.Equal(t, []string{
+		"homeassistant/sensor/udin_bridge_version/config",
+		"homeassistant/sensor/udin_bridge_uptime/config",
+		"homeassistant/sensor/udin_bridge_recent_errors/config",
+		"homeassistant/binary_sensor/udin_udin_8r_problem/config",
+	}, topics)
+	uptime := msgs[1].Body.(ha.Sensor)
+	assert.Equal(t, ha.DiagnosticEntity, uptime.EntityCategory)
+	assert.Equal(t, "udin/bridge/state", uptime.StateTopic)
+	assert.Equal(t, []string{"udin_bridge"}, uptime.Device.Identifiers)
+	assert.Equal(t, "{{ value_json.uptime }}", uptime.ValueTemplate)
+	problem := msgs[3].Body.(ha.BinarySensor)
+	assert.Equal(t, "problem", problem.DeviceClass)
+	assert.Equal(t, []string{"udin_udin_8r"}, problem.Device.Identifiers)
+	assert.Equal(t,
+		"{{ 'OFF' if value_json.udins.udin_8r.healthy else 'ON' }}",
+		problem.ValueTemplate)
+}
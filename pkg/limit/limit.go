@@ -0,0 +1,335 @@
+// Package limit rate limits the commands sent to devices so that a
+// flood of commands does not make the relays chatter.
+package limit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+)
+
+// Policies for commands that arrive within the interval of the
+// previous command to a device.
+const (
+	// Drop discards the command.
+	Drop = "drop"
+	// Coalesce keeps only the latest command and runs it once the
+	// interval has passed.
+	Coalesce = "coalesce"
+	// Queue runs every command, one per interval, up to the queue
+	// length of the limiter.
+	Queue = "queue"
+)
+
+// Policies are the valid policies.
+var Policies = []string{Drop, Coalesce, Queue}
+
+// DefaultPolicy is shown in place of the empty policy of a limit that
+// uses the policy of the bridge.
+const DefaultPolicy = "default"
+
+// DefaultQueueLength is the number of commands queued for a device by
+// default.
+const DefaultQueueLength = 10
+
+// Limit is the minimum interval between commands to a device and the
+// policy for commands that arrive sooner. A zero interval is no limit
+// and an empty policy is the default policy of the bridge.
+type Limit struct {
+	Interval time.Duration
+	Policy   string
+}
+
+// Validate checks the interval and policy of a limit.
+func (l Limit) Validate() error {
+	if l.Interval < 0 {
+		return fmt.Errorf("invalid interval %s", l.Interval)
+	}
+	if l.Policy == "" {
+		return nil
+	}
+	for _, p := range Policies {
+		if l.Policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid policy %q, expected %s, %s or %s",
+		l.Policy, Drop, Coalesce, Queue)
+}
+
+func (l Limit) String() string {
+	if l.Interval == 0 {
+		return "none"
+	}
+	if l.Policy == "" {
+		return fmt.Sprintf("%s %s", l.Interval, DefaultPolicy)
+	}
+	return fmt.Sprintf("%s %s", l.Interval, l.Policy)
+}
+
+// Result is what happened to a submitted command.
+type Result int
+
+const (
+	// Run means the command should be run now.
+	Run Result = iota
+	// Deferred means the command will be sent by Run later.
+	Deferred
+	// Dropped means the command was discarded.
+	Dropped
+)
+
+// Command is a deferred command that is now due.
+type Command struct {
+	Device  string
+	Command string
+}
+
+type device struct {
+	last     time.Time
+	interval time.Duration
+	pending  []string
+	dropped  uint64
+}
+
+// Limiter applies the limits of devices to their commands.
+type Limiter struct {
+	clock    clock.Clock
+	queueLen int
+	mu       sync.Mutex
+	devices  map[string]*device
+	dirty    bool
+	wake     chan struct{}
+	// total counts the commands dropped for every device including
+	// deleted ones so that it never decreases
+	total uint64
+}
+
+// New creates a limiter that queues at most queueLen commands for each
+// device.
+func New(c clock.Clock, queueLen int) *Limiter {
+	return &Limiter{
+		clock:    c,
+		queueLen: queueLen,
+		devices:  make(map[string]*device),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Submit applies the limit l of a device to a command. Commands that
+// are run must be run straight away so that the interval is measured
+// from when they ran.
+func (lm *Limiter) Submit(name, cmd string, l Limit) Result {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	now := lm.clock.Now()
+	dev, ok := lm.devices[name]
+	if !ok {
+		dev = &device{}
+		lm.devices[name] = dev
+	}
+	if l.Interval <= 0 {
+		// earlier commands may have been limited before the limit
+		// was removed
+		if len(dev.pending) > 0 {
+			lm.drop(dev, len(dev.pending))
+			dev.pending = nil
+		}
+		dev.last = now
+		return Run
+	}
+	dev.interval = l.Interval
+	if len(dev.pending) == 0 && !now.Before(dev.last.Add(l.Interval)) {
+		dev.last = now
+		return Run
+	}
+	switch l.Policy {
+	case Coalesce:
+		if len(dev.pending) > 0 {
+			lm.drop(dev, len(dev.pending))
+		}
+		dev.pending = []string{cmd}
+	case Queue:
+		if len(dev.pending) >= lm.queueLen {
+			lm.drop(dev, 1)
+			return Dropped
+		}
+		dev.pending = append(dev.pending, cmd)
+	default:
+		lm.drop(dev, 1)
+		return Dropped
+	}
+	select {
+	case lm.wake <- struct{}{}:
+	default:
+	}
+	return Deferred
+}
+
+// drop counts n commands dropped for dev. It must be called with lm.mu
+// held.
+func (lm *Limiter) drop(dev *device, n int) {
+	dev.dropped += uint64(n)
+	lm.total += uint64(n)
+	lm.dirty = true
+}
+
+// Due returns the deferred commands that are due at time now recording
+// them as run.
+func (lm *Limiter) Due(now time.Time) []Command {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	names := make([]string, 0, len(lm.devices))
+	for name, dev := range lm.devices {
+		if len(dev.pending) > 0 && !now.Before(dev.last.Add(dev.interval)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res := []Command{}
+	for _, name := range names {
+		dev := lm.devices[name]
+		res = append(res, Command{Device: name, Command: dev.pending[0]})
+		dev.pending = dev.pending[1:]
+		dev.last = now
+	}
+	return res
+}
+
+// next returns when the next deferred command is due.
+func (lm *Limiter) next() (time.Time, bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	var next time.Time
+	found := false
+	for _, dev := range lm.devices {
+		if len(dev.pending) == 0 {
+			continue
+		}
+		at := dev.last.Add(dev.interval)
+		if !found || at.Before(next) {
+			next, found = at, true
+		}
+	}
+	return next, found
+}
+
+// Run sends deferred commands when they are due until ctx is done.
+func (lm *Limiter) Run(ctx context.Context, out chan<- Command) {
+	for {
+		var due <-chan time.Time
+		if at, ok := lm.next(); ok {
+			due = lm.clock.After(at.Sub(lm.clock.Now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-lm.wake:
+			continue
+		case <-due:
+		}
+		for _, c := range lm.Due(lm.clock.Now()) {
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// RenameDevice moves the pending commands and counters of a renamed
+// device.
+func (lm *Limiter) RenameDevice(oldName, newName string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if dev, ok := lm.devices[oldName]; ok {
+		delete(lm.devices, oldName)
+		lm.devices[newName] = dev
+		lm.dirty = true
+	}
+}
+
+// DeleteDevice discards the pending commands and counters of a deleted
+// device. Its dropped commands stay in the total.
+func (lm *Limiter) DeleteDevice(name string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if _, ok := lm.devices[name]; ok {
+		delete(lm.devices, name)
+		lm.dirty = true
+	}
+}
+
+// Stats is the body of the dropped commands diagnostic message.
+type Stats struct {
+	Total   uint64            `json:"total"`
+	Devices map[string]uint64 `json:"devices"`
+}
+
+// Stats returns the number of commands dropped for each device and in
+// total since the bridge started.
+func (lm *Limiter) Stats() Stats {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	st := Stats{Total: lm.total, Devices: map[string]uint64{}}
+	for name, dev := range lm.devices {
+		if dev.dropped > 0 {
+			st.Devices[name] = dev.dropped
+		}
+	}
+	return st
+}
+
+// Changed reports whether commands were dropped since it was last
+// called.
+func (lm *Limiter) Changed() bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	dirty := lm.dirty
+	lm.dirty = false
+	return dirty
+}
+
+// StatsTopic is the topic of the dropped commands diagnostic.
+func StatsTopic(cfg types.SimpleStringConfig) string {
+	return cfg.GetString("Bridge_Topic") + "/bridge/dropped_commands"
+}
+
+// DiscoveryMessage returns the discovery message of the diagnostic
+// sensor of the bridge device bridgeID that counts dropped commands.
+func DiscoveryMessage(cfg types.SimpleStringConfig, bridgeID string) *mqtt.Msg {
+	return &mqtt.Msg{
+		Topic: mqtt.ConfigTopic(cfg.GetString("Discovery_Prefix"),
+			"sensor", bridgeID, "dropped_commands"),
+		Body: ha.Sensor{
+			Availability: []ha.Availability{
+				{Topic: mqtt.AvailabilityTopic(
+					cfg.GetString("Bridge_Topic"), "bridge")},
+			},
+			Device:                 ha.Device{Identifiers: []string{bridgeID}},
+			EntityCategory:         ha.DiagnosticEntity,
+			Icon:                   "mdi:cancel",
+			JSONAttributesTopic:    StatsTopic(cfg),
+			JSONAttributesTemplate: "{{ value_json.devices | tojson }}",
+			Name:                   bridgeID + " dropped commands",
+			StateClass:             "total_increasing",
+			StateTopic:             StatsTopic(cfg),
+			UniqueID:               bridgeID + "_dropped_commands",
+			ValueTemplate:          "{{ value_json.total }}",
+		},
+		Retain: true,
+	}
+}
+
+// StatsMessage returns the dropped commands diagnostic message.
+func (lm *Limiter) StatsMessage(cfg types.SimpleStringConfig) *mqtt.Msg {
+	return &mqtt.Msg{Topic: StatsTopic(cfg), Body: lm.Stats(), Retain: true}
+}
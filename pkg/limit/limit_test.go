@@ -0,0 +1,150 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockCfg map[string]string
+
+func (cfg MockCfg) GetString(k string) string {
+	return cfg[k]
+}
+
+var start = time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+func Test_Validate(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  string
+	}{
+		{Limit{}, ""},
+		{Limit{Interval: time.Second, Policy: Drop}, ""},
+		{Limit{Interval: -time.Second, Policy: Drop}, "invalid interval -1s"},
+		{Limit{Interval: time.Second}, ""},
+		{Limit{Interval: time.Second, Policy: "ignore"},
+			`invalid policy "ignore", expected drop, coalesce or queue`},
+	}
+	for _, tc := range tests {
+		err := tc.limit.Validate()
+		if tc.want == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.EqualError(t, err, tc.want)
+	}
+	assert.Equal(t, "none", Limit{}.String())
+	assert.Equal(t, "1s queue", Limit{Interval: time.Second,
+		Policy: Queue}.String())
+	assert.Equal(t, "1s default", Limit{Interval: time.Second}.String())
+}
+
+func Test_Submit(t *testing.T) {
+	fake := clock.NewFake(start)
+	lm := New(fake, 2)
+	drop := Limit{Interval: time.Second, Policy: Drop}
+	coalesce := Limit{Interval: time.Second, Policy: Coalesce}
+	queue := Limit{Interval: time.Second, Policy: Queue}
+	tests := []struct {
+		name   string
+		device string
+		cmd    string
+		limit  Limit
+		at     time.Duration
+		want   Result
+	}{
+		{"unlimited", "light", "on", Limit{}, 0, Run},
+		{"unlimited again", "light", "off", Limit{}, 0, Run},
+		{"first", "fan", "on", drop, 0, Run},
+		{"too soon", "fan", "off", drop, 500 * time.Millisecond, Dropped},
+		{"interval passed", "fan", "off", drop, time.Second, Run},
+		{"first", "blind", "open", coalesce, 0, Run},
+		{"coalesced", "blind", "close", coalesce, 100 * time.Millisecond,
+			Deferred},
+		{"coalesced again", "blind", "stop", coalesce,
+			200 * time.Millisecond, Deferred},
+		{"first", "lock", "lock", queue, 0, Run},
+		{"queued", "lock", "unlock", queue, 100 * time.Millisecond, Deferred},
+		{"queued again", "lock", "lock", queue, 200 * time.Millisecond,
+			Deferred},
+		{"queue full", "lock", "unlock", queue, 300 * time.Millisecond,
+			Dropped},
+	}
+	for _, tc := range tests {
+		fake.Advance(start.Add(tc.at).Sub(fake.Now()))
+		assert.Equal(t, tc.want, lm.Submit(tc.device, tc.cmd, tc.limit),
+			tc.name+" "+tc.device)
+	}
+	assert.Equal(t, Stats{Total: 3, Devices: map[string]uint64{
+		"fan": 1, "blind": 1, "lock": 1}}, lm.Stats())
+	assert.True(t, lm.Changed())
+	assert.False(t, lm.Changed())
+
+	assert.Empty(t, lm.Due(start.Add(900*time.Millisecond)))
+	assert.Equal(t, []Command{
+		{Device: "blind", Command: "stop"},
+		{Device: "lock", Command: "unlock"},
+	}, lm.Due(start.Add(time.Second)))
+	assert.Empty(t, lm.Due(start.Add(1500*time.Millisecond)))
+	assert.Equal(t, []Command{{Device: "lock", Command: "lock"}},
+		lm.Due(start.Add(2*time.Second)))
+	assert.Empty(t, lm.Due(start.Add(time.Hour)))
+
+	lm.RenameDevice("lock", "door")
+	lm.DeleteDevice("fan")
+	assert.Equal(t, Stats{Total: 3, Devices: map[string]uint64{
+		"blind": 1, "door": 1}}, lm.Stats(),
+		"the total keeps the commands dropped for deleted devices")
+}
+
+func Test_Run(t *testing.T) {
+	fake := clock.NewFake(start)
+	lm := New(fake, DefaultQueueLength)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan Command, 10)
+	done := make(chan struct{})
+	go func() {
+		lm.Run(ctx, out)
+		close(done)
+	}()
+	queue := Limit{Interval: time.Second, Policy: Queue}
+	assert.Equal(t, Run, lm.Submit("lock", "lock", queue))
+	assert.Equal(t, Deferred, lm.Submit("lock", "unlock", queue))
+	assert.Equal(t, Deferred, lm.Submit("lock", "lock", queue))
+	for _, want := range []string{"unlock", "lock"} {
+		fake.BlockUntil(1)
+		fake.Advance(time.Second)
+		assert.Equal(t, Command{Device: "lock", Command: want}, <-out)
+	}
+	cancel()
+	<-done
+}
+
+func Test_Messages(t *testing.T) {
+	cfg := MockCfg{
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+	}
+	msg := DiscoveryMessage(cfg, "udin_bridge")
+	assert.Equal(t,
+		"homeassistant/sensor/udin_bridge_dropped_commands/config", msg.Topic)
+	sensor := msg.Body.(ha.Sensor)
+	assert.Equal(t, ha.DiagnosticEntity, sensor.EntityCategory)
+	assert.Equal(t, "udin/bridge/dropped_commands", sensor.StateTopic)
+	assert.Equal(t, []string{"udin_bridge"}, sensor.Device.Identifiers)
+
+	lm := New(clock.NewFake(start), 1)
+	lm.Submit("fan", "on", Limit{Interval: time.Second, Policy: Drop})
+	lm.Submit("fan", "off", Limit{Interval: time.Second, Policy: Drop})
+	assert.Equal(t, &mqtt.Msg{
+		Topic:  "udin/bridge/dropped_commands",
+		Body:   Stats{Total: 1, Devices: map[string]uint64{"fan": 1}},
+		Retain: true,
+	}, lm.StatsMessage(cfg))
+}
@@ -0,0 +1,458 @@
+// Package meter counts pulses on UDIN inputs, such as those from the
+// reed switches of water and gas meters, and publishes the totals and
+// rates as Home Assistant sensors.
+package meter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+)
+
+// DefaultDebounce is used for meters without a debounce time.
+const DefaultDebounce = 100 * time.Millisecond
+
+// Config is the persisted form of a meter on an input. Pulses is the
+// number of pulses counted so far.
+type Config struct {
+	Name          string  `json:"name" yaml:"name"`
+	UnitsPerPulse float64 `json:"units_per_pulse" yaml:"units_per_pulse"`
+	Unit          string  `json:"unit,omitempty" yaml:"unit,omitempty"`
+	DeviceClass   string  `json:"device_class,omitempty" yaml:"device_class,omitempty"`
+	Debounce      string  `json:"debounce,omitempty" yaml:"debounce,omitempty"`
+	Pulses        uint64  `json:"pulses" yaml:"pulses"`
+}
+
+// State is the body of the state message of a meter. Total is in the
+// unit of the meter and Rate is in units per hour.
+type State struct {
+	Total  float64 `json:"total"`
+	Rate   float64 `json:"rate"`
+	Pulses uint64  `json:"pulses"`
+}
+
+// Info describes a meter for the UI.
+type Info struct {
+	Input  string
+	Config Config
+	State  State
+}
+
+type meter struct {
+	cfg      Config
+	debounce time.Duration
+	// on is the debounced state of the input which is unknown until
+	// the first update
+	on    bool
+	known bool
+	// pending is set while a change of state is being debounced
+	pending      bool
+	pendingSince time.Time
+	// pulses are the times of the pulses within the rate window
+	pulses []time.Time
+}
+
+// Meters are the meters on the inputs in counter mode.
+type Meters struct {
+	mu     sync.Mutex
+	window time.Duration
+	meters map[string]*meter
+	dirty  bool
+}
+
+// New creates an empty set of meters that derive rates from the pulses
+// seen in the last window.
+func New(window time.Duration) *Meters {
+	return &Meters{window: window, meters: make(map[string]*meter)}
+}
+
+// Validate checks the config of a meter on input.
+func (m *Meters) Validate(input string, cfg Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.compile(input, cfg)
+	return err
+}
+
+// compile checks the config of a meter on input and returns its
+// debounce time.
+func (m *Meters) compile(input string, cfg Config) (time.Duration, error) {
+	if _, _, err := devices.ParseInput(input); err != nil {
+		return 0, err
+	}
+	if cfg.Name == "" || strings.ContainsAny(cfg.Name, "/+# ") {
+		return 0, fmt.Errorf("invalid meter name %q, name must be "+
+			"non-empty and contain no spaces, '/', '+' or '#'", cfg.Name)
+	}
+	if cfg.Name == devices.BridgeName {
+		return 0, fmt.Errorf("meter name %s is reserved for the bridge",
+			cfg.Name)
+	}
+	for in, mt := range m.meters {
+		if in != input && mt.cfg.Name == cfg.Name {
+			return 0, fmt.Errorf("meter name %s already used by %s",
+				cfg.Name, in)
+		}
+	}
+	if !(cfg.UnitsPerPulse > 0) {
+		return 0, fmt.Errorf("invalid units per pulse %v", cfg.UnitsPerPulse)
+	}
+	if cfg.Debounce == "" {
+		return DefaultDebounce, nil
+	}
+	debounce, err := time.ParseDuration(cfg.Debounce)
+	if err != nil || debounce < 0 {
+		return 0, fmt.Errorf("invalid debounce time %q", cfg.Debounce)
+	}
+	return debounce, nil
+}
+
+// Set adds or changes the meter on input. The count of an existing
+// meter is kept.
+func (m *Meters) Set(input string, cfg Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mt, ok := m.meters[input]; ok {
+		cfg.Pulses = mt.cfg.Pulses
+	}
+	return m.set(input, cfg)
+}
+
+func (m *Meters) set(input string, cfg Config) error {
+	debounce, err := m.compile(input, cfg)
+	if err != nil {
+		return err
+	}
+	mt, ok := m.meters[input]
+	if !ok {
+		mt = &meter{}
+		m.meters[input] = mt
+	}
+	mt.cfg, mt.debounce = cfg, debounce
+	m.dirty = true
+	return nil
+}
+
+// Load adds previously saved meters with their counts.
+func (m *Meters) Load(cfgs map[string]Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inputs := make([]string, 0, len(cfgs))
+	for input := range cfgs {
+		inputs = append(inputs, input)
+	}
+	sort.Strings(inputs)
+	for _, input := range inputs {
+		if err := m.set(input, cfgs[input]); err != nil {
+			return fmt.Errorf("invalid meter on %s: %w", input, err)
+		}
+	}
+	m.dirty = false
+	return nil
+}
+
+// Delete removes the meter on input.
+func (m *Meters) Delete(input string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.meters[input]; !ok {
+		return fmt.Errorf("no meter on %s", input)
+	}
+	delete(m.meters, input)
+	m.dirty = true
+	return nil
+}
+
+// Counts reports whether there is a meter on input.
+func (m *Meters) Counts(input string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.meters[input]
+	return ok
+}
+
+// NameInUse reports whether a meter is called name. Meter states share
+// the topics of device states so devices may not use the same names.
+func (m *Meters) NameInUse(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mt := range m.meters {
+		if mt.cfg.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Config returns the config of the meter on input.
+func (m *Meters) Config(input string) (Config, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt, ok := m.meters[input]
+	if !ok {
+		return Config{}, false
+	}
+	return mt.cfg, true
+}
+
+// Update records the polled state of input at time now and reports
+// whether a pulse was counted. A change of state is only accepted once
+// it has been seen for the debounce time and each accepted rising edge
+// is a pulse. The first state seen only sets the initial state.
+func (m *Meters) Update(input string, on bool, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt, ok := m.meters[input]
+	if !ok {
+		return false
+	}
+	if !mt.known {
+		mt.on, mt.known = on, true
+		return false
+	}
+	if on == mt.on {
+		mt.pending = false
+		return false
+	}
+	if !mt.pending {
+		mt.pending, mt.pendingSince = true, now
+	}
+	if now.Sub(mt.pendingSince) < mt.debounce {
+		return false
+	}
+	mt.on, mt.pending = on, false
+	if !on {
+		return false
+	}
+	mt.cfg.Pulses++
+	mt.pulses = append(mt.prune(now, m.window), now)
+	m.dirty = true
+	return true
+}
+
+// prune returns the pulses of the meter within window of now.
+func (mt *meter) prune(now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(mt.pulses) && now.Sub(mt.pulses[i]) > window {
+		i++
+	}
+	return mt.pulses[i:]
+}
+
+// Changed reports whether counts or configs changed since it was last
+// called and so need to be saved.
+func (m *Meters) Changed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dirty := m.dirty
+	m.dirty = false
+	return dirty
+}
+
+// Configs returns the persisted form of the meters including their
+// current counts.
+func (m *Meters) Configs() map[string]Config {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.meters) == 0 {
+		return nil
+	}
+	res := make(map[string]Config, len(m.meters))
+	for input, mt := range m.meters {
+		res[input] = mt.cfg
+	}
+	return res
+}
+
+// Inputs returns the sorted inputs that have meters.
+func (m *Meters) Inputs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]string, 0, len(m.meters))
+	for input := range m.meters {
+		res = append(res, input)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// State returns the total and the rate over the rate window of the
+// meter on input at time now.
+func (m *Meters) State(input string, now time.Time) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt, ok := m.meters[input]
+	if !ok {
+		return State{}, fmt.Errorf("no meter on %s", input)
+	}
+	return m.state(mt, now), nil
+}
+
+func (m *Meters) state(mt *meter, now time.Time) State {
+	mt.pulses = mt.prune(now, m.window)
+	rate := 0.0
+	if m.window > 0 {
+		rate = float64(len(mt.pulses)) * mt.cfg.UnitsPerPulse /
+			m.window.Hours()
+	}
+	return State{
+		Total:  round(float64(mt.cfg.Pulses) * mt.cfg.UnitsPerPulse),
+		Rate:   round(rate),
+		Pulses: mt.cfg.Pulses,
+	}
+}
+
+// round removes the floating point noise of multiplying counts by
+// fractional units.
+func round(f float64) float64 {
+	return math.Round(f*1e6) / 1e6
+}
+
+// Infos returns the meters and their states for the UI.
+func (m *Meters) Infos() []Info {
+	if m == nil {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []Info{}
+	for input, mt := range m.meters {
+		res = append(res, Info{Input: input, Config: mt.cfg,
+			State: m.state(mt, now)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Input < res[j].Input })
+	return res
+}
+
+// StateTopic is the topic of the retained state of a meter.
+func StateTopic(cfg types.SimpleStringConfig, name string) string {
+	return mqtt.StateTopic(cfg.GetString("Bridge_Topic"), name)
+}
+
+// StateMessage returns the retained state message of the meter on
+// input at time now.
+func (m *Meters) StateMessage(input string, cfg types.SimpleStringConfig,
+	now time.Time) (*mqtt.Msg, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt, ok := m.meters[input]
+	if !ok {
+		return nil, fmt.Errorf("no meter on %s", input)
+	}
+	return &mqtt.Msg{
+		Topic:  StateTopic(cfg, mt.cfg.Name),
+		Body:   m.state(mt, now),
+		Retain: true,
+	}, nil
+}
+
+// DiscoveryMessages returns the discovery messages of the total and
+// rate sensors of the meter on input.
+func (m *Meters) DiscoveryMessages(input string,
+	cfg types.SimpleStringConfig) ([]*mqtt.Msg, error) {
+	c, ok := m.Config(input)
+	if !ok {
+		return nil, fmt.Errorf("no meter on %s", input)
+	}
+	u, _, err := devices.ParseInput(input)
+	if err != nil {
+		return nil, err
+	}
+	prefix := cfg.GetString("Discovery_Prefix")
+	device := ha.Device{
+		Identifiers: []string{c.Name},
+		Name:        c.Name,
+		SwVersion: fmt.Sprintf("%s v%s",
+			cfg.GetString("App_Name"), cfg.GetString("Version")),
+		ConfigurationURL: "http://" + cfg.GetString("UI_Advertise"),
+		ViaDevice:        devices.UdinID(cfg, u),
+	}
+	availability := []ha.Availability{
+		{Topic: mqtt.AvailabilityTopic(
+			cfg.GetString("Bridge_Topic"), "bridge")},
+	}
+	rateUnit := ""
+	if c.Unit != "" {
+		rateUnit = c.Unit + "/h"
+	}
+	return []*mqtt.Msg{
+		{
+			Topic: mqtt.ConfigTopic(prefix, "sensor", c.Name, "total"),
+			Body: ha.Sensor{
+				Availability:      availability,
+				Device:            device,
+				DeviceClass:       ha.DeviceClass(c.DeviceClass),
+				Icon:              "mdi:counter",
+				Name:              c.Name + " total",
+				StateClass:        "total_increasing",
+				StateTopic:        StateTopic(cfg, c.Name),
+				UniqueID:          c.Name + "_total",
+				UnitOfMeasurement: c.Unit,
+				ValueTemplate:     "{{ value_json.total }}",
+			},
+			Retain: true,
+		},
+		{
+			Topic: mqtt.ConfigTopic(prefix, "sensor", c.Name, "rate"),
+			Body: ha.Sensor{
+				Availability:      availability,
+				Device:            device,
+				Icon:              "mdi:speedometer",
+				Name:              c.Name + " rate",
+				StateClass:        "measurement",
+				StateTopic:        StateTopic(cfg, c.Name),
+				UniqueID:          c.Name + "_rate",
+				UnitOfMeasurement: rateUnit,
+				ValueTemplate:     "{{ value_json.rate }}",
+			},
+			Retain: true,
+		},
+	}, nil
+}
+
+// AnnounceMessages returns the discovery and state messages of the
+// meter on input.
+func (m *Meters) AnnounceMessages(input string, cfg types.SimpleStringConfig,
+	now time.Time) ([]*mqtt.Msg, error) {
+	msgs, err := m.DiscoveryMessages(input, cfg)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := m.StateMessage(input, cfg, now)
+	if err != nil {
+		return nil, err
+	}
+	return append(msgs, msg), nil
+}
+
+// RemovalMessages returns the messages that remove the sensors and
+// retained state of the meter on input.
+func (m *Meters) RemovalMessages(input string,
+	cfg types.SimpleStringConfig) ([]*mqtt.Msg, error) {
+	msgs, err := m.DiscoveryMessages(input, cfg)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*mqtt.Msg, 0, len(msgs)+1)
+	for _, msg := range msgs {
+		res = append(res, &mqtt.Msg{Topic: msg.Topic, Body: "", Retain: true})
+	}
+	c, _ := m.Config(input)
+	return append(res, &mqtt.Msg{Topic: StateTopic(cfg, c.Name), Body: "",
+		Retain: true}), nil
+}
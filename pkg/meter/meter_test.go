@@ -0,0 +1,169 @@
+package meter
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockCfg map[string]string
+
+func (cfg MockCfg) GetString(k string) string {
+	return cfg[k]
+}
+
+var start = time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+func Test_Update(t *testing.T) {
+	m := New(time.Hour)
+	assert.NoError(t, m.Set("udin_44-i1", Config{Name: "water",
+		UnitsPerPulse: 0.001, Unit: "m³", Debounce: "100ms"}))
+	assert.True(t, m.Counts("udin_44-i1"))
+	assert.False(t, m.Counts("udin_44-i2"))
+	assert.True(t, m.Changed())
+	assert.False(t, m.Changed())
+
+	tests := []struct {
+		name string
+		on   bool
+		at   time.Duration
+		want bool
+	}{
+		{"initial state is not a pulse", true, 0, false},
+		{"falling", false, 50 * time.Millisecond, false},
+		{"falling debounced", false, 150 * time.Millisecond, false},
+		{"bounce", true, 200 * time.Millisecond, false},
+		{"bounce ends", false, 250 * time.Millisecond, false},
+		{"rising", true, 300 * time.Millisecond, false},
+		{"rising debounced", true, 400 * time.Millisecond, true},
+		{"still on", true, time.Second, false},
+		{"falling again", false, 2 * time.Second, false},
+		{"falling debounced again", false, 3 * time.Second, false},
+		{"rising again", true, 4 * time.Second, false},
+		{"rising debounced again", true, 5 * time.Second, true},
+	}
+	for _, tc := range tests {
+		got := m.Update("udin_44-i1", tc.on, start.Add(tc.at))
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+	assert.False(t, m.Update("udin_44-i2", true, start))
+	assert.True(t, m.Changed())
+
+	st, err := m.State("udin_44-i1", start.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, State{Total: 0.002, Rate: 0.002, Pulses: 2}, st)
+	st, err = m.State("udin_44-i1", start.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, State{Total: 0.002, Rate: 0, Pulses: 2}, st,
+		"rate decays once the pulses leave the window")
+	_, err = m.State("udin_44-i2", start)
+	assert.EqualError(t, err, "no meter on udin_44-i2")
+}
+
+func Test_Persistence(t *testing.T) {
+	m := New(time.Minute)
+	assert.NoError(t, m.Load(map[string]Config{
+		"udin_44-i1": {Name: "gas", UnitsPerPulse: 0.01, Unit: "m³",
+			DeviceClass: "gas", Pulses: 1234},
+	}))
+	assert.False(t, m.Changed())
+	assert.NoError(t, m.Set("udin_44-i1", Config{Name: "gas_meter",
+		UnitsPerPulse: 0.01, Unit: "m³", DeviceClass: "gas"}))
+	assert.Equal(t, map[string]Config{
+		"udin_44-i1": {Name: "gas_meter", UnitsPerPulse: 0.01, Unit: "m³",
+			DeviceClass: "gas", Pulses: 1234},
+	}, m.Configs(), "count is kept when a meter is changed")
+	st, err := m.State("udin_44-i1", start)
+	assert.NoError(t, err)
+	assert.Equal(t, 12.34, st.Total)
+	assert.Equal(t, []string{"udin_44-i1"}, m.Inputs())
+
+	assert.NoError(t, m.Delete("udin_44-i1"))
+	assert.EqualError(t, m.Delete("udin_44-i1"), "no meter on udin_44-i1")
+	assert.Nil(t, m.Configs())
+
+	var nilMeters *Meters
+	assert.Nil(t, nilMeters.Configs())
+	assert.False(t, nilMeters.Counts("udin_44-i1"))
+}
+
+func Test_Validate(t *testing.T) {
+	m := New(time.Minute)
+	assert.NoError(t, m.Set("udin_44-i1", Config{Name: "water",
+		UnitsPerPulse: 1}))
+	tests := []struct {
+		input string
+		cfg   Config
+		want  string
+	}{
+		{"udin_44-r1", Config{Name: "gas", UnitsPerPulse: 1},
+			"invalid input udin_44-r1"},
+		{"udin_44-i2", Config{Name: "gas meter", UnitsPerPulse: 1},
+			`invalid meter name "gas meter", name must be non-empty and ` +
+				`contain no spaces, '/', '+' or '#'`},
+		{"udin_44-i2", Config{Name: "bridge", UnitsPerPulse: 1},
+			"meter name bridge is reserved for the bridge"},
+		{"udin_44-i2", Config{Name: "water", UnitsPerPulse: 1},
+			"meter name water already used by udin_44-i1"},
+		{"udin_44-i2", Config{Name: "gas"}, "invalid units per pulse 0"},
+		{"udin_44-i2", Config{Name: "gas", UnitsPerPulse: 1,
+			Debounce: "-1s"}, `invalid debounce time "-1s"`},
+	}
+	for _, tc := range tests {
+		assert.EqualError(t, m.Validate(tc.input, tc.cfg), tc.want)
+		assert.EqualError(t, m.Set(tc.input, tc.cfg), tc.want)
+	}
+	assert.NoError(t, m.Validate("udin_44-i1", Config{Name: "water",
+		UnitsPerPulse: 2}), "a meter may keep its own name")
+	assert.True(t, m.NameInUse("water"))
+	assert.False(t, m.NameInUse("gas"))
+	assert.Error(t, m.Load(map[string]Config{"udin_44-i3": {}}))
+}
+
+func Test_Messages(t *testing.T) {
+	cfg := MockCfg{
+		"Bridge_Topic":     "udin",
+		"Discovery_Prefix": "homeassistant",
+		"App_Name":         "udin2mqtt",
+		"Version":          "1.0",
+		"UI_Advertise":     "127.0.0.1:8094",
+	}
+	m := New(time.Hour)
+	assert.NoError(t, m.Load(map[string]Config{
+		"udin_44-i2": {Name: "water", UnitsPerPulse: 0.5, Unit: "L",
+			DeviceClass: "water", Pulses: 10},
+	}))
+	msgs, err := m.AnnounceMessages("udin_44-i2", cfg, start)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, "homeassistant/sensor/water_total/config", msgs[0].Topic)
+	total := msgs[0].Body.(ha.Sensor)
+	assert.Equal(t, "total_increasing", total.StateClass)
+	assert.Equal(t, "L", total.UnitOfMeasurement)
+	assert.Equal(t, ha.DeviceClass("water"), total.DeviceClass)
+	assert.Equal(t, "udin/water/state", total.StateTopic)
+	assert.Equal(t, "{{ value_json.total }}", total.ValueTemplate)
+	assert.Equal(t, "udin_udin_44", total.Device.ViaDevice)
+	assert.Equal(t, "homeassistant/sensor/water_rate/config", msgs[1].Topic)
+	rate := msgs[1].Body.(ha.Sensor)
+	assert.Equal(t, "measurement", rate.StateClass)
+	assert.Equal(t, "L/h", rate.UnitOfMeasurement)
+	assert.Equal(t, &mqtt.Msg{Topic: "udin/water/state",
+		Body: State{Total: 5, Pulses: 10}, Retain: true}, msgs[2])
+
+	rm, err := m.RemovalMessages("udin_44-i2", cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "homeassistant/sensor/water_total/config", Body: "",
+			Retain: true},
+		{Topic: "homeassistant/sensor/water_rate/config", Body: "",
+			Retain: true},
+		{Topic: "udin/water/state", Body: "", Retain: true},
+	}, rm)
+
+	_, err = m.AnnounceMessages("udin_44-i1", cfg, start)
+	assert.EqualError(t, err, "no meter on udin_44-i1")
+}
@@ -0,0 +1,160 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// field is the set of values matched by one field of a cron expression.
+type field struct {
+	match [60]bool
+	// any is set if the field is "*" which matters for the day fields
+	any bool
+}
+
+// parseField parses a comma separated list of "*", values and ranges,
+// each with an optional "/step", where values are between min and max
+// or one of the names.
+func parseField(s string, min, max int, names map[string]int) (*field, error) {
+	f := &field{any: s == "*"}
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %s", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = fieldValue(bounds[0], names)
+			if err != nil {
+				return nil, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = fieldValue(bounds[1], names)
+				if err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		// allow 7 for sunday as well as 0
+		if max == 6 && hi == 7 {
+			f.match[0] = true
+			if lo == 7 {
+				continue
+			}
+			hi = 6
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%s is not between %d and %d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			f.match[v] = true
+		}
+	}
+	return f, nil
+}
+
+func fieldValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+	return v, nil
+}
+
+// cron is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week.
+type cron struct {
+	minute, hour, dom, month, dow *field
+	loc                           *time.Location
+}
+
+func parseCron(s string, loc *time.Location) (*cron, error) {
+	fs := strings.Fields(s)
+	if len(fs) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in %q", s)
+	}
+	c := &cron{loc: loc}
+	var err error
+	for i, p := range []struct {
+		dst      **field
+		min, max int
+		names    map[string]int
+	}{
+		{&c.minute, 0, 59, nil},
+		{&c.hour, 0, 23, nil},
+		{&c.dom, 1, 31, nil},
+		{&c.month, 1, 12, monthNames},
+		{&c.dow, 0, 6, dayNames},
+	} {
+		*p.dst, err = parseField(fs[i], p.min, p.max, p.names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", s, err)
+		}
+	}
+	return c, nil
+}
+
+// dayMatch follows cron in matching either day field when both are
+// restricted.
+func (c *cron) dayMatch(t time.Time) bool {
+	dom, dow := c.dom.match[t.Day()], c.dow.match[t.Weekday()]
+	switch {
+	case c.dom.any:
+		return dow
+	case c.dow.any:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t matching the expression or the
+// zero time if there is none within five years.
+func (c *cron) next(after time.Time) time.Time {
+	t := after.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		prev := t
+		switch {
+		case !c.month.match[m]:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatch(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, c.loc)
+		case !c.hour.match[t.Hour()]:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, c.loc)
+		case !c.minute.match[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !t.After(prev) {
+			// the hour was repeated as daylight saving time ended
+			t = prev.Truncate(time.Hour).Add(time.Hour)
+		}
+	}
+	return time.Time{}
+}
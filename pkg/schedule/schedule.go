@@ -0,0 +1,395 @@
+// Package schedule runs device commands at set times so that devices
+// keep working when Home Assistant is not available.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+)
+
+// MaxLate is how late a command may be sent, for instance after the
+// system clock jumps forward, before it is skipped.
+const MaxLate = 15 * time.Minute
+
+// maxWait limits how long the scheduler sleeps so that it notices
+// changes to the system clock.
+const maxWait = time.Minute
+
+// Rule sends Command to Device at the times given by At. At is either
+// a five field cron expression, such as "30 7 * * mon-fri", or a time
+// of day, such as "07:30", "sunrise" or "sunset-15m", in which case
+// Days optionally restricts the days, such as "weekdays", "weekends"
+// or "mon,wed,fri".
+type Rule struct {
+	ID      string `json:"id" yaml:"id"`
+	Device  string `json:"device" yaml:"device"`
+	Command string `json:"command" yaml:"command"`
+	At      string `json:"at" yaml:"at"`
+	Days    string `json:"days,omitempty" yaml:"days,omitempty"`
+}
+
+func (r Rule) String() string {
+	s := fmt.Sprintf("%s %s at %s", r.Command, r.Device, r.At)
+	if r.Days != "" {
+		s += " " + r.Days
+	}
+	return s
+}
+
+// Fire is a rule that is due.
+type Fire struct {
+	Rule Rule
+	Time time.Time
+}
+
+// RuleInfo describes a rule and when it next fires for the UI.
+type RuleInfo struct {
+	Rule
+	Next time.Time
+}
+
+// trigger computes the first firing of a rule after a time.
+type trigger interface {
+	next(after time.Time) time.Time
+}
+
+type Scheduler struct {
+	clock  clock.Clock
+	loc    *time.Location
+	lat    float64
+	lon    float64
+	hasSun bool
+	mu     sync.Mutex
+	rules  []Rule
+	trig   map[string]trigger
+	nextID int
+	wake   chan struct{}
+}
+
+// New returns a scheduler that interprets times in loc.
+func New(c clock.Clock, loc *time.Location) *Scheduler {
+	return &Scheduler{
+		clock:  c,
+		loc:    loc,
+		trig:   make(map[string]trigger),
+		nextID: 1,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// SetCoordinates sets the location, in degrees with north and east
+// positive, used to compute sunrise and sunset. It must be called
+// before rules using them are added.
+func (s *Scheduler) SetCoordinates(lat, lon float64) error {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return fmt.Errorf("invalid coordinates %f,%f", lat, lon)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lat, s.lon, s.hasSun = lat, lon, true
+	return nil
+}
+
+// Validate checks that a rule is complete and its times are valid.
+func (s *Scheduler) Validate(r Rule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.compile(r)
+	return err
+}
+
+func (s *Scheduler) compile(r Rule) (trigger, error) {
+	if r.Device == "" {
+		return nil, fmt.Errorf("missing device")
+	}
+	if r.Command == "" {
+		return nil, fmt.Errorf("missing command")
+	}
+	at := strings.TrimSpace(r.At)
+	if len(strings.Fields(at)) == 5 {
+		if r.Days != "" {
+			return nil, fmt.Errorf("days may not be used with a cron expression")
+		}
+		return parseCron(at, s.loc)
+	}
+	d := &daily{loc: s.loc, lat: s.lat, lon: s.lon}
+	days, err := parseDays(r.Days)
+	if err != nil {
+		return nil, err
+	}
+	d.days = days
+	lc := strings.ToLower(at)
+	switch {
+	case strings.HasPrefix(lc, "sunrise"), strings.HasPrefix(lc, "sunset"):
+		if !s.hasSun {
+			return nil, fmt.Errorf(
+				"latitude and longitude must be configured to use %s", at)
+		}
+		d.sun = "sunrise"
+		if strings.HasPrefix(lc, "sunset") {
+			d.sun = "sunset"
+		}
+		if off := lc[len(d.sun):]; off != "" {
+			d.offset, err = time.ParseDuration(off)
+			if err != nil || (off[0] != '+' && off[0] != '-') {
+				return nil, fmt.Errorf("invalid offset in %s", at)
+			}
+		}
+	default:
+		tod, err := time.Parse("15:04", at)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q, expected HH:MM, "+
+				"sunrise, sunset or a cron expression", at)
+		}
+		d.hour, d.minute = tod.Hour(), tod.Minute()
+	}
+	return d, nil
+}
+
+// parseDays parses the days of a time of day rule.
+func parseDays(s string) (*field, error) {
+	switch strings.ToLower(s) {
+	case "", "daily", "everyday":
+		s = "*"
+	case "weekdays":
+		s = "mon-fri"
+	case "weekends":
+		s = "sat,sun"
+	}
+	f, err := parseField(s, 0, 6, dayNames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid days %q: %w", s, err)
+	}
+	return f, nil
+}
+
+// daily fires once a day at a time of day or relative to sunrise or
+// sunset.
+type daily struct {
+	loc          *time.Location
+	days         *field
+	hour, minute int
+	sun          string
+	offset       time.Duration
+	lat, lon     float64
+}
+
+func (d *daily) next(after time.Time) time.Time {
+	y, m, day := after.In(d.loc).Date()
+	for i := 0; i < 370; i++ {
+		date := time.Date(y, m, day+i, 0, 0, 0, 0, d.loc)
+		if !d.days.match[date.Weekday()] {
+			continue
+		}
+		t := time.Date(y, m, day+i, d.hour, d.minute, 0, 0, d.loc)
+		if d.sun != "" {
+			rise, set, ok := SunTimes(date, d.lat, d.lon)
+			if !ok {
+				continue
+			}
+			t = rise
+			if d.sun == "sunset" {
+				t = set
+			}
+			t = t.Add(d.offset).Truncate(time.Minute)
+		}
+		if t.After(after) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Add validates a rule and adds it assigning an ID if it has none.
+func (s *Scheduler) Add(r Rule) (Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.compile(r)
+	if err != nil {
+		return r, err
+	}
+	if r.ID == "" {
+		r.ID = strconv.Itoa(s.nextID)
+	}
+	if _, ok := s.trig[r.ID]; ok {
+		return r, fmt.Errorf("duplicate rule id %s", r.ID)
+	}
+	if n, err := strconv.Atoi(r.ID); err == nil && n >= s.nextID {
+		s.nextID = n + 1
+	}
+	s.rules = append(s.rules, r)
+	s.trig[r.ID] = t
+	s.notify()
+	return r, nil
+}
+
+// Load adds previously saved rules.
+func (s *Scheduler) Load(rules []Rule) error {
+	for _, r := range rules {
+		if _, err := s.Add(r); err != nil {
+			return fmt.Errorf("invalid schedule %s: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes the rule with the given ID.
+func (s *Scheduler) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.rules {
+		if r.ID == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			delete(s.trig, id)
+			s.notify()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown schedule %s", id)
+}
+
+// Has reports whether there is a rule with the given ID.
+func (s *Scheduler) Has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.trig[id]
+	return ok
+}
+
+// RenameDevice updates the rules of a renamed device.
+func (s *Scheduler) RenameDevice(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rules {
+		if s.rules[i].Device == oldName {
+			s.rules[i].Device = newName
+		}
+	}
+}
+
+// DeleteDevice removes the rules of a deleted device.
+func (s *Scheduler) DeleteDevice(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := s.rules[:0]
+	for _, r := range s.rules {
+		if r.Device == name {
+			delete(s.trig, r.ID)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	s.rules = rules
+	s.notify()
+}
+
+// Rules returns the persisted form of the rules.
+func (s *Scheduler) Rules() []Rule {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Rule(nil), s.rules...)
+}
+
+// Infos returns the rules with their next firing time.
+func (s *Scheduler) Infos() []RuleInfo {
+	if s == nil {
+		return nil
+	}
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]RuleInfo, len(s.rules))
+	for i, r := range s.rules {
+		res[i] = RuleInfo{Rule: r, Next: s.trig[r.ID].next(now)}
+	}
+	return res
+}
+
+// Due returns the firings of the rules after from and up to and
+// including to in time order.
+func (s *Scheduler) Due(from, to time.Time) []Fire {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []Fire{}
+	for _, r := range s.rules {
+		t := s.trig[r.ID].next(from)
+		for !t.IsZero() && !t.After(to) {
+			res = append(res, Fire{Rule: r, Time: t})
+			t = s.trig[r.ID].next(t)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res
+}
+
+// nextFire returns the earliest firing after t or the zero time.
+func (s *Scheduler) nextFire(after time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for _, t := range s.trig {
+		n := t.next(after)
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends the rules to fire as they become due until ctx is done.
+// Firings missed while the process was not running are not sent and
+// those more than MaxLate late are skipped.
+func (s *Scheduler) Run(ctx context.Context, fire chan<- Fire) {
+	last := s.clock.Now()
+	for {
+		wait := maxWait
+		if next := s.nextFire(last); !next.IsZero() {
+			if d := next.Sub(s.clock.Now()); d < wait {
+				wait = d
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+			continue
+		case <-s.clock.After(wait):
+		}
+		now := s.clock.Now()
+		if now.Before(last) {
+			// the clock went backwards so avoid repeating firings
+			last = now
+			continue
+		}
+		for _, f := range s.Due(last, now) {
+			if now.Sub(f.Time) > MaxLate {
+				continue
+			}
+			select {
+			case fire <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+		last = now
+	}
+}
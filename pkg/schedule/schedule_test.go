@@ -0,0 +1,245 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Monday 29th November 2021
+var monday = time.Date(2021, 11, 29, 0, 0, 0, 0, time.UTC)
+
+func Test_Next(t *testing.T) {
+	tests := []struct {
+		name  string
+		at    string
+		days  string
+		after time.Time
+		want  []time.Time
+	}{
+		{
+			name:  "time of day",
+			at:    "07:30",
+			after: monday.Add(8 * time.Hour),
+			want: []time.Time{
+				monday.AddDate(0, 0, 1).Add(7*time.Hour + 30*time.Minute),
+				monday.AddDate(0, 0, 2).Add(7*time.Hour + 30*time.Minute),
+			},
+		},
+		{
+			name:  "weekdays",
+			at:    "07:30",
+			days:  "weekdays",
+			after: monday.AddDate(0, 0, 4).Add(8 * time.Hour),
+			want: []time.Time{
+				monday.AddDate(0, 0, 7).Add(7*time.Hour + 30*time.Minute),
+				monday.AddDate(0, 0, 8).Add(7*time.Hour + 30*time.Minute),
+			},
+		},
+		{
+			name:  "days",
+			at:    "23:59",
+			days:  "sat,Sun",
+			after: monday,
+			want: []time.Time{
+				monday.AddDate(0, 0, 5).Add(23*time.Hour + 59*time.Minute),
+				monday.AddDate(0, 0, 6).Add(23*time.Hour + 59*time.Minute),
+				monday.AddDate(0, 0, 12).Add(23*time.Hour + 59*time.Minute),
+			},
+		},
+		{
+			name:  "cron",
+			at:    "*/20 9-10 * * mon-fri",
+			after: monday.AddDate(0, 0, 4).Add(10*time.Hour + 30*time.Minute),
+			want: []time.Time{
+				monday.AddDate(0, 0, 4).Add(10*time.Hour + 40*time.Minute),
+				monday.AddDate(0, 0, 7).Add(9 * time.Hour),
+				monday.AddDate(0, 0, 7).Add(9*time.Hour + 20*time.Minute),
+			},
+		},
+		{
+			name:  "cron day of month or week",
+			at:    "0 12 1 * 0",
+			after: monday,
+			want: []time.Time{
+				monday.AddDate(0, 0, 2).Add(12 * time.Hour),
+				monday.AddDate(0, 0, 6).Add(12 * time.Hour),
+				monday.AddDate(0, 0, 13).Add(12 * time.Hour),
+			},
+		},
+		{
+			name:  "cron month",
+			at:    "0 0 29 feb 7",
+			after: monday,
+			want: []time.Time{
+				time.Date(2021, 12, 5, 0, 0, 0, 0, time.UTC).AddDate(0, 2, 1),
+			},
+		},
+		{
+			name:  "sunset",
+			at:    "sunset-15m",
+			after: monday,
+			want: []time.Time{
+				time.Date(2021, 11, 29, 15, 43, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:  "sunrise",
+			at:    "Sunrise+1h",
+			days:  "sun",
+			after: monday,
+			want: []time.Time{
+				time.Date(2021, 12, 5, 8, 51, 0, 0, time.UTC),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(clock.NewFake(monday), time.UTC)
+			assert.NoError(t, s.SetCoordinates(51.5074, -0.1278))
+			trig, err := s.compile(Rule{Device: "d", Command: "c",
+				At: tc.at, Days: tc.days})
+			if !assert.NoError(t, err) {
+				return
+			}
+			after := tc.after
+			for _, want := range tc.want {
+				got := trig.next(after)
+				assert.WithinDuration(t, want, got, time.Minute)
+				after = got
+			}
+		})
+	}
+}
+
+func Test_RuleErrors(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{Command: "open", At: "07:30"}, "missing device"},
+		{Rule{Device: "d", At: "07:30"}, "missing command"},
+		{Rule{Device: "d", Command: "open", At: "7.30"},
+			`invalid time "7.30", expected HH:MM, sunrise, sunset ` +
+				`or a cron expression`},
+		{Rule{Device: "d", Command: "open", At: "25:00"},
+			`invalid time "25:00", expected HH:MM, sunrise, sunset ` +
+				`or a cron expression`},
+		{Rule{Device: "d", Command: "open", At: "07:30", Days: "someday"},
+			`invalid days "someday": invalid value someday`},
+		{Rule{Device: "d", Command: "open", At: "* * * * *",
+			Days: "weekdays"},
+			"days may not be used with a cron expression"},
+		{Rule{Device: "d", Command: "open", At: "60 * * * *"},
+			`invalid cron expression "60 * * * *": 60 is not between 0 and 59`},
+		{Rule{Device: "d", Command: "open", At: "*/0 * * * *"},
+			`invalid cron expression "*/0 * * * *": invalid step in */0`},
+		{Rule{Device: "d", Command: "open", At: "sunrise"},
+			"latitude and longitude must be configured to use sunrise"},
+	}
+	s := New(clock.NewFake(monday), time.UTC)
+	for _, tc := range tests {
+		assert.EqualError(t, s.Validate(tc.rule), tc.want, tc.rule.At)
+	}
+	assert.Error(t, s.SetCoordinates(91, 0))
+	assert.NoError(t, s.SetCoordinates(51.5, 0))
+	assert.EqualError(t, s.Validate(Rule{Device: "d", Command: "open",
+		At: "sunset 1h"}), "invalid offset in sunset 1h")
+}
+
+func Test_Rules(t *testing.T) {
+	s := New(clock.NewFake(monday), time.UTC)
+	assert.NoError(t, s.Load([]Rule{
+		{ID: "3", Device: "blind", Command: "close", At: "20:00"},
+	}))
+	r, err := s.Add(Rule{Device: "blind", Command: "open", At: "07:30",
+		Days: "weekdays"})
+	assert.NoError(t, err)
+	assert.Equal(t, "4", r.ID)
+	assert.Equal(t, "open blind at 07:30 weekdays", r.String())
+	_, err = s.Add(Rule{ID: "3", Device: "fan", Command: "on", At: "06:00"})
+	assert.EqualError(t, err, "duplicate rule id 3")
+	_, err = s.Add(Rule{Device: "fan", Command: "off", At: "0 * * * *"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []RuleInfo{
+		{Rule: Rule{ID: "3", Device: "blind", Command: "close", At: "20:00"},
+			Next: monday.Add(20 * time.Hour)},
+		{Rule: Rule{ID: "4", Device: "blind", Command: "open", At: "07:30",
+			Days: "weekdays"},
+			Next: monday.Add(7*time.Hour + 30*time.Minute)},
+		{Rule: Rule{ID: "5", Device: "fan", Command: "off", At: "0 * * * *"},
+			Next: monday.Add(time.Hour)},
+	}, s.Infos())
+
+	fires := s.Due(monday.Add(6*time.Hour+30*time.Minute),
+		monday.Add(8*time.Hour))
+	assert.Equal(t, []Fire{
+		{Rule: s.Rules()[2], Time: monday.Add(7 * time.Hour)},
+		{Rule: s.Rules()[1], Time: monday.Add(7*time.Hour + 30*time.Minute)},
+		{Rule: s.Rules()[2], Time: monday.Add(8 * time.Hour)},
+	}, fires)
+
+	s.RenameDevice("blind", "shutter")
+	assert.Equal(t, "shutter", s.Rules()[0].Device)
+	s.DeleteDevice("fan")
+	assert.Equal(t, 2, len(s.Rules()))
+	assert.True(t, s.Has("3"))
+	assert.NoError(t, s.Delete("3"))
+	assert.False(t, s.Has("3"))
+	assert.EqualError(t, s.Delete("3"), "unknown schedule 3")
+	assert.Equal(t, []Rule{{ID: "4", Device: "shutter", Command: "open",
+		At: "07:30", Days: "weekdays"}}, s.Rules())
+
+	var nilScheduler *Scheduler
+	assert.Nil(t, nilScheduler.Rules())
+	assert.Nil(t, nilScheduler.Infos())
+}
+
+func Test_Run(t *testing.T) {
+	fake := clock.NewFake(monday.Add(7 * time.Hour))
+	s := New(fake, time.UTC)
+	_, err := s.Add(Rule{Device: "blind", Command: "open", At: "07:30"})
+	assert.NoError(t, err)
+	_, err = s.Add(Rule{Device: "blind", Command: "close", At: "07:32"})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	fire := make(chan Fire)
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, fire)
+		close(done)
+	}()
+
+	// the scheduler sleeps for at most a minute at a time
+	for i := 0; i < 29; i++ {
+		fake.BlockUntil(1)
+		fake.Advance(time.Minute)
+	}
+	assert.Empty(t, fire)
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	f := <-fire
+	assert.Equal(t, "open", f.Rule.Command)
+	assert.Equal(t, monday.Add(7*time.Hour+30*time.Minute), f.Time)
+
+	// firings missed by a jump in the clock are sent if not too late
+	fake.BlockUntil(1)
+	fake.Advance(10 * time.Minute)
+	f = <-fire
+	assert.Equal(t, "close", f.Rule.Command)
+
+	// but not if they are more than MaxLate late
+	_, err = s.Add(Rule{Device: "blind", Command: "open", At: "07:45"})
+	assert.NoError(t, err)
+	fake.BlockUntil(1)
+	fake.Advance(time.Hour)
+	fake.BlockUntil(1)
+	assert.Empty(t, fire)
+
+	cancel()
+	<-done
+}
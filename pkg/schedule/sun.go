@@ -0,0 +1,52 @@
+package schedule
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	j2000    = 2451545.0 // Julian day of 2000-01-01 12:00 UTC
+	unixJDay = 2440587.5 // Julian day of the Unix epoch
+	rad      = math.Pi / 180
+)
+
+// SunTimes returns the times of sunrise and sunset on the calendar
+// day of t, in the location of t, at the given coordinates in degrees
+// with east and north positive. It uses the sunrise equation which is
+// accurate to a minute or two away from the poles. ok is false if the
+// sun does not rise or set on that day.
+func SunTimes(t time.Time, lat, lon float64) (rise, set time.Time, ok bool) {
+	y, m, d := t.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	jd := float64(noon.Unix())/86400 + unixJDay
+	// mean solar noon
+	n := math.Round(jd - j2000 - 0.0009 + lon/360)
+	jstar := n + 0.0009 - lon/360
+	// solar mean anomaly and equation of the centre
+	ma := math.Mod(357.5291+0.98560028*jstar, 360)
+	c := 1.9148*math.Sin(ma*rad) + 0.02*math.Sin(2*ma*rad) +
+		0.0003*math.Sin(3*ma*rad)
+	// ecliptic longitude and solar transit
+	lambda := math.Mod(ma+c+180+102.9372, 360)
+	transit := j2000 + jstar + 0.0053*math.Sin(ma*rad) -
+		0.0069*math.Sin(2*lambda*rad)
+	sinDecl := math.Sin(lambda*rad) * math.Sin(23.4397*rad)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	// hour angle of the upper limb of the sun on the horizon allowing
+	// for refraction
+	cosH := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sinDecl) /
+		(math.Cos(lat*rad) * cosDecl)
+	if cosH < -1 || cosH > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	h := math.Acos(cosH) / rad
+	loc := t.Location()
+	return julianTime(transit - h/360).In(loc),
+		julianTime(transit + h/360).In(loc), true
+}
+
+func julianTime(jd float64) time.Time {
+	sec := (jd - unixJDay) * 86400
+	return time.Unix(0, int64(math.Round(sec))*int64(time.Second)).UTC()
+}
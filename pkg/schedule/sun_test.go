@@ -0,0 +1,69 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SunTimes(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("no time zone data")
+	}
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skip("no time zone data")
+	}
+	tests := []struct {
+		name     string
+		day      time.Time
+		lat, lon float64
+		rise     time.Time
+		set      time.Time
+		ok       bool
+	}{
+		{
+			name: "london midsummer",
+			day:  time.Date(2021, 6, 21, 0, 0, 0, 0, london),
+			lat:  51.5074, lon: -0.1278,
+			rise: time.Date(2021, 6, 21, 4, 43, 0, 0, london),
+			set:  time.Date(2021, 6, 21, 21, 21, 0, 0, london),
+			ok:   true,
+		},
+		{
+			name: "london midwinter",
+			day:  time.Date(2021, 12, 21, 15, 0, 0, 0, london),
+			lat:  51.5074, lon: -0.1278,
+			rise: time.Date(2021, 12, 21, 8, 4, 0, 0, london),
+			set:  time.Date(2021, 12, 21, 15, 53, 0, 0, london),
+			ok:   true,
+		},
+		{
+			name: "sydney",
+			day:  time.Date(2021, 11, 29, 0, 0, 0, 0, sydney),
+			lat:  -33.8688, lon: 151.2093,
+			rise: time.Date(2021, 11, 29, 5, 39, 0, 0, sydney),
+			set:  time.Date(2021, 11, 29, 19, 51, 0, 0, sydney),
+			ok:   true,
+		},
+		{
+			name: "polar night",
+			day:  time.Date(2021, 12, 21, 0, 0, 0, 0, time.UTC),
+			lat:  78.2232, lon: 15.6267,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rise, set, ok := SunTimes(tc.day, tc.lat, tc.lon)
+			assert.Equal(t, tc.ok, ok)
+			if !tc.ok {
+				return
+			}
+			assert.WithinDuration(t, tc.rise, rise, 2*time.Minute)
+			assert.WithinDuration(t, tc.set, set, 2*time.Minute)
+			assert.Equal(t, tc.day.Location(), rise.Location())
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package store
+
+// lock is a no-op on platforms without flock.
+func lock(path string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,198 @@
+// Package store persists device definitions in a versioned JSON file
+// kept separate from the hand-edited configuration file.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/beanz/udin2mqtt-go/pkg/automation"
+	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/meter"
+	"github.com/beanz/udin2mqtt-go/pkg/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the schema version written by Save.
+const Version = 1
+
+// File is the content of a device store.
+type File struct {
+	Version     int                            `json:"version" yaml:"version"`
+	Devices     map[string]devices.Config      `json:"devices" yaml:"devices"`
+	Relays      map[string]devices.RelayConfig `json:"relays,omitempty" yaml:"relays,omitempty"`
+	Schedules   []schedule.Rule                `json:"schedules,omitempty" yaml:"schedules,omitempty"`
+	Automations []automation.Rule              `json:"automations,omitempty" yaml:"automations,omitempty"`
+	Meters      map[string]meter.Config        `json:"meters,omitempty" yaml:"meters,omitempty"`
+}
+
+// migrations[i] upgrades the decoded content of a store from version i
+// to version i+1.
+var migrations = []func(map[string]interface{}) (map[string]interface{}, error){
+	// version 0 is the bare "device" section of the configuration file
+	func(raw map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"version": 1,
+			"devices": raw,
+		}, nil
+	},
+}
+
+type Store struct {
+	path string
+}
+
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Exists returns true if the store file has been created.
+func (s *Store) Exists() bool {
+	_, err := os.Stat(s.path)
+	return err == nil
+}
+
+// Load reads the devices, relay settings, rules and meters from the
+// store migrating older versions. A missing store is not an error and
+// results in no devices.
+func (s *Store) Load() (*File, error) {
+	unlock, err := lock(s.path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &File{
+			Version: Version,
+			Devices: map[string]devices.Config{},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("device store %s: %w", s.path, err)
+	}
+	return f, nil
+}
+
+// Decode parses the content of a store, or an export in JSON or YAML
+// format, migrating it to the current version.
+func Decode(b []byte) (*File, error) {
+	var raw map[string]interface{}
+	var err error
+	if json.Valid(b) {
+		err = json.Unmarshal(b, &raw)
+	} else {
+		err = yaml.Unmarshal(b, &raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	version := 0
+	switch v := raw["version"].(type) {
+	case float64:
+		version = int(v)
+	case int:
+		version = v
+	default:
+		// hand written files may omit the version
+		if _, ok := raw["devices"]; ok {
+			version = Version
+		}
+	}
+	if version < 0 || version > Version {
+		return nil, fmt.Errorf("unsupported version %d, expected at most %d",
+			version, Version)
+	}
+	for ; version < Version; version++ {
+		raw, err = migrations[version](raw)
+		if err != nil {
+			return nil, fmt.Errorf("migration from version %d failed: %w",
+				version, err)
+		}
+	}
+	b, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, err
+	}
+	f.Version = Version
+	if f.Devices == nil {
+		f.Devices = map[string]devices.Config{}
+	}
+	return &f, nil
+}
+
+// Encode returns devices in the store format as "json" or "yaml".
+func Encode(devs map[string]devices.Config, format string) ([]byte, error) {
+	return encode(&File{Version: Version, Devices: devs}, format)
+}
+
+func encode(f *File, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(f, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case "yaml":
+		return yaml.Marshal(f)
+	default:
+		return nil, fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+// Save atomically replaces the content of the store.
+func (s *Store) Save(f *File) error {
+	f.Version = Version
+	b, err := encode(f, "json")
+	if err != nil {
+		return err
+	}
+	unlock, err := lock(s.path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(s.path, b)
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and
+// renames it over path so readers never see a partial file.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o600)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
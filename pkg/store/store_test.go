@@ -0,0 +1,194 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/beanz/udin2mqtt-go/pkg/automation"
+	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/meter"
+	"github.com/beanz/udin2mqtt-go/pkg/schedule"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	s := New(path)
+	assert.Equal(t, path, s.Path())
+	assert.False(t, s.Exists())
+
+	f, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &File{Version: Version,
+		Devices: map[string]devices.Config{}}, f)
+
+	want := map[string]devices.Config{
+		"blind": {
+			Kind:    "momentaryopenclose",
+			Def:     []string{"udin_8r-r1", "udin_8r-r2"},
+			Enabled: true,
+			Pulse:   "300ms",
+		},
+	}
+	saved := &File{
+		Devices: want,
+		Relays: map[string]devices.RelayConfig{
+			"udin_8r-r3": {Invert: true},
+		},
+		Schedules: []schedule.Rule{
+			{ID: "1", Device: "blind", Command: "open", At: "07:30",
+				Days: "weekdays"},
+		},
+		Automations: []automation.Rule{
+			{ID: "1", Input: "udin_44-i1", Event: automation.Held,
+				Hold: "2s", Device: "blind", Command: "close"},
+		},
+		Meters: map[string]meter.Config{
+			"udin_44-i2": {Name: "water", UnitsPerPulse: 0.001, Unit: "m³",
+				Pulses: 1234},
+		},
+	}
+	assert.NoError(t, s.Save(saved))
+	assert.True(t, s.Exists())
+	f, err = s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, Version, f.Version)
+	assert.Equal(t, saved, f)
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t,
+		[]string{"devices.json", "devices.json.lock"}, names)
+}
+
+func Test_Decode(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    *File
+		wantErr string
+	}{
+		{
+			name: "current",
+			in: `{"version":1,"devices":{"door":` +
+				`{"kind":"electriclock","def":["udin_8r-r3"],"code":"1234"}}}`,
+			want: &File{Version: 1, Devices: map[string]devices.Config{
+				"door": {
+					Kind: "electriclock",
+					Def:  []string{"udin_8r-r3"},
+					Code: "1234",
+				},
+			}},
+		},
+		{
+			name: "version 0",
+			in:   `{"vent":{"kind":"1","def":["udin_8r-r5"],"enabled":true}}`,
+			want: &File{Version: 1, Devices: map[string]devices.Config{
+				"vent": {
+					Kind:    "1",
+					Def:     []string{"udin_8r-r5"},
+					Enabled: true,
+				},
+			}},
+		},
+		{
+			name: "yaml",
+			in: "version: 1\ndevices:\n  door:\n    kind: electriclock\n" +
+				"    def: [udin_8r-r3]\n    enabled: true\n",
+			want: &File{Version: 1, Devices: map[string]devices.Config{
+				"door": {
+					Kind:    "electriclock",
+					Def:     []string{"udin_8r-r3"},
+					Enabled: true,
+				},
+			}},
+		},
+		{
+			name: "unversioned",
+			in:   `{"devices":{"door":{"kind":"2","def":["udin_8r-r3"]}}}`,
+			want: &File{Version: 1, Devices: map[string]devices.Config{
+				"door": {Kind: "2", Def: []string{"udin_8r-r3"}},
+			}},
+		},
+		{
+			name: "empty",
+			in:   `{"version":1}`,
+			want: &File{Version: 1, Devices: map[string]devices.Config{}},
+		},
+		{
+			name:    "newer",
+			in:      `{"version":2,"devices":{}}`,
+			wantErr: "unsupported version 2, expected at most 1",
+		},
+		{
+			name:    "invalid",
+			in:      `{`,
+			wantErr: "yaml: line 1: did not find expected node content",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Decode([]byte(tc.in))
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, f)
+		})
+	}
+}
+
+func Test_LoadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":99}`), 0o600))
+	_, err := New(path).Load()
+	assert.EqualError(t, err, "device store "+path+
+		": unsupported version 99, expected at most 1")
+
+	// a store in a missing directory can not be written
+	err = New(filepath.Join(path+".d", "devices.json")).Save(&File{})
+	assert.Error(t, err)
+}
+
+func Test_EncodeRoundTrip(t *testing.T) {
+	devs := map[string]devices.Config{
+		"blind": {
+			Kind:    "momentaryopenclose",
+			Def:     []string{"udin_8r-r1", "udin_8r-r2"},
+			Enabled: true,
+			Guard:   "1s",
+			Area:    "Lounge",
+		},
+		"blinds": {
+			Kind: "devicegroup",
+			Def:  []string{"blind", "stagger=2s"},
+		},
+	}
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			b, err := Encode(devs, format)
+			assert.NoError(t, err)
+			f, err := Decode(b)
+			assert.NoError(t, err)
+			assert.Equal(t, &File{Version: Version, Devices: devs}, f)
+		})
+	}
+	b, err := Encode(devs, "yaml")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "        area: Lounge\n")
+	assert.NotContains(t, string(b), "icon")
+
+	_, err = Encode(devs, "xml")
+	assert.EqualError(t, err, "unsupported format xml")
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/acomagu/bufpipe"
@@ -50,6 +52,14 @@ type MockUdin struct {
 	model string
 	r     io.ReadCloser
 	w     io.WriteCloser
+	mu    sync.Mutex
+	// relays records the relays switched on so that status requests
+	// can be answered
+	relays    map[uint]bool
+	numRelays uint
+	// inputs are set with SetMockInput to simulate wall switches
+	inputs    map[uint]bool
+	numInputs uint
 }
 
 func (m *MockUdin) Write(b []byte) (int, error) {
@@ -69,9 +79,76 @@ func (m *MockUdin) Write(b []byte) (int, error) {
 			return c, err
 		}
 	}
+	if len(b) > 2 {
+		r, err := strconv.ParseUint(string(b[1:len(b)-1]), 10, 32)
+		if err != nil {
+			return c, nil
+		}
+		switch b[0] {
+		case 'n', 'f':
+			m.set(uint(r), b[0] == 'n')
+		case 's':
+			n, err = m.w.Write([]byte(m.status(uint(r)) + "\r\n"))
+			c += n
+			if err != nil {
+				return c, err
+			}
+		case 'i':
+			n, err = m.w.Write([]byte(m.inputStatus(uint(r)) + "\r\n"))
+			c += n
+			if err != nil {
+				return c, err
+			}
+		}
+	}
 	return c, nil
 }
 
+// set switches relay r, or every relay if r is 0, on or off.
+func (m *MockUdin) set(r uint, on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r != 0 {
+		m.relays[r] = on
+		return
+	}
+	for i := uint(1); i <= m.numRelays; i++ {
+		m.relays[i] = on
+	}
+}
+
+// status returns the reply to a status request for relay r, or for
+// every relay if r is 0.
+func (m *MockUdin) status(r uint) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return states(m.relays, r, m.numRelays)
+}
+
+// inputStatus returns the reply to an input request for input i, or
+// for every input if i is 0.
+func (m *MockUdin) inputStatus(i uint) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return states(m.inputs, i, m.numInputs)
+}
+
+func states(on map[uint]bool, n, num uint) string {
+	first, last := n, n
+	if n == 0 {
+		first, last = 1, num
+	}
+	var sb strings.Builder
+	for i := first; i <= last; i++ {
+		if on[i] {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	}
+	return sb.String()
+}
+
 func (m *MockUdin) Read(p []byte) (int, error) {
 	n, err := m.r.Read(p)
 	return n, err
@@ -91,11 +168,19 @@ func NewUdinMock(dev string, logger *log.Logger) (*UdinDevice, error) {
 		model = s[1]
 	}
 	r, w := bufpipe.New(nil)
-	mock := &MockUdin{model, r, w}
-	return udinInit(dev, mock, model[:7], logger)
+	mock := &MockUdin{model: model, r: r, w: w,
+		relays: map[uint]bool{}, inputs: map[uint]bool{}}
+	u, err := udinInit(dev, mock, model[:7], logger)
+	if err != nil {
+		return nil, err
+	}
+	mock.numRelays = u.numRelays
+	mock.numInputs = u.numInputs
+	return u, nil
 }
 
 type UdinDevice struct {
+	path      string
 	port      io.ReadWriteCloser
 	reader    *bufio.Reader
 	model     string
@@ -103,14 +188,30 @@ type UdinDevice struct {
 	numRelays uint
 	numInputs uint
 	logger    *log.Logger
+	// mu serialises requests as inputs are polled concurrently with
+	// relay commands
+	mu sync.Mutex
+	// hmu protects health so that it can be read during a request
+	hmu    sync.Mutex
+	health Health
+}
+
+// Health is the outcome of the requests sent to a UDIN device. Healthy
+// is whether the last request succeeded.
+type Health struct {
+	Healthy   bool
+	Errors    uint64
+	LastError string
 }
 
 func udinInit(dev string, rwc io.ReadWriteCloser, name string, logger *log.Logger) (*UdinDevice, error) {
 	udin := &UdinDevice{
+		path:   dev,
 		port:   rwc,
 		reader: bufio.NewReader(rwc),
 		name:   strings.ToLower(name),
 		logger: logger,
+		health: Health{Healthy: true},
 	}
 	m, err := udin.Send(UdinRequest{Command: UdinQuery})
 	if err != nil {
@@ -142,7 +243,30 @@ func NewUdinSerial(tty string, logger *log.Logger) (*UdinDevice, error) {
 	return udinInit(tty, s, strings.TrimPrefix(tty, "/dev/"), logger)
 }
 
+// Send sends a request and returns the reply recording the outcome in
+// the health of the device.
 func (u *UdinDevice) Send(r UdinRequest) (string, error) {
+	s, err := u.send(r)
+	u.hmu.Lock()
+	defer u.hmu.Unlock()
+	u.health.Healthy = err == nil
+	if err != nil {
+		u.health.Errors++
+		u.health.LastError = err.Error()
+	}
+	return s, err
+}
+
+// Health returns the outcome of the requests sent to the device.
+func (u *UdinDevice) Health() Health {
+	u.hmu.Lock()
+	defer u.hmu.Unlock()
+	return u.health
+}
+
+func (u *UdinDevice) send(r UdinRequest) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	cmd := r.String()
 	_, err := u.port.Write([]byte(cmd + "\r"))
 	if err != nil {
@@ -170,7 +294,7 @@ func (u *UdinDevice) Send(r UdinRequest) (string, error) {
 		}
 		u.model = model[:len(model)-2]
 		return model[:len(model)-2], nil
-	case UdinStatus:
+	case UdinStatus, UdinInput:
 		status, err := u.reader.ReadString('\n')
 		if err != nil {
 			return "", fmt.Errorf("udin status read failed: %+v", err)
@@ -202,6 +326,12 @@ func (u *UdinDevice) Name() string {
 	return u.name
 }
 
+// Path returns the serial device path, or mock definition, used to
+// open the device.
+func (u *UdinDevice) Path() string {
+	return u.path
+}
+
 func (u *UdinDevice) NumRelays() uint {
 	return u.numRelays
 }
@@ -217,12 +347,78 @@ func NewUdin(dev string, logger *log.Logger) (*UdinDevice, error) {
 	return NewUdinSerial(dev, logger)
 }
 
-func (u *UdinDevice) Status(r uint) error {
+// Status returns whether relay r is energised or, if r is 0, the state
+// of every relay starting with relay 1. The reply is expected to be a
+// 0 or 1 for each relay.
+func (u *UdinDevice) Status(r uint) ([]bool, error) {
 	if r > u.numRelays {
-		return fmt.Errorf("invalid relay %d", r)
+		return nil, fmt.Errorf("invalid relay %d", r)
 	}
-	_, err := u.Send(UdinRequest{Command: UdinStatus, Instance: r})
-	return err
+	s, err := u.Send(UdinRequest{Command: UdinStatus, Instance: r})
+	if err != nil {
+		return nil, err
+	}
+	states, err := parseStates(s, r, u.numRelays)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status reply for relay %d: %w", r, err)
+	}
+	return states, nil
+}
+
+// Inputs returns whether input i is active or, if i is 0, the state of
+// every input starting with input 1.
+func (u *UdinDevice) Inputs(i uint) ([]bool, error) {
+	if i > u.numInputs {
+		return nil, fmt.Errorf("invalid input %d", i)
+	}
+	s, err := u.Send(UdinRequest{Command: UdinInput, Instance: i})
+	if err != nil {
+		return nil, err
+	}
+	states, err := parseStates(s, i, u.numInputs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input reply for input %d: %w", i, err)
+	}
+	return states, nil
+}
+
+// parseStates parses a reply of a 0 or 1 for instance n or, if n is 0,
+// for each of the num instances.
+func parseStates(s string, n, num uint) ([]bool, error) {
+	want := 1
+	if n == 0 {
+		want = int(num)
+	}
+	if len(s) != want {
+		return nil, fmt.Errorf("expected %d states in %q", want, s)
+	}
+	states := make([]bool, len(s))
+	for i, c := range s {
+		switch c {
+		case '0':
+		case '1':
+			states[i] = true
+		default:
+			return nil, fmt.Errorf("invalid state %q in %q", c, s)
+		}
+	}
+	return states, nil
+}
+
+// SetMockInput sets the state of input i of a mock device to simulate
+// a wall switch.
+func (u *UdinDevice) SetMockInput(i uint, on bool) error {
+	m, ok := u.port.(*MockUdin)
+	if !ok {
+		return fmt.Errorf("%s is not a mock device", u.name)
+	}
+	if i < 1 || i > u.numInputs {
+		return fmt.Errorf("invalid input %d", i)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs[i] = on
+	return nil
 }
 
 func (u *UdinDevice) On(r uint) error {
@@ -104,6 +104,14 @@ func Test_Model(t *testing.T) {
 	}
 }
 
+func Test_Path(t *testing.T) {
+	for _, mock := range []string{"mock", "mock:UDIN-44"} {
+		u, err := NewUdin(mock, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, mock, u.Path())
+	}
+}
+
 func Test_String(t *testing.T) {
 	tests := []struct {
 		mock string
@@ -221,3 +229,74 @@ read: f3 [102 51 13 10]
 	err = u.Pulse(99, time.Millisecond)
 	assert.Error(t, err)
 }
+
+func Test_Status(t *testing.T) {
+	u, err := NewUdin("mock", nil)
+	assert.NoError(t, err)
+	defer u.Close()
+	states, err := u.Status(0)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]bool, 8), states)
+	assert.NoError(t, u.On(2))
+	assert.NoError(t, u.On(8))
+	states, err = u.Status(0)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		[]bool{false, true, false, false, false, false, false, true}, states)
+	states, err = u.Status(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true}, states)
+	assert.NoError(t, u.Off(0))
+	states, err = u.Status(8)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false}, states)
+	_, err = u.Status(99)
+	assert.Error(t, err)
+
+	u44, err := NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	defer u44.Close()
+	assert.NoError(t, u44.On(0))
+	states, err = u44.Status(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true, true}, states)
+}
+
+func Test_Inputs(t *testing.T) {
+	u, err := NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	defer u.Close()
+	states, err := u.Inputs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]bool, 4), states)
+	assert.NoError(t, u.SetMockInput(2, true))
+	states, err = u.Inputs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false, false}, states)
+	states, err = u.Inputs(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true}, states)
+	_, err = u.Inputs(5)
+	assert.Error(t, err)
+	assert.Error(t, u.SetMockInput(5, true))
+
+	u8r, err := NewUdin("mock", nil)
+	assert.NoError(t, err)
+	defer u8r.Close()
+	states, err = u8r.Inputs(0)
+	assert.NoError(t, err)
+	assert.Empty(t, states)
+}
+
+func Test_Health(t *testing.T) {
+	u, err := NewUdin("mock", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Health{Healthy: true}, u.Health())
+	assert.NoError(t, u.On(1))
+	assert.NoError(t, u.Close())
+	assert.Error(t, u.On(1))
+	h := u.Health()
+	assert.False(t, h.Healthy)
+	assert.Equal(t, uint64(1), h.Errors)
+	assert.Contains(t, h.LastError, "udin write failed")
+}
@@ -0,0 +1,210 @@
+package udin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+)
+
+// Alert reports a relay that the watchdog switched because its load
+// was on for longer than its maximum on-time. The load of an inverted
+// relay is on when the relay is de-energised.
+type Alert struct {
+	Udin     string    `json:"udin"`
+	Relay    uint      `json:"relay"`
+	Inverted bool      `json:"inverted,omitempty"`
+	MaxOn    string    `json:"max_on"`
+	OnFor    string    `json:"on_for"`
+	Time     time.Time `json:"time"`
+	// Error is set if the load could not be switched off
+	Error string `json:"error,omitempty"`
+}
+
+func (a Alert) String() string {
+	state := "energised"
+	if a.Inverted {
+		state = "de-energised"
+	}
+	s := fmt.Sprintf("relay %s-r%d %s for %s, longer than %s",
+		a.Udin, a.Relay, state, a.OnFor, a.MaxOn)
+	if a.Error != "" {
+		s += ", failed to switch off: " + a.Error
+	}
+	return s
+}
+
+type watchedRelay struct {
+	udin  string
+	relay uint
+}
+
+// Watchdog switches off the loads of relays that stay on for longer
+// than their maximum on-time. Relays are polled so the time a load is
+// on may exceed its maximum by up to the polling interval.
+type Watchdog struct {
+	clock clock.Clock
+	udins map[string]*UdinDevice
+	mu    sync.Mutex
+	maxOn map[watchedRelay]time.Duration
+	// inverted relays switch their loads on when de-energised
+	inverted map[watchedRelay]bool
+	// since records when the load of a relay was first seen on
+	since map[watchedRelay]time.Time
+}
+
+func NewWatchdog(c clock.Clock, udins map[string]*UdinDevice) *Watchdog {
+	return &Watchdog{
+		clock:    c,
+		udins:    udins,
+		maxOn:    make(map[watchedRelay]time.Duration),
+		inverted: make(map[watchedRelay]bool),
+		since:    make(map[watchedRelay]time.Time),
+	}
+}
+
+func (w *Watchdog) validRelay(udin string, r uint) error {
+	u, ok := w.udins[udin]
+	if !ok {
+		return fmt.Errorf("invalid UDIN %s", udin)
+	}
+	if r < 1 || r > u.NumRelays() {
+		return fmt.Errorf("invalid relay %d", r)
+	}
+	return nil
+}
+
+// SetMaxOn sets the maximum on-time of relay r of a UDIN device. A
+// zero duration stops watching the relay.
+func (w *Watchdog) SetMaxOn(udin string, r uint, d time.Duration) error {
+	if err := w.validRelay(udin, r); err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid maximum on-time %s", d)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wr := watchedRelay{udin, r}
+	if d == 0 {
+		delete(w.maxOn, wr)
+		delete(w.since, wr)
+		return nil
+	}
+	w.maxOn[wr] = d
+	return nil
+}
+
+// SetInverted sets whether relay r of a UDIN device is inverted so
+// that the load is on, and is switched off, when the relay is
+// de-energised.
+func (w *Watchdog) SetInverted(udin string, r uint, inverted bool) error {
+	if err := w.validRelay(udin, r); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wr := watchedRelay{udin, r}
+	if w.inverted[wr] != inverted {
+		delete(w.since, wr)
+	}
+	if inverted {
+		w.inverted[wr] = true
+	} else {
+		delete(w.inverted, wr)
+	}
+	return nil
+}
+
+// Check reads the state of the watched relays and switches off the
+// loads that have been on for longer than their maximum on-time.
+func (w *Watchdog) Check() ([]Alert, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watched := map[string]bool{}
+	for wr := range w.maxOn {
+		watched[wr.udin] = true
+	}
+	names := make([]string, 0, len(watched))
+	for name := range watched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := []Alert{}
+	for _, name := range names {
+		states, err := w.udins[name].Status(0)
+		if err != nil {
+			return res, fmt.Errorf("failed to read relays of %s: %w",
+				name, err)
+		}
+		now := w.clock.Now()
+		for j, on := range states {
+			wr := watchedRelay{name, uint(j + 1)}
+			maxOn, ok := w.maxOn[wr]
+			if !ok {
+				continue
+			}
+			inverted := w.inverted[wr]
+			if on == inverted {
+				// the load is off
+				delete(w.since, wr)
+				continue
+			}
+			since, ok := w.since[wr]
+			if !ok {
+				w.since[wr] = now
+				continue
+			}
+			if now.Sub(since) < maxOn {
+				continue
+			}
+			alert := Alert{
+				Udin:     name,
+				Relay:    wr.relay,
+				Inverted: inverted,
+				MaxOn:    maxOn.String(),
+				OnFor:    now.Sub(since).String(),
+				Time:     now,
+			}
+			switchOff := w.udins[name].Off
+			if inverted {
+				switchOff = w.udins[name].On
+			}
+			if err := switchOff(wr.relay); err != nil {
+				alert.Error = err.Error()
+			} else {
+				delete(w.since, wr)
+			}
+			res = append(res, alert)
+		}
+	}
+	return res, nil
+}
+
+// Run checks the watched relays every interval and sends alerts until
+// ctx is done. Failures to read relays are logged.
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration,
+	alerts chan<- Alert, logger *log.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.clock.After(interval):
+		}
+		res, err := w.Check()
+		if err != nil && logger != nil {
+			logger.Printf("%s\n", err)
+		}
+		for _, a := range res {
+			select {
+			case alerts <- a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
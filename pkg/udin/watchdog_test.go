@@ -0,0 +1,148 @@
+package udin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+func Test_WatchdogCheck(t *testing.T) {
+	u, err := NewUdin("mock", nil)
+	assert.NoError(t, err)
+	defer u.Close()
+	fake := clock.NewFake(start)
+	w := NewWatchdog(fake, map[string]*UdinDevice{"udin_8r": u})
+	assert.EqualError(t, w.SetMaxOn("udin_44", 1, time.Second),
+		"invalid UDIN udin_44")
+	assert.EqualError(t, w.SetMaxOn("udin_8r", 9, time.Second),
+		"invalid relay 9")
+	assert.EqualError(t, w.SetMaxOn("udin_8r", 1, -time.Second),
+		"invalid maximum on-time -1s")
+	assert.NoError(t, w.SetMaxOn("udin_8r", 1, 5*time.Second))
+	assert.NoError(t, w.SetMaxOn("udin_8r", 2, 5*time.Second))
+
+	assert.NoError(t, u.On(1))
+	assert.NoError(t, u.On(2))
+	assert.NoError(t, u.On(3))
+	check := func() []Alert {
+		alerts, err := w.Check()
+		assert.NoError(t, err)
+		return alerts
+	}
+	assert.Empty(t, check(), "relays seen energised")
+	fake.Advance(3 * time.Second)
+	assert.NoError(t, u.Off(2))
+	assert.Empty(t, check(), "within the maximum on-time")
+	assert.NoError(t, u.On(2))
+	fake.Advance(3 * time.Second)
+	assert.Equal(t, []Alert{{Udin: "udin_8r", Relay: 1, MaxOn: "5s",
+		OnFor: "6s", Time: start.Add(6 * time.Second)}}, check(),
+		"relay 2 was switched off so its on-time restarted")
+
+	states, err := u.Status(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true, false, false, false, false,
+		false}, states, "relay 3 is not watched")
+
+	assert.NoError(t, w.SetMaxOn("udin_8r", 2, 0))
+	fake.Advance(time.Hour)
+	assert.Empty(t, check(), "relay 2 is no longer watched")
+}
+
+func Test_WatchdogInverted(t *testing.T) {
+	u, err := NewUdin("mock", nil)
+	assert.NoError(t, err)
+	defer u.Close()
+	fake := clock.NewFake(start)
+	w := NewWatchdog(fake, map[string]*UdinDevice{"udin_8r": u})
+	assert.EqualError(t, w.SetInverted("udin_8r", 9, true),
+		"invalid relay 9")
+	assert.NoError(t, w.SetMaxOn("udin_8r", 1, 5*time.Second))
+	assert.NoError(t, w.SetInverted("udin_8r", 1, true))
+	check := func() []Alert {
+		alerts, err := w.Check()
+		assert.NoError(t, err)
+		return alerts
+	}
+
+	// the load of an energised inverted relay is off
+	assert.NoError(t, u.On(1))
+	assert.Empty(t, check())
+	fake.Advance(time.Hour)
+	assert.Empty(t, check(), "load is off")
+
+	// and is on when the relay is de-energised
+	assert.NoError(t, u.Off(1))
+	assert.Empty(t, check(), "load seen on")
+	fake.Advance(6 * time.Second)
+	assert.Equal(t, []Alert{{Udin: "udin_8r", Relay: 1, Inverted: true,
+		MaxOn: "5s", OnFor: "6s", Time: start.Add(time.Hour + 6*time.Second)}},
+		check())
+	states, err := u.Status(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true}, states,
+		"relay was energised to switch the load off")
+	fake.Advance(time.Hour)
+	assert.Empty(t, check(), "load stays off")
+
+	// changing the inversion restarts the on-time
+	assert.NoError(t, w.SetInverted("udin_8r", 1, false))
+	assert.Empty(t, check(), "load seen on")
+	fake.Advance(6 * time.Second)
+	alerts := check()
+	if assert.Equal(t, 1, len(alerts)) {
+		assert.False(t, alerts[0].Inverted)
+	}
+	states, err = u.Status(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false}, states)
+}
+
+func Test_AlertString(t *testing.T) {
+	a := Alert{Udin: "udin_8r", Relay: 1, MaxOn: "5s", OnFor: "6s"}
+	assert.Equal(t, "relay udin_8r-r1 energised for 6s, longer than 5s",
+		a.String())
+	a.Error = "udin write failed"
+	assert.Equal(t, "relay udin_8r-r1 energised for 6s, longer than 5s, "+
+		"failed to switch off: udin write failed", a.String())
+	a = Alert{Udin: "udin_8r", Relay: 1, Inverted: true, MaxOn: "5s",
+		OnFor: "6s"}
+	assert.Equal(t, "relay udin_8r-r1 de-energised for 6s, longer than 5s",
+		a.String())
+}
+
+func Test_WatchdogRun(t *testing.T) {
+	u, err := NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	defer u.Close()
+	fake := clock.NewFake(start)
+	w := NewWatchdog(fake, map[string]*UdinDevice{"udin_44": u})
+	assert.NoError(t, w.SetMaxOn("udin_44", 4, 2*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	alerts := make(chan Alert, 1)
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx, time.Second, alerts, nil)
+		close(done)
+	}()
+	// a pulse whose Off was never sent
+	assert.NoError(t, u.On(4))
+	for i := 0; i < 3; i++ {
+		fake.BlockUntil(1)
+		fake.Advance(time.Second)
+	}
+	a := <-alerts
+	assert.Equal(t, uint(4), a.Relay)
+	assert.Equal(t, "2s", a.OnFor)
+	states, err := u.Status(4)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false}, states, "relay was switched off")
+	cancel()
+	<-done
+}
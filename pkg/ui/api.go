@@ -0,0 +1,167 @@
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/types"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+)
+
+// Request is the body of a management request published to
+// <bridge>/bridge/request/<operation>. The ID is copied to the response
+// so that callers can match responses to their requests.
+type Request struct {
+	ID      string   `json:"id"`
+	Device  string   `json:"device"`
+	Def     []string `json:"def"`
+	Enabled bool     `json:"enabled"`
+	Name    string   `json:"name"`
+}
+
+// Response is the body of the reply to a management request published
+// to <bridge>/bridge/response/<operation>.
+type Response struct {
+	ID      string                     `json:"id,omitempty"`
+	Status  string                     `json:"status"`
+	Message string                     `json:"message,omitempty"`
+	Errors  []*devices.ValidationError `json:"errors,omitempty"`
+	Data    interface{}                `json:"data,omitempty"`
+}
+
+// UdinScan is the result of querying a UDIN device.
+type UdinScan struct {
+	devices.UdinInfo
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RequestTopic is the topic prefix of management requests.
+func RequestTopic(cfg types.SimpleStringConfig) string {
+	return cfg.GetString("Bridge_Topic") + "/bridge/request/"
+}
+
+// ResponseTopic is the topic prefix of management responses.
+func ResponseTopic(cfg types.SimpleStringConfig) string {
+	return cfg.GetString("Bridge_Topic") + "/bridge/response/"
+}
+
+// HandleRequest validates a management request received on topic and
+// returns the response message and, for requests that change devices,
+// the event that makes the change. The failure of the event should be
+// reported with SetError on the body of the response.
+func (ui *UI) HandleRequest(cfg types.SimpleStringConfig, topic string,
+	body []byte) (*mqtt.Msg, *UIEvent) {
+	op := strings.TrimPrefix(topic, RequestTopic(cfg))
+	resp := &Response{Status: "ok"}
+	msg := &mqtt.Msg{Topic: ResponseTopic(cfg) + op, Body: resp}
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		resp.SetError(fmt.Errorf("invalid request: %w", err))
+		return msg, nil
+	}
+	resp.ID = req.ID
+	ev, err := ui.request(op, &req, resp)
+	if err != nil {
+		resp.SetError(err)
+		return msg, nil
+	}
+	return msg, ev
+}
+
+// SetError reports the failure of the request.
+func (resp *Response) SetError(err error) {
+	resp.Status = "error"
+	resp.Message = err.Error()
+	var verrs devices.ValidationErrors
+	if errors.As(err, &verrs) {
+		resp.Errors = verrs
+	}
+}
+
+func (ui *UI) request(op string, req *Request, resp *Response) (*UIEvent, error) {
+	switch op {
+	case "device/list":
+		resp.Data = devices.RedactCodes(ui.Devices.Configs())
+		return nil, nil
+	case "device/create":
+		if err := ui.Devices.Validate(req.Def); err != nil {
+			return nil, err
+		}
+		ev := NewUIEvent(UICreateEvent, req.Def...)
+		resp.Message = "creating device"
+		return &ev, nil
+	case "device/enable":
+		if err := ui.Devices.ValidateDevice(req.Device); err != nil {
+			return nil, err
+		}
+		ev := NewUIEvent(UIEnableEvent, req.Device,
+			fmt.Sprintf("%t", req.Enabled))
+		action := "disabled"
+		if req.Enabled {
+			action = "enabled"
+		}
+		resp.Message = fmt.Sprintf("device %s %s", req.Device, action)
+		return &ev, nil
+	case "device/rename":
+		if err := ui.Devices.ValidateRename(req.Device, req.Name); err != nil {
+			return nil, err
+		}
+		ev := NewUIEvent(UIRenameEvent, req.Device, req.Name)
+		resp.Message = fmt.Sprintf("renaming device %s to %s",
+			req.Device, req.Name)
+		return &ev, nil
+	case "device/delete":
+		if err := ui.Devices.ValidateDelete(req.Device); err != nil {
+			return nil, err
+		}
+		ev := NewUIEvent(UIDeleteEvent, req.Device)
+		resp.Message = fmt.Sprintf("deleting device %s", req.Device)
+		return &ev, nil
+	case "udin/list":
+		res := map[string]devices.UdinInfo{}
+		for name, u := range ui.Udins {
+			res[name] = udinInfo(u)
+		}
+		resp.Data = res
+		return nil, nil
+	case "udin/scan":
+		res := map[string]UdinScan{}
+		for _, name := range ui.udinNames() {
+			u := ui.Udins[name]
+			scan := UdinScan{UdinInfo: udinInfo(u), Healthy: true}
+			_, err := u.Send(udin.UdinRequest{Command: udin.UdinQuery})
+			if err != nil {
+				scan.Healthy = false
+				scan.Error = err.Error()
+			}
+			res[name] = scan
+		}
+		resp.Data = res
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid request %s", op)
+}
+
+func (ui *UI) udinNames() []string {
+	names := make([]string, 0, len(ui.Udins))
+	for name := range ui.Udins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func udinInfo(u *udin.UdinDevice) devices.UdinInfo {
+	return devices.UdinInfo{
+		Model:  u.Model(),
+		Path:   u.Path(),
+		Relays: u.NumRelays(),
+		Inputs: u.NumInputs(),
+	}
+}
@@ -0,0 +1,163 @@
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockCfg map[string]string
+
+func (cfg MockCfg) GetString(k string) string {
+	return cfg[k]
+}
+
+func Test_HandleRequest(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	udins := map[string]*udin.UdinDevice{"udin_8r": u8r}
+	d := devices.NewDevices(udins)
+	_, err = d.Create([]string{"blind", "0", "udin_8r-r1", "udin_8r-r2"},
+		true, "")
+	assert.NoError(t, err)
+	_, err = d.Create([]string{"gate", "2", "udin_8r-r7"}, true, "")
+	assert.NoError(t, err)
+	d.Device("gate").Code = "1234"
+	u := NewUI(d, "0.0.1", 1)
+	u.Udins = udins
+	cfg := MockCfg{"Bridge_Topic": "udin"}
+
+	tests := []struct {
+		name  string
+		op    string
+		body  string
+		want  string
+		event *UIEvent
+	}{
+		{
+			name: "create",
+			op:   "device/create",
+			body: `{"id":"1","def":["door","2","udin_8r-r3"]}`,
+			want: `{"id":"1","status":"ok","message":"creating device"}`,
+			event: &UIEvent{UICreateEvent,
+				[]string{"door", "2", "udin_8r-r3"}},
+		},
+		{
+			name: "invalid create",
+			op:   "device/create",
+			body: `{"id":"2","def":["door","2","udin_8r-r1"]}`,
+			want: `{"id":"2","status":"error","message":"device door: ` +
+				`def[0] \"udin_8r-r1\": relay already used by blind",` +
+				`"errors":[{"device":"door","field":"def[0]",` +
+				`"value":"udin_8r-r1",` +
+				`"reason":"relay already used by blind"}]}`,
+		},
+		{
+			name:  "enable",
+			op:    "device/enable",
+			body:  `{"id":"3","device":"blind","enabled":false}`,
+			want:  `{"id":"3","status":"ok","message":"device blind disabled"}`,
+			event: &UIEvent{UIEnableEvent, []string{"blind", "false"}},
+		},
+		{
+			name: "enable missing device",
+			op:   "device/enable",
+			body: `{"id":"4","device":"nope","enabled":true}`,
+			want: `{"id":"4","status":"error","message":"device nope: ` +
+				`name \"nope\": unknown device nope",` +
+				`"errors":[{"device":"nope","field":"name",` +
+				`"value":"nope","reason":"unknown device nope"}]}`,
+		},
+		{
+			name: "rename",
+			op:   "device/rename",
+			body: `{"id":"5","device":"blind","name":"shade"}`,
+			want: `{"id":"5","status":"ok",` +
+				`"message":"renaming device blind to shade"}`,
+			event: &UIEvent{UIRenameEvent, []string{"blind", "shade"}},
+		},
+		{
+			name:  "delete",
+			op:    "device/delete",
+			body:  `{"id":"6","device":"blind"}`,
+			want:  `{"id":"6","status":"ok","message":"deleting device blind"}`,
+			event: &UIEvent{UIDeleteEvent, []string{"blind"}},
+		},
+		{
+			name: "list",
+			op:   "device/list",
+			body: `{"id":"7"}`,
+			want: `{"id":"7","status":"ok","data":{"blind":` +
+				`{"kind":"momentaryopenclose",` +
+				`"def":["udin_8r-r1","udin_8r-r2"],"enabled":true},` +
+				`"gate":{"kind":"electriclock","def":["udin_8r-r7"],` +
+				`"enabled":true,"code":"REDACTED"}}}`,
+		},
+		{
+			name: "udin list",
+			op:   "udin/list",
+			body: `{}`,
+			want: `{"status":"ok","data":{"udin_8r":` +
+				`{"model":"UDIN-8R 8 x Relay V1.0","path":"mock",` +
+				`"relays":8,"inputs":0}}}`,
+		},
+		{
+			name: "udin scan",
+			op:   "udin/scan",
+			body: `{}`,
+			want: `{"status":"ok","data":{"udin_8r":` +
+				`{"model":"UDIN-8R 8 x Relay V1.0","path":"mock",` +
+				`"relays":8,"inputs":0,"healthy":true}}}`,
+		},
+		{
+			name: "invalid operation",
+			op:   "device/explode",
+			body: `{"id":"8"}`,
+			want: `{"id":"8","status":"error",` +
+				`"message":"invalid request device/explode"}`,
+		},
+		{
+			name: "invalid json",
+			op:   "device/list",
+			body: `{`,
+			want: `{"status":"error","message":"invalid request: ` +
+				`unexpected end of JSON input"}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, ev := u.HandleRequest(cfg, "udin/bridge/request/"+tc.op,
+				[]byte(tc.body))
+			assert.Equal(t, "udin/bridge/response/"+tc.op, msg.Topic)
+			b, err := json.Marshal(msg.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, string(b))
+			assert.Equal(t, tc.event, ev)
+		})
+	}
+
+	assert.NoError(t, u8r.Close())
+	msg, _ := u.HandleRequest(cfg, "udin/bridge/request/udin/scan",
+		[]byte(`{"id":"9"}`))
+	scan := msg.Body.(*Response).Data.(map[string]UdinScan)["udin_8r"]
+	assert.False(t, scan.Healthy)
+	assert.Contains(t, scan.Error, "udin write failed")
+}
+
+func Test_ResponseSetError(t *testing.T) {
+	resp := &Response{ID: "1", Status: "ok", Message: "creating device"}
+	resp.SetError(fmt.Errorf("failed to create device: %w",
+		devices.ValidationErrors{{Device: "door", Field: "name",
+			Value: "door", Reason: "name already used by a meter"}}))
+	b, err := json.Marshal(resp)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1","status":"error","message":"failed to `+
+		`create device: device door: name \"door\": name already used `+
+		`by a meter","errors":[{"device":"door","field":"name",`+
+		`"value":"door","reason":"name already used by a meter"}]}`,
+		string(b))
+}
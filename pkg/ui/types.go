@@ -6,6 +6,19 @@ const (
 	UIRenameEvent UIEventType = iota
 	UIEnableEvent
 	UICreateEvent
+	UITimingEvent
+	UIEditEvent
+	UIDeleteEvent
+	UIImportEvent
+	UIInvertEvent
+	UIScheduleAddEvent
+	UIScheduleDeleteEvent
+	UIAutomationAddEvent
+	UIAutomationDeleteEvent
+	UIMeterSetEvent
+	UIMeterDeleteEvent
+	UILimitEvent
+	UIMaxOnEvent
 )
 
 type UIEvent struct {
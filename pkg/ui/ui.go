@@ -1,13 +1,23 @@
 package ui
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/beanz/udin2mqtt-go/pkg/automation"
 	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/limit"
+	"github.com/beanz/udin2mqtt-go/pkg/meter"
+	"github.com/beanz/udin2mqtt-go/pkg/schedule"
+	"github.com/beanz/udin2mqtt-go/pkg/store"
+	"github.com/beanz/udin2mqtt-go/pkg/udin"
 
 	"github.com/go-chi/chi"
 )
@@ -15,9 +25,13 @@ import (
 var templates = template.Must(template.ParseFiles("index.html"))
 
 type UI struct {
-	Devices *devices.Devices
-	Version string
-	Seed    int64
+	Devices     *devices.Devices
+	Schedules   *schedule.Scheduler
+	Automations *automation.Engine
+	Meters      *meter.Meters
+	Udins       map[string]*udin.UdinDevice
+	Version     string
+	Seed        int64
 }
 
 func NewUI(d *devices.Devices, ver string, seed int64) *UI {
@@ -34,12 +48,63 @@ func (ui *UI) CreateRouter(stdout io.Writer, ch chan UIEvent) *chi.Mux {
 	router.Route("/api", func(r chi.Router) {
 		r.Get("/create/{def}", ui.getCreateHandler(stdout, ch))
 		r.Get("/{device}/enable/{val}", ui.getEnableDisableHandler(stdout, ch))
+		r.Get("/{device}/timing/{pulse}/{guard}",
+			ui.getTimingHandler(stdout, ch))
+		r.Get("/{device}/limit/{interval}/{policy}",
+			ui.getLimitHandler(stdout, ch))
+		r.Get("/{device}/rename/{name}", ui.getRenameHandler(stdout, ch))
+		r.Get("/{device}/edit/{def}", ui.getEditHandler(stdout, ch))
+		r.Get("/{device}/delete", ui.getDeleteHandler(stdout, ch))
+		r.Get("/relay/{relay}/invert/{val}", ui.getInvertHandler(stdout, ch))
+		r.Get("/relay/{relay}/maxon/{duration}", ui.getMaxOnHandler(stdout, ch))
+		r.Get("/schedule/add", ui.getScheduleAddHandler(stdout, ch))
+		r.Get("/schedule/{id}/delete", ui.getScheduleDeleteHandler(stdout, ch))
+		r.Get("/automation/add", ui.getAutomationAddHandler(stdout, ch))
+		r.Get("/automation/{id}/delete",
+			ui.getAutomationDeleteHandler(stdout, ch))
+		r.Get("/meter/{input}/set", ui.getMeterSetHandler(stdout, ch))
+		r.Get("/meter/{input}/delete", ui.getMeterDeleteHandler(stdout, ch))
+		r.Get("/export", ui.getExportHandler(stdout))
+		r.Post("/import", ui.postImportHandler(stdout, ch))
 	})
 	fs := http.FileServer(http.Dir("static"))
 	router.Handle("/static/*", http.StripPrefix("/static/", fs))
 	return router
 }
 
+type errorResponse struct {
+	Status  string                     `json:"status"`
+	Message string                     `json:"message"`
+	Errors  []*devices.ValidationError `json:"errors,omitempty"`
+}
+
+// writeError writes a JSON error response including the individual
+// validation errors, if any, so that the UI can display them.
+func writeError(stdout io.Writer, w http.ResponseWriter, err error) {
+	resp := errorResponse{Status: "error", Message: err.Error()}
+	var verrs devices.ValidationErrors
+	if errors.As(err, &verrs) {
+		resp.Errors = verrs
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		fmt.Fprintf(stdout, "error response marshal failed: %+v\n", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, err = w.Write(b)
+	if err != nil {
+		fmt.Fprintf(stdout, "error response write failed: %+v\n", err)
+	}
+}
+
+// Policies are the rate limit policies offered for devices.
+func (ui *UI) Policies() []string {
+	return limit.Policies
+}
+
 func (ui *UI) getIndexHandler(stdout io.Writer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := templates.ExecuteTemplate(w, "index.html", ui)
@@ -53,12 +118,16 @@ func (ui *UI) getIndexHandler(stdout io.Writer) func(w http.ResponseWriter, r *h
 func (ui *UI) getCreateHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		def := strings.Split(chi.URLParam(r, "def"), ",")
+		if err := ui.Devices.Validate(def); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
 		ch <- NewUIEvent(UICreateEvent, def...)
 		_, err := w.Write([]byte(
 			"{\"status\":\"ok\",\"message\":\"creating device\"}"))
 		if err != nil {
 			fmt.Fprintf(stdout,
-				"enable/disable request write failed: %+v\n", err)
+				"create request write failed: %+v\n", err)
 		}
 	}
 }
@@ -67,6 +136,10 @@ func (ui *UI) getEnableDisableHandler(stdout io.Writer, ch chan UIEvent) func(w
 	return func(w http.ResponseWriter, r *http.Request) {
 		device := chi.URLParam(r, "device")
 		val := chi.URLParam(r, "val")
+		if err := ui.Devices.ValidateDevice(device); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
 		var action string
 		if val == "true" {
 			action = "enabled"
@@ -83,3 +156,427 @@ func (ui *UI) getEnableDisableHandler(stdout io.Writer, ch chan UIEvent) func(w
 		}
 	}
 }
+
+func (ui *UI) getTimingHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := chi.URLParam(r, "device")
+		pulse := chi.URLParam(r, "pulse")
+		guard := chi.URLParam(r, "guard")
+		if pulse == "" {
+			// an empty pulse uses the default of the device type
+			pulse = "0s"
+		}
+		for _, v := range []string{pulse, guard} {
+			if d, err := time.ParseDuration(v); err != nil || d < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, err := w.Write([]byte(fmt.Sprintf(
+					"{\"status\":\"error\",\"message\":\"invalid duration %s\"}",
+					template.JSEscapeString(v))))
+				if err != nil {
+					fmt.Fprintf(stdout,
+						"timing request write failed: %+v\n", err)
+				}
+				return
+			}
+		}
+		ch <- NewUIEvent(UITimingEvent, device, pulse, guard)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"device %s timing updated\"}",
+			device)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"timing request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getLimitHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := chi.URLParam(r, "device")
+		interval := chi.URLParam(r, "interval")
+		policy := chi.URLParam(r, "policy")
+		if policy == limit.DefaultPolicy {
+			policy = ""
+		}
+		if err := ui.Devices.ValidateDevice(device); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			writeError(stdout, w,
+				fmt.Errorf("invalid duration %s", interval))
+			return
+		}
+		err = limit.Limit{Interval: d, Policy: policy}.Validate()
+		if err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UILimitEvent, device, interval, policy)
+		_, err = w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"device %s rate limit updated\"}",
+			device)))
+		if err != nil {
+			fmt.Fprintf(stdout, "limit request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getRenameHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := chi.URLParam(r, "device")
+		name := chi.URLParam(r, "name")
+		if err := ui.Devices.ValidateRename(device, name); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UIRenameEvent, device, name)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"renaming device %s to %s\"}",
+			device, name)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"rename request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getEditHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := chi.URLParam(r, "device")
+		def := append([]string{device},
+			strings.Split(chi.URLParam(r, "def"), ",")...)
+		if err := ui.Devices.ValidateDevice(device); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		if err := ui.Devices.Validate(def); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UIEditEvent, def...)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"updating device %s\"}",
+			device)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"edit request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getDeleteHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := chi.URLParam(r, "device")
+		if err := ui.Devices.ValidateDelete(device); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UIDeleteEvent, device)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"deleting device %s\"}",
+			device)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"delete request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getInvertHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		relay := chi.URLParam(r, "relay")
+		val := chi.URLParam(r, "val")
+		if err := ui.Devices.ValidateRelay(relay); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		msg := "relay %s inverted"
+		if val != "true" {
+			val = "false"
+			msg = "relay %s not inverted"
+		}
+		ch <- NewUIEvent(UIInvertEvent, relay, val)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\""+msg+"\"}", relay)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"invert request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getMaxOnHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		relay := chi.URLParam(r, "relay")
+		duration := chi.URLParam(r, "duration")
+		if err := ui.Devices.ValidateRelay(relay); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		if d, err := time.ParseDuration(duration); err != nil || d < 0 {
+			writeError(stdout, w,
+				fmt.Errorf("invalid duration %s", duration))
+			return
+		}
+		ch <- NewUIEvent(UIMaxOnEvent, relay, duration)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"relay %s maximum on-time updated\"}",
+			relay)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"max on-time request write failed: %+v\n", err)
+		}
+	}
+}
+
+// getScheduleAddHandler takes the rule as query parameters since cron
+// expressions contain characters that are awkward in a path.
+func (ui *UI) getScheduleAddHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ui.Schedules == nil {
+			writeError(stdout, w, fmt.Errorf("schedules not available"))
+			return
+		}
+		q := r.URL.Query()
+		rule := schedule.Rule{
+			Device:  q.Get("device"),
+			Command: q.Get("command"),
+			At:      q.Get("at"),
+			Days:    q.Get("days"),
+		}
+		if err := ui.Devices.ValidateDevice(rule.Device); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		if err := ui.Schedules.Validate(rule); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UIScheduleAddEvent,
+			rule.Device, rule.Command, rule.At, rule.Days)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"adding schedule for %s\"}",
+			rule.Device)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"schedule add request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getScheduleDeleteHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if ui.Schedules == nil || !ui.Schedules.Has(id) {
+			writeError(stdout, w, fmt.Errorf("unknown schedule %s", id))
+			return
+		}
+		ch <- NewUIEvent(UIScheduleDeleteEvent, id)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"deleting schedule %s\"}",
+			id)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"schedule delete request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getAutomationAddHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ui.Automations == nil {
+			writeError(stdout, w, fmt.Errorf("automations not available"))
+			return
+		}
+		q := r.URL.Query()
+		rule := automation.Rule{
+			Input:   q.Get("input"),
+			Event:   q.Get("event"),
+			Hold:    q.Get("hold"),
+			Device:  q.Get("device"),
+			Command: q.Get("command"),
+		}
+		if err := ui.Devices.ValidateInput(rule.Input); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		if err := ui.Devices.ValidateDevice(rule.Device); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		if err := ui.Automations.Validate(rule); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UIAutomationAddEvent,
+			rule.Input, rule.Event, rule.Hold, rule.Device, rule.Command)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"adding automation for %s\"}",
+			rule.Input)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"automation add request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getAutomationDeleteHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if ui.Automations == nil || !ui.Automations.Has(id) {
+			writeError(stdout, w, fmt.Errorf("unknown automation %s", id))
+			return
+		}
+		ch <- NewUIEvent(UIAutomationDeleteEvent, id)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"deleting automation %s\"}",
+			id)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"automation delete request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getMeterSetHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ui.Meters == nil {
+			writeError(stdout, w, fmt.Errorf("meters not available"))
+			return
+		}
+		input := chi.URLParam(r, "input")
+		q := r.URL.Query()
+		cfg := meter.Config{
+			Name:        q.Get("name"),
+			Unit:        q.Get("unit"),
+			DeviceClass: q.Get("class"),
+			Debounce:    q.Get("debounce"),
+		}
+		upp, err := strconv.ParseFloat(q.Get("upp"), 64)
+		if err != nil {
+			writeError(stdout, w,
+				fmt.Errorf("invalid units per pulse %q", q.Get("upp")))
+			return
+		}
+		cfg.UnitsPerPulse = upp
+		if err := ui.Devices.ValidateInput(input); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		// meter states share the topics of device states
+		if ui.Devices.Device(cfg.Name) != nil {
+			writeError(stdout, w,
+				fmt.Errorf("meter name %s already used by a device", cfg.Name))
+			return
+		}
+		if err := ui.Meters.Validate(input, cfg); err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		ch <- NewUIEvent(UIMeterSetEvent, input, cfg.Name, q.Get("upp"),
+			cfg.Unit, cfg.DeviceClass, cfg.Debounce)
+		_, err = w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"setting meter on %s\"}",
+			input)))
+		if err != nil {
+			fmt.Fprintf(stdout, "meter set request write failed: %+v\n", err)
+		}
+	}
+}
+
+func (ui *UI) getMeterDeleteHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		input := chi.URLParam(r, "input")
+		if !ui.Meters.Counts(input) {
+			writeError(stdout, w, fmt.Errorf("no meter on %s", input))
+			return
+		}
+		ch <- NewUIEvent(UIMeterDeleteEvent, input)
+		_, err := w.Write([]byte(fmt.Sprintf(
+			"{\"status\":\"ok\",\"message\":\"deleting meter on %s\"}",
+			input)))
+		if err != nil {
+			fmt.Fprintf(stdout,
+				"meter delete request write failed: %+v\n", err)
+		}
+	}
+}
+
+// maxImportSize limits the size of an import request body.
+const maxImportSize = 1 << 20
+
+func (ui *UI) getExportHandler(stdout io.Writer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		cfgs := ui.Devices.Configs()
+		if r.URL.Query().Get("codes") != "true" {
+			cfgs = devices.RedactCodes(cfgs)
+		}
+		b, err := store.Encode(cfgs, format)
+		if err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/"+format)
+		_, err = w.Write(b)
+		if err != nil {
+			fmt.Fprintf(stdout, "export request write failed: %+v\n", err)
+		}
+	}
+}
+
+type importResponse struct {
+	Status  string                  `json:"status"`
+	Message string                  `json:"message"`
+	Changes []*devices.ImportChange `json:"changes"`
+}
+
+// postImportHandler validates the devices in the request body, in the
+// format written by the export handler, and imports them unless the
+// dry_run query parameter is set. The planned changes are returned.
+func (ui *UI) postImportHandler(stdout io.Writer, ch chan UIEvent) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize))
+		if err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		f, err := store.Decode(b)
+		if err != nil {
+			writeError(stdout, w, fmt.Errorf("invalid import: %w", err))
+			return
+		}
+		changes, err := ui.Devices.PlanImport(f.Devices)
+		if err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		resp := importResponse{Status: "ok", Changes: changes}
+		if r.URL.Query().Get("dry_run") == "true" {
+			resp.Message = "dry run, no devices changed"
+		} else {
+			enc, err := json.Marshal(f.Devices)
+			if err != nil {
+				writeError(stdout, w, err)
+				return
+			}
+			ch <- NewUIEvent(UIImportEvent, string(enc))
+			resp.Message = fmt.Sprintf("importing %d devices", len(changes))
+		}
+		b, err = json.Marshal(resp)
+		if err != nil {
+			writeError(stdout, w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		if err != nil {
+			fmt.Fprintf(stdout, "import request write failed: %+v\n", err)
+		}
+	}
+}
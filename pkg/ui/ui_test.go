@@ -6,9 +6,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/beanz/udin2mqtt-go/pkg/automation"
+	"github.com/beanz/udin2mqtt-go/pkg/clock"
 	"github.com/beanz/udin2mqtt-go/pkg/devices"
+	"github.com/beanz/udin2mqtt-go/pkg/meter"
+	"github.com/beanz/udin2mqtt-go/pkg/schedule"
 	"github.com/beanz/udin2mqtt-go/pkg/udin"
 
 	"github.com/stretchr/testify/assert"
@@ -50,6 +56,11 @@ func Test_Router(t *testing.T) {
 				)
 				assert.Contains(t, body,
 					"<div>App v0.0.1</div>", "must contain version reference")
+				assert.Contains(t, body,
+					"<option value=\"multispeedfan\"",
+					"must contain registered device types")
+				assert.Contains(t, body, "Multi-speed fan</option>",
+					"must contain form label of device type")
 			},
 		},
 		{
@@ -84,6 +95,185 @@ func Test_Router(t *testing.T) {
 					NewUIEvent(UIEnableEvent, "bar", "false"))
 			},
 		},
+		{
+			name: "enable unknown device request",
+			uri:  "/api/quux/enable/true",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "unknown device quux")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "create request",
+			uri:  "/api/create/grp,group,foo,bar",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"creating device\"}",
+					body)
+				assert.NotEmpty(t, ch, "event channel should not be empty")
+				assert.Equal(t, <-ch,
+					NewUIEvent(UICreateEvent, "grp", "group", "foo", "bar"))
+			},
+		},
+		{
+			name: "invalid create request",
+			uri:  "/api/create/blind,0,udin_8r-r1",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.JSONEq(t, `{
+  "status": "error",
+  "message": "device blind: def \"udin_8r-r1\": expected open and close relays; device blind: def[0] \"udin_8r-r1\": unknown UDIN device udin_8r",
+  "errors": [
+    {
+      "device": "blind",
+      "field": "def",
+      "value": "udin_8r-r1",
+      "reason": "expected open and close relays"
+    },
+    {
+      "device": "blind",
+      "field": "def[0]",
+      "value": "udin_8r-r1",
+      "reason": "unknown UDIN device udin_8r"
+    }
+  ]
+}`, body)
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "rename request",
+			uri:  "/api/foo/rename/baz",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"renaming device foo to baz\"}",
+					body)
+				assert.NotEmpty(t, ch, "event channel should not be empty")
+				assert.Equal(t, <-ch, NewUIEvent(UIRenameEvent, "foo", "baz"))
+			},
+		},
+		{
+			name: "invalid rename request",
+			uri:  "/api/foo/rename/bar",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "device bar already exists")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "edit request",
+			uri:  "/api/foo/edit/group,bar",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"updating device foo\"}",
+					body)
+				assert.NotEmpty(t, ch, "event channel should not be empty")
+				assert.Equal(t, <-ch,
+					NewUIEvent(UIEditEvent, "foo", "group", "bar"))
+			},
+		},
+		{
+			name: "invalid edit request",
+			uri:  "/api/foo/edit/group",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "expected at least one member device")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "edit unknown device request",
+			uri:  "/api/quux/edit/group,foo",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "unknown device quux")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "delete request",
+			uri:  "/api/foo/delete",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"deleting device foo\"}",
+					body)
+				assert.NotEmpty(t, ch, "event channel should not be empty")
+				assert.Equal(t, <-ch, NewUIEvent(UIDeleteEvent, "foo"))
+			},
+		},
+		{
+			name: "invalid delete request",
+			uri:  "/api/quux/delete",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "unknown device quux")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "timing request",
+			uri:  "/api/foo/timing/300ms/0s",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"device foo timing updated\"}",
+					body)
+				assert.NotEmpty(t, ch, "event channel should not be empty")
+				assert.Equal(t, <-ch,
+					NewUIEvent(UITimingEvent, "foo", "300ms", "0s"))
+			},
+		},
+		{
+			name: "invalid timing request",
+			uri:  "/api/foo/timing/soon/0s",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"error\",\"message\":\"invalid duration soon\"}",
+					body)
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "limit request",
+			uri:  "/api/foo/limit/2s/coalesce",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"device foo rate limit updated\"}",
+					body)
+				assert.Equal(t, <-ch,
+					NewUIEvent(UILimitEvent, "foo", "2s", "coalesce"))
+			},
+		},
+		{
+			name: "limit request with default policy",
+			uri:  "/api/foo/limit/2s/default",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Equal(t,
+					"{\"status\":\"ok\",\"message\":\"device foo rate limit updated\"}",
+					body)
+				assert.Equal(t, <-ch,
+					NewUIEvent(UILimitEvent, "foo", "2s", ""))
+			},
+		},
+		{
+			name: "invalid limit request",
+			uri:  "/api/foo/limit/2s/ignore",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, `invalid policy \"ignore\"`)
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "invalid limit duration",
+			uri:  "/api/foo/limit/soon/drop",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "invalid duration soon")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
+		{
+			name: "limit request for unknown device",
+			uri:  "/api/quux/limit/1s/drop",
+			checks: func(t *testing.T, ui *UI, body string, ch chan UIEvent) {
+				assert.Contains(t, body, "unknown device quux")
+				assert.Empty(t, ch, "event channel should be empty")
+			},
+		},
 	}
 
 	for _, tc := range tests {
@@ -125,6 +315,51 @@ func Test_Errors(t *testing.T) {
 			uri:   "/api/foo/enable/true",
 			error: "enable/disable request write failed",
 		},
+		{
+			name:  "create error",
+			uri:   "/api/create/grp,group,foo",
+			error: "create request write failed",
+		},
+		{
+			name:  "invalid create error",
+			uri:   "/api/create/grp,group",
+			error: "error response write failed",
+		},
+		{
+			name:  "rename error",
+			uri:   "/api/foo/rename/baz",
+			error: "rename request write failed",
+		},
+		{
+			name:  "edit error",
+			uri:   "/api/foo/edit/group,bar",
+			error: "edit request write failed",
+		},
+		{
+			name:  "delete error",
+			uri:   "/api/foo/delete",
+			error: "delete request write failed",
+		},
+		{
+			name:  "export error",
+			uri:   "/api/export?format=yaml",
+			error: "export request write failed",
+		},
+		{
+			name:  "timing error",
+			uri:   "/api/foo/timing/1s/0s",
+			error: "timing request write failed",
+		},
+		{
+			name:  "invalid timing error",
+			uri:   "/api/foo/timing/1s/never",
+			error: "timing request write failed",
+		},
+		{
+			name:  "limit error",
+			uri:   "/api/foo/limit/1s/drop",
+			error: "limit request write failed",
+		},
 	}
 
 	for _, tc := range tests {
@@ -143,3 +378,412 @@ func Test_Errors(t *testing.T) {
 		})
 	}
 }
+
+func Test_ImportExport(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	d := devices.NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = d.Create([]string{"blind", "0", "udin_8r-r1", "udin_8r-r2"},
+		true, "")
+	assert.NoError(t, err)
+	_, err = d.Create([]string{"door", "2", "udin_8r-r7"}, true, "")
+	assert.NoError(t, err)
+	d.Device("door").Code = "1234"
+	var buf bytes.Buffer
+	ch := make(chan UIEvent, 1)
+	router := NewUI(d, "0.0.1", 987654321).CreateRouter(&buf, ch)
+	request := func(method, uri, body string) (int, string) {
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res.StatusCode, string(data)
+	}
+
+	code, exported := request(http.MethodGet, "/api/export", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, exported, `"version": 1`)
+	assert.Contains(t, exported, `"code": "REDACTED"`)
+	assert.NotContains(t, exported, "1234")
+	code, yamlExport := request(http.MethodGet, "/api/export?format=yaml", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, yamlExport, "kind: momentaryopenclose")
+	assert.NotContains(t, yamlExport, "1234")
+	code, withCodes := request(http.MethodGet, "/api/export?codes=true", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, withCodes, `"code": "1234"`)
+	code, _ = request(http.MethodGet, "/api/export?format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// exports import unchanged in either format
+	for _, body := range []string{exported, yamlExport, withCodes} {
+		code, resp := request(http.MethodPost, "/api/import?dry_run=true",
+			body)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, `{"status":"ok",`+
+			`"message":"dry run, no devices changed",`+
+			`"changes":[{"device":"blind","action":"unchanged"},`+
+			`{"device":"door","action":"unchanged"}]}`, resp)
+		assert.Empty(t, ch, "event channel should be empty")
+	}
+
+	body := strings.Replace(exported, "udin_8r-r2", "udin_8r-r3", 1)
+	code, resp := request(http.MethodPost, "/api/import", body)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"status":"ok","message":"importing 2 devices",`+
+		`"changes":[{"device":"blind","action":"update",`+
+		`"diff":["def: [udin_8r-r1 udin_8r-r2] -\u003e [udin_8r-r1 udin_8r-r3]"]},`+
+		`{"device":"door","action":"unchanged"}]}`,
+		resp)
+	assert.NotEmpty(t, ch, "event channel should not be empty")
+	ev := <-ch
+	assert.Equal(t, UIImportEvent, ev.Kind)
+	assert.Contains(t, ev.Args[0], `"udin_8r-r3"`)
+
+	code, resp = request(http.MethodPost, "/api/import",
+		`{"version":1,"devices":{"door":{"kind":"2","def":["udin_8r-r1"]}}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp, `"reason":"relay already used by blind"`)
+	code, resp = request(http.MethodPost, "/api/import", "{")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp, "invalid import")
+	assert.Empty(t, ch, "event channel should be empty")
+	assert.Equal(t, "", buf.String())
+}
+
+func Test_Invert(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	d := devices.NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	assert.NoError(t, d.SetInvert("udin_8r-r8", true))
+	assert.NoError(t, d.SetMaxOn("udin_8r-r7", 90*time.Second))
+	tests := []struct {
+		uri   string
+		want  string
+		event *UIEvent
+	}{
+		{
+			uri:  "/",
+			want: "x-relay=\"udin_8r-r8\"\n                     checked",
+		},
+		{
+			uri:  "/",
+			want: "x-relay=\"udin_8r-r7\"\n                     value=\"1m30s\"",
+		},
+		{
+			uri:  "/api/relay/udin_8r-r3/invert/true",
+			want: `{"status":"ok","message":"relay udin_8r-r3 inverted"}`,
+			event: &UIEvent{Kind: UIInvertEvent,
+				Args: []string{"udin_8r-r3", "true"}},
+		},
+		{
+			uri:  "/api/relay/udin_8r-r3/invert/false",
+			want: `{"status":"ok","message":"relay udin_8r-r3 not inverted"}`,
+			event: &UIEvent{Kind: UIInvertEvent,
+				Args: []string{"udin_8r-r3", "false"}},
+		},
+		{
+			uri:  "/api/relay/udin_8r-r9/invert/true",
+			want: "invalid relay udin_8r-r9",
+		},
+		{
+			uri:  "/api/relay/udin_8r-r3/maxon/5m",
+			want: `{"status":"ok","message":"relay udin_8r-r3 maximum on-time updated"}`,
+			event: &UIEvent{Kind: UIMaxOnEvent,
+				Args: []string{"udin_8r-r3", "5m"}},
+		},
+		{
+			uri:  "/api/relay/udin_8r-r3/maxon/-5m",
+			want: "invalid duration -5m",
+		},
+		{
+			uri:  "/api/relay/udin_8r-r9/maxon/5m",
+			want: "invalid relay udin_8r-r9",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			ch := make(chan UIEvent, 1)
+			var buf bytes.Buffer
+			router := NewUI(d, "0.0.1", 1).CreateRouter(&buf, ch)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.Contains(t, w.Body.String(), tc.want)
+			if tc.event == nil {
+				assert.Empty(t, ch, "event channel should be empty")
+			} else {
+				assert.Equal(t, *tc.event, <-ch)
+			}
+
+			var ebuf bytes.Buffer
+			router = NewUI(d, "0.0.1", 1).CreateRouter(&ebuf, ch)
+			router.ServeHTTP(BrokenWriter{},
+				httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.NotEmpty(t, ebuf.String(), "write errors are logged")
+			for len(ch) > 0 {
+				<-ch
+			}
+		})
+	}
+}
+
+func Test_Schedules(t *testing.T) {
+	d := devices.NewDevices(map[string]*udin.UdinDevice{})
+	d.Update(devices.Device{Name: "blind", Enabled: true})
+	s := schedule.New(clock.NewFake(time.Date(2021, 11, 29, 0, 0, 0, 0,
+		time.UTC)), time.UTC)
+	_, err := s.Add(schedule.Rule{Device: "blind", Command: "OPEN",
+		At: "07:30", Days: "weekdays"})
+	assert.NoError(t, err)
+	tests := []struct {
+		uri   string
+		want  string
+		event *UIEvent
+	}{
+		{
+			uri:  "/",
+			want: "<td>07:30</td>\n            <td>weekdays</td>\n            <td>Mon 29 Nov 07:30</td>",
+		},
+		{
+			uri:  "/api/schedule/add?device=blind&command=CLOSE&at=0+20+*+*+*",
+			want: `{"status":"ok","message":"adding schedule for blind"}`,
+			event: &UIEvent{Kind: UIScheduleAddEvent,
+				Args: []string{"blind", "CLOSE", "0 20 * * *", ""}},
+		},
+		{
+			uri:  "/api/schedule/add?device=fan&command=on&at=07:00",
+			want: "unknown device fan",
+		},
+		{
+			uri:  "/api/schedule/add?device=blind&command=CLOSE&at=sunset",
+			want: "latitude and longitude must be configured to use sunset",
+		},
+		{
+			uri:   "/api/schedule/1/delete",
+			want:  `{"status":"ok","message":"deleting schedule 1"}`,
+			event: &UIEvent{Kind: UIScheduleDeleteEvent, Args: []string{"1"}},
+		},
+		{
+			uri:  "/api/schedule/2/delete",
+			want: "unknown schedule 2",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			ch := make(chan UIEvent, 1)
+			var buf bytes.Buffer
+			u := NewUI(d, "0.0.1", 1)
+			u.Schedules = s
+			router := u.CreateRouter(&buf, ch)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.Contains(t, w.Body.String(), tc.want)
+			if tc.event == nil {
+				assert.Empty(t, ch, "event channel should be empty")
+			} else {
+				assert.Equal(t, *tc.event, <-ch)
+			}
+
+			var ebuf bytes.Buffer
+			router = u.CreateRouter(&ebuf, ch)
+			router.ServeHTTP(BrokenWriter{},
+				httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.NotEmpty(t, ebuf.String(), "write errors are logged")
+			for len(ch) > 0 {
+				<-ch
+			}
+		})
+	}
+
+	// schedules are not shown or managed without a scheduler
+	w := httptest.NewRecorder()
+	NewUI(d, "0.0.1", 1).CreateRouter(&bytes.Buffer{}, nil).ServeHTTP(w,
+		httptest.NewRequest(http.MethodGet, "/api/schedule/1/delete", nil))
+	assert.Contains(t, w.Body.String(), "unknown schedule 1")
+}
+
+func Test_Automations(t *testing.T) {
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	d := devices.NewDevices(map[string]*udin.UdinDevice{"udin_44": u44})
+	d.Update(devices.Device{Name: "light", Enabled: true})
+	e := automation.New(clock.Real)
+	_, err = e.Add(automation.Rule{Input: "udin_44-i1", Event: "held",
+		Hold: "2s", Device: "light", Command: "off"})
+	assert.NoError(t, err)
+	tests := []struct {
+		uri   string
+		want  string
+		event *UIEvent
+	}{
+		{
+			uri:  "/",
+			want: "<td>udin_44-i1</td>\n            <td>held</td>\n            <td>2s</td>",
+		},
+		{
+			uri:  "/api/automation/add?input=udin_44-i2&event=rising&device=light&command=toggle",
+			want: `{"status":"ok","message":"adding automation for udin_44-i2"}`,
+			event: &UIEvent{Kind: UIAutomationAddEvent,
+				Args: []string{"udin_44-i2", "rising", "", "light", "toggle"}},
+		},
+		{
+			uri:  "/api/automation/add?input=udin_44-i5&event=rising&device=light&command=on",
+			want: "invalid input udin_44-i5",
+		},
+		{
+			uri:  "/api/automation/add?input=udin_44-i2&event=rising&device=fan&command=on",
+			want: "unknown device fan",
+		},
+		{
+			uri:  "/api/automation/add?input=udin_44-i2&event=held&device=light&command=on",
+			want: `invalid hold time \"\"`,
+		},
+		{
+			uri:   "/api/automation/1/delete",
+			want:  `{"status":"ok","message":"deleting automation 1"}`,
+			event: &UIEvent{Kind: UIAutomationDeleteEvent, Args: []string{"1"}},
+		},
+		{
+			uri:  "/api/automation/2/delete",
+			want: "unknown automation 2",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			ch := make(chan UIEvent, 1)
+			var buf bytes.Buffer
+			u := NewUI(d, "0.0.1", 1)
+			u.Automations = e
+			router := u.CreateRouter(&buf, ch)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.Contains(t, w.Body.String(), tc.want)
+			if tc.event == nil {
+				assert.Empty(t, ch, "event channel should be empty")
+			} else {
+				assert.Equal(t, *tc.event, <-ch)
+			}
+
+			var ebuf bytes.Buffer
+			router = u.CreateRouter(&ebuf, ch)
+			router.ServeHTTP(BrokenWriter{},
+				httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.NotEmpty(t, ebuf.String(), "write errors are logged")
+			for len(ch) > 0 {
+				<-ch
+			}
+		})
+	}
+}
+
+func Test_Meters(t *testing.T) {
+	u44, err := udin.NewUdin("mock:UDIN-44", nil)
+	assert.NoError(t, err)
+	d := devices.NewDevices(map[string]*udin.UdinDevice{"udin_44": u44})
+	d.Update(devices.Device{Name: "light", Enabled: true})
+	m := meter.New(time.Hour)
+	assert.NoError(t, m.Load(map[string]meter.Config{
+		"udin_44-i1": {Name: "water", UnitsPerPulse: 0.5, Unit: "L",
+			Pulses: 3},
+	}))
+	tests := []struct {
+		uri   string
+		want  string
+		event *UIEvent
+	}{
+		{
+			uri:  "/",
+			want: "<td>udin_44-i1</td>\n            <td>water</td>\n            <td>0.5</td>",
+		},
+		{
+			uri:  "/",
+			want: "<td>1.5 L</td>",
+		},
+		{
+			uri:  "/api/meter/udin_44-i2/set?name=gas&upp=0.01&unit=m%C2%B3&class=gas",
+			want: `{"status":"ok","message":"setting meter on udin_44-i2"}`,
+			event: &UIEvent{Kind: UIMeterSetEvent,
+				Args: []string{"udin_44-i2", "gas", "0.01", "m³", "gas", ""}},
+		},
+		{
+			uri:  "/api/meter/udin_44-i2/set?name=gas&upp=x",
+			want: `invalid units per pulse \"x\"`,
+		},
+		{
+			uri:  "/api/meter/udin_44-i5/set?name=gas&upp=1",
+			want: "invalid input udin_44-i5",
+		},
+		{
+			uri:  "/api/meter/udin_44-i2/set?name=light&upp=1",
+			want: "meter name light already used by a device",
+		},
+		{
+			uri:  "/api/meter/udin_44-i2/set?name=water&upp=1",
+			want: "meter name water already used by udin_44-i1",
+		},
+		{
+			uri:   "/api/meter/udin_44-i1/delete",
+			want:  `{"status":"ok","message":"deleting meter on udin_44-i1"}`,
+			event: &UIEvent{Kind: UIMeterDeleteEvent, Args: []string{"udin_44-i1"}},
+		},
+		{
+			uri:  "/api/meter/udin_44-i2/delete",
+			want: "no meter on udin_44-i2",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			ch := make(chan UIEvent, 1)
+			var buf bytes.Buffer
+			u := NewUI(d, "0.0.1", 1)
+			u.Meters = m
+			router := u.CreateRouter(&buf, ch)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			assert.Contains(t, w.Body.String(), tc.want)
+			if tc.event == nil {
+				assert.Empty(t, ch, "event channel should be empty")
+			} else {
+				assert.Equal(t, *tc.event, <-ch)
+			}
+		})
+	}
+}
+
+func Test_TimingGuardOnly(t *testing.T) {
+	u8r, err := udin.NewUdin("mock", nil)
+	assert.NoError(t, err)
+	d := devices.NewDevices(map[string]*udin.UdinDevice{"udin_8r": u8r})
+	_, err = d.Create([]string{"door", "electriclock", "udin_8r-r7"}, true, "")
+	assert.NoError(t, err)
+	ch := make(chan UIEvent, 1)
+	router := NewUI(d, "0.0.1", 1).CreateRouter(&bytes.Buffer{}, ch)
+
+	// an unset pulse is left empty rather than showing the default
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, w.Body.String(),
+		"x-device=\"door\"\n                     placeholder=\"default\"\n"+
+			"                     value=\"\" />")
+
+	// so changing only the guard sends an empty pulse
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/api/door/timing//500ms", nil))
+	assert.Equal(t,
+		`{"status":"ok","message":"device door timing updated"}`,
+		w.Body.String())
+	e := <-ch
+	assert.Equal(t, NewUIEvent(UITimingEvent, "door", "0s", "500ms"), e)
+	pulse, err := time.ParseDuration(e.Args[1])
+	assert.NoError(t, err)
+	guard, err := time.ParseDuration(e.Args[2])
+	assert.NoError(t, err)
+	assert.NoError(t, d.SetTiming("door",
+		devices.Timing{Pulse: pulse, Guard: guard}))
+	assert.Equal(t, devices.Timing{Guard: 500 * time.Millisecond},
+		d.Device("door").Timing)
+}
@@ -9,32 +9,71 @@ function load() {
     }, 5000);
   }
 
+  // the definition fields of the selected type are rendered from the
+  // form metadata of the device type registry
+  var typeSelect = document.getElementById("type")
+  var fieldsElt = document.getElementById("fields")
+  function selectedForm() {
+    var opt = typeSelect.options[typeSelect.selectedIndex]
+    return JSON.parse(opt.getAttribute("x-form"))
+  }
+  function renderFields() {
+    fieldsElt.innerHTML = ""
+    selectedForm().fields.forEach(function (f) {
+      var label = document.createElement("label")
+      label.textContent = f.label + (f.optional ? " (optional)" : "") + ": "
+      var input = document.createElement("input")
+      input.type = "text"
+      input.name = f.name
+      if (f.kind == "relay" || f.kind == "relays") {
+        input.setAttribute("list", "relays")
+      } else if (f.kind == "input") {
+        input.setAttribute("list", "inputs")
+      } else if (f.kind == "devices") {
+        input.setAttribute("list", "deviceNames")
+      }
+      if (f.kind == "relays" || f.kind == "devices") {
+        input.placeholder = "comma separated"
+      } else if (f.kind == "duration") {
+        input.placeholder = "e.g. 500ms"
+      }
+      label.appendChild(input)
+      fieldsElt.appendChild(label)
+      fieldsElt.appendChild(document.createElement("br"))
+    })
+  }
+  typeSelect.addEventListener('change', renderFields)
+  renderFields()
+
   var x = document.getElementsByClassName("createRelay");
   var i;
   for (i = 0; i < x.length; i++) {
     x[i].addEventListener('click', (event) => {
-      var form = event.currentTarget.parentElement
-      var name = form.getElementsByTagName("input")[0].value
-      var selects = form.getElementsByTagName("select")
-      var openIdx = selects[0].selectedIndex
-      var open = selects[0].options[openIdx].text
-      var closeIdx = selects[1].selectedIndex
-      var close = selects[1].options[closeIdx].text
-      if (openIdx == closeIdx) {
-          setMessage("Please select different open/close relays!")
-          return;
-      }
-      var type = selects[2].selectedIndex
-      var param = name + "," + type + "," + open + "," + close
-      var xmlhttp = new XMLHttpRequest();
-      xmlhttp.onreadystatechange = function() {
-        if (this.readyState == 4 && this.status == 200) {
-          var resp = JSON.parse(this.responseText);
-          setMessage(resp.message)
+      var name = document.getElementById("name").value
+      var def = [name, typeSelect.value]
+      var missing = []
+      selectedForm().fields.forEach(function (f) {
+        var value = fieldsElt.querySelector(
+          "input[name='" + f.name + "']").value.trim()
+        if (value == "") {
+          if (!f.optional) {
+            missing.push(f.label)
+          }
+          return
         }
-      };
-      xmlhttp.open("GET", "/api/create/" + param, true);
-      xmlhttp.send()
+        var values = [value]
+        if (f.kind == "relays" || f.kind == "devices") {
+          values = value.split(",").map(function (v) { return v.trim() })
+        }
+        values.forEach(function (v) {
+          def.push((f.prefix || "") + v)
+        })
+      })
+      if (missing.length > 0) {
+        setMessage("Please enter " + missing.join(", "))
+        return;
+      }
+      request("/api/create/" + encodeURIComponent(def.join(",")))
     })
   }
 
@@ -60,4 +99,198 @@ function load() {
       xmlhttp.send()
     })
   }
+
+  var x = document.getElementsByClassName("timing");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('change', (event) => {
+      var row = event.currentTarget.parentElement.parentElement
+      var dev = event.currentTarget.getAttribute('x-device');
+      var pulse = row.getElementsByClassName("pulse")[0].value
+      var guard = row.getElementsByClassName("guard")[0].value
+      var xmlhttp = new XMLHttpRequest();
+      xmlhttp.onreadystatechange = function() {
+        if (this.readyState == 4) {
+          var resp = JSON.parse(this.responseText);
+          setMessage(resp.message)
+        }
+      };
+      xmlhttp.open("GET", "/api/" + dev + "/timing/" +
+                   encodeURIComponent(pulse) + "/" +
+                   encodeURIComponent(guard), true);
+      xmlhttp.send()
+    })
+  }
+
+  var x = document.getElementsByClassName("limit");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('change', (event) => {
+      var row = event.currentTarget.parentElement.parentElement
+      var dev = event.currentTarget.getAttribute('x-device');
+      var interval = row.getElementsByClassName("interval")[0].value
+      var policy = row.getElementsByClassName("policy")[0].value
+      request("/api/" + dev + "/limit/" + encodeURIComponent(interval) +
+              "/" + encodeURIComponent(policy))
+    })
+  }
+
+  function request(url) {
+    var xmlhttp = new XMLHttpRequest();
+    xmlhttp.onreadystatechange = function() {
+      if (this.readyState == 4) {
+        var resp = JSON.parse(this.responseText);
+        if (resp.errors) {
+          setMessage(resp.errors.map(function (e) {
+            return e.field + " " + e.value + ": " + e.reason
+          }).join("<br/>"))
+        } else {
+          setMessage(resp.message)
+        }
+      }
+    };
+    xmlhttp.open("GET", url, true);
+    xmlhttp.send()
+  }
+
+  var x = document.getElementsByClassName("invertRelay");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('change', (event) => {
+      var relay = event.currentTarget.getAttribute('x-relay');
+      request("/api/relay/" + relay + "/invert/" +
+              event.currentTarget.checked)
+    })
+  }
+
+  var x = document.getElementsByClassName("maxOn");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('change', (event) => {
+      var relay = event.currentTarget.getAttribute('x-relay');
+      var maxOn = event.currentTarget.value.trim() || "0s";
+      request("/api/relay/" + relay + "/maxon/" + encodeURIComponent(maxOn))
+    })
+  }
+
+  var x = document.getElementsByClassName("addSchedule");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var params = new URLSearchParams({
+        device: document.getElementById("scheduleDevice").value.trim(),
+        command: document.getElementById("scheduleCommand").value.trim(),
+        at: document.getElementById("scheduleAt").value.trim(),
+        days: document.getElementById("scheduleDays").value.trim(),
+      })
+      request("/api/schedule/add?" + params.toString())
+    })
+  }
+
+  var x = document.getElementsByClassName("deleteSchedule");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var id = event.currentTarget.getAttribute('x-id');
+      if (!confirm("Delete schedule " + id + "?")) {
+        return;
+      }
+      request("/api/schedule/" + id + "/delete")
+    })
+  }
+
+  var x = document.getElementsByClassName("addAutomation");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var params = new URLSearchParams({
+        input: document.getElementById("automationInput").value.trim(),
+        event: document.getElementById("automationEvent").value,
+        hold: document.getElementById("automationHold").value.trim(),
+        device: document.getElementById("automationDevice").value.trim(),
+        command: document.getElementById("automationCommand").value.trim(),
+      })
+      request("/api/automation/add?" + params.toString())
+    })
+  }
+
+  var x = document.getElementsByClassName("deleteAutomation");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var id = event.currentTarget.getAttribute('x-id');
+      if (!confirm("Delete automation " + id + "?")) {
+        return;
+      }
+      request("/api/automation/" + id + "/delete")
+    })
+  }
+
+  var x = document.getElementsByClassName("setMeter");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var input = document.getElementById("meterInput").value.trim();
+      var params = new URLSearchParams({
+        name: document.getElementById("meterName").value.trim(),
+        upp: document.getElementById("meterUpp").value.trim(),
+        unit: document.getElementById("meterUnit").value.trim(),
+        class: document.getElementById("meterClass").value,
+        debounce: document.getElementById("meterDebounce").value.trim(),
+      })
+      request("/api/meter/" + encodeURIComponent(input) + "/set?" +
+              params.toString())
+    })
+  }
+
+  var x = document.getElementsByClassName("deleteMeter");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var input = event.currentTarget.getAttribute('x-input');
+      if (!confirm("Delete meter on " + input + "?")) {
+        return;
+      }
+      request("/api/meter/" + input + "/delete")
+    })
+  }
+
+  var x = document.getElementsByClassName("renameDevice");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var dev = event.currentTarget.getAttribute('x-device');
+      var name = prompt("New name for " + dev, dev)
+      if (name == null || name == dev) {
+        return;
+      }
+      request("/api/" + dev + "/rename/" + encodeURIComponent(name))
+    })
+  }
+
+  var x = document.getElementsByClassName("editDevice");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var dev = event.currentTarget.getAttribute('x-device');
+      var def = event.currentTarget.getAttribute('x-def');
+      var newDef = prompt("Kind and definition for " + dev, def)
+      if (newDef == null || newDef == def) {
+        return;
+      }
+      request("/api/" + dev + "/edit/" + encodeURIComponent(newDef))
+    })
+  }
+
+  var x = document.getElementsByClassName("deleteDevice");
+  var i;
+  for (i = 0; i < x.length; i++) {
+    x[i].addEventListener('click', (event) => {
+      var dev = event.currentTarget.getAttribute('x-device');
+      if (!confirm("Delete " + dev + "?")) {
+        return;
+      }
+      request("/api/" + dev + "/delete")
+    })
+  }
 }